@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	exportOutput     string
+	importOnConflict string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [--output ARCHIVE_PATH]",
+	Short: "Export every stored image to an archive",
+	Long: `Export every image in the configured datastore, with its build history, to a
+line-delimited JSON archive. The first line is a header naming the archive format version
+and the datastore type it came from, and each following line is one image.
+
+The archive is written to stdout unless --output is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var wr io.Writer = os.Stdout
+		if exportOutput != "" {
+			file, err := os.Create(exportOutput)
+			if err != nil {
+				erWithDetails(err, "Could not create archive file")
+			}
+			defer file.Close()
+			wr = file
+		}
+		exported, err := comms.ExportImages(imageStore, wr, viper.GetString("datastore.type"))
+		if err != nil {
+			erWithDetails(err, "Failed to export images")
+		}
+		if exportOutput != "" {
+			fmt.Printf("Exported %d\n", exported)
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import ARCHIVE_PATH [--on-conflict skip|overwrite|fail]",
+	Short: "Import images from an archive made by export",
+	Long: `Import every image in an archive made by "image export" into the configured datastore.
+--on-conflict decides what happens to images that already exist:
+  skip      - leave the existing image alone
+  overwrite - replace the existing image and its history with the archived one
+  fail      - import nothing if any image already exists (default)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Must provide ARCHIVE_PATH", cmd)
+		}
+		policy, err := comms.ParseConflictPolicy(importOnConflict)
+		if err != nil {
+			erWithDetails(err, "Invalid --on-conflict value")
+		}
+		reader, err := os.Open(args[0])
+		if err != nil {
+			erWithDetails(err, "Could not read archive file")
+		}
+		defer reader.Close()
+		report, err := comms.ImportImages(imageStore, reader, policy)
+		if report != nil {
+			printImportReport(report)
+		}
+		if err != nil {
+			erWithDetails(err, "Failed to import images")
+		}
+	},
+}
+
+// printImportReport writes the names and counts of imported, overwritten and skipped images
+func printImportReport(report *comms.ImportReport) {
+	if len(report.Overwritten) > 0 {
+		notify(fmt.Sprintf("overwrote %s", strings.Join(report.Overwritten, ", ")))
+	}
+	if len(report.Skipped) > 0 {
+		notify(fmt.Sprintf("skipped %s", strings.Join(report.Skipped, ", ")))
+	}
+	fmt.Printf("Imported %d, overwritten %d, skipped %d\n", len(report.Imported), len(report.Overwritten), len(report.Skipped))
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "path to write the archive to instead of stdout")
+	importCmd.Flags().StringVar(&importOnConflict, "on-conflict", string(comms.ConflictFail), "what to do with images that already exist (skip | overwrite | fail)")
+	imageCmd.AddCommand(exportCmd)
+	imageCmd.AddCommand(importCmd)
+}
@@ -3,22 +3,17 @@ package cmd
 import (
 	"github.com/bypasslane/gzr/comms"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var buildCmd = &cobra.Command{
 	Use:   "build [DOCKER ARGS...]",
 	Short: "Wrapper around `docker build` to produce Docker artifacts as well as register data with gzr",
-	Long:  `Wrapper around "docker build" to produce Docker artifacts as well as register data with gzr`,
+	Long: `Wrapper around "docker build" to produce Docker artifacts as well as register data with gzr.
+The "builder" setting in the config file chooses what builds and pushes the image:
+docker (default), docker-api, buildah or podman`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		setupImageStore()
-
-		buildEnv := viper.GetString("build_env")
-		if buildEnv == "test" {
-			imageManager = comms.NewDefaultMockManager()
-		} else {
-			imageManager = comms.NewDockerManager()
-		}
+		setupImageManager()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		err := buildHandler(args, imageManager)
@@ -33,19 +28,22 @@ var buildCmd = &cobra.Command{
 }
 
 // buildHandler handles the arguments from running a build command.
-// The steps involved are as follows: Build image, create the metadata blob
-// that accompanies the image, create the tag for docker, use a transaction
-// to store the metadata and push the image
+// The steps involved are as follows: create the metadata blob that accompanies
+// the image, render the configured tag templates, build the image with every
+// tag and with the metadata as OCI labels so the image describes itself, use
+// a transaction to push every tag and store the metadata under every tag along
+// with the digest, size and layers the push produced. The transaction is rolled
+// back if pushing, inspecting or storing fails
 func buildHandler(args []string, manager comms.ImageManager) error {
-	err := manager.Build(args...)
+	meta, err := comms.NewImageMetadata()
 	if err != nil {
 		return err
 	}
-	meta, err := comms.NewImageMetadata()
+	tags, err := comms.GetDockerTags()
 	if err != nil {
 		return err
 	}
-	tag, err := comms.GetDockerTag()
+	err = manager.Build(comms.BuildOptions{Tags: tags, Labels: comms.MetadataLabels(meta)}, args...)
 	if err != nil {
 		return err
 	}
@@ -53,13 +51,21 @@ func buildHandler(args []string, manager comms.ImageManager) error {
 	if err != nil {
 		return err
 	}
-	err = imageStore.Store(tag, meta)
-	if err != nil {
-		return err
+	for _, tag := range tags {
+		err = manager.Push(tag)
+		if err != nil {
+			return rollbackTransaction(err)
+		}
 	}
-	err = manager.Push(tag)
+	meta.Registry, err = manager.Inspect(tags[0])
 	if err != nil {
-		return err
+		return rollbackTransaction(err)
+	}
+	for _, tag := range tags {
+		err = imageStore.Store(tag, meta)
+		if err != nil {
+			return rollbackTransaction(err)
+		}
 	}
 	err = imageStore.CommitTransaction()
 	if err != nil {
@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/bypasslane/gzr/comms"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -12,6 +16,15 @@ var (
 	storeCalled  bool
 	startCalled  bool
 	commitCalled bool
+
+	inspectCalled bool
+	storedMeta    comms.ImageMetadata
+	builtLabels   map[string]string
+	builtTags     []string
+	pushedTags    []string
+	storedTags    []string
+
+	rollbackCalled bool
 )
 
 // TestBuildHandler just ensures that all the correct functions are called
@@ -21,36 +34,112 @@ func TestBuildHandler(t *testing.T) {
 	storeCalled = false
 	startCalled = false
 	commitCalled = false
+	inspectCalled = false
 	imageStore = &comms.MockStore{
 		OnStore:             callStore,
 		OnStartTransaction:  callStart,
 		OnCommitTransaction: callCommit,
 	}
 	manager := &comms.MockManager{
-		OnBuild: callBuild,
-		OnPush:  callPush,
+		OnBuild:   callBuild,
+		OnPush:    callPush,
+		OnInspect: callInspect,
 	}
 	err := buildHandler([]string{}, manager)
 	if err != nil {
 		t.Errorf("buildHandler errored with %s", err.Error())
 	}
-	if !buildCalled || !pushCalled || !storeCalled || !startCalled || !commitCalled {
+	if !buildCalled || !pushCalled || !inspectCalled || !storeCalled || !startCalled || !commitCalled {
 		t.Error("buildHandler did not call the correct functions")
 	}
+	if storedMeta.Registry == nil || storedMeta.Registry.Digest != testDigest {
+		t.Errorf("buildHandler should store the pushed digest %q", testDigest)
+	}
+	if builtLabels[comms.OCIRevisionLabel] != storedMeta.GitCommit {
+		t.Errorf("buildHandler should label the image with the stored commit %q", storedMeta.GitCommit)
+	}
+}
+
+// TestBuildHandlerMultipleTags ensures that every configured tag is built, pushed and stored
+func TestBuildHandlerMultipleTags(t *testing.T) {
+	viper.Set("tag_templates", []string{comms.DefaultTagTemplate, "build-latest", "{{.GitTag}}"})
+	defer viper.Set("tag_templates", nil)
+	pushedTags = nil
+	storedTags = nil
+	imageStore = &comms.MockStore{
+		OnStore:             callStore,
+		OnStartTransaction:  callStart,
+		OnCommitTransaction: callCommit,
+	}
+	manager := &comms.MockManager{
+		OnBuild:   callBuild,
+		OnPush:    callPush,
+		OnInspect: callInspect,
+	}
+	err := buildHandler([]string{}, manager)
+	if err != nil {
+		t.Fatalf("buildHandler errored with %s", err.Error())
+	}
+	if len(builtTags) < 2 || !strings.HasSuffix(builtTags[1], ":build-latest") {
+		t.Errorf("buildHandler should build every configured tag, but built %v", builtTags)
+	}
+	if !reflect.DeepEqual(pushedTags, builtTags) || !reflect.DeepEqual(storedTags, builtTags) {
+		t.Errorf("buildHandler should push and store %v, but pushed %v and stored %v", builtTags, pushedTags, storedTags)
+	}
 }
 
-func callBuild(args ...string) error {
+// TestBuildHandlerPushFailure ensures that a failed push rolls back the transaction instead of committing it
+func TestBuildHandlerPushFailure(t *testing.T) {
+	commitCalled = false
+	rollbackCalled = false
+	imageStore = &comms.MockStore{
+		OnStore:               callStore,
+		OnStartTransaction:    callStart,
+		OnCommitTransaction:   callCommit,
+		OnRollbackTransaction: callRollback,
+	}
+	manager := &comms.MockManager{
+		OnBuild:   callBuild,
+		OnPush:    failPush,
+		OnInspect: callInspect,
+	}
+	err := buildHandler([]string{}, manager)
+	if err == nil {
+		t.Error("buildHandler should have errored when push failed")
+	}
+	if !rollbackCalled || commitCalled {
+		t.Error("buildHandler should roll back and not commit when push fails")
+	}
+}
+
+func callBuild(opts comms.BuildOptions, args ...string) error {
 	buildCalled = true
+	builtLabels = opts.Labels
+	builtTags = opts.Tags
 	return nil
 }
 
 func callPush(name string) error {
 	pushCalled = true
+	pushedTags = append(pushedTags, name)
 	return nil
 }
 
+func failPush(name string) error {
+	return errors.New("push failed")
+}
+
+const testDigest = "sha256:0d4f0f3ae4ec4fdd5d4d2d2ab43d4c4e1d7f0b6b9f2c2cb3bcbf2de1f1e0a7c3"
+
+func callInspect(name string) (*comms.RegistryInfo, error) {
+	inspectCalled = true
+	return &comms.RegistryInfo{Digest: testDigest, Size: 1024, Architecture: "amd64", Layers: 3}, nil
+}
+
 func callStore(name string, meta comms.ImageMetadata) error {
 	storeCalled = true
+	storedMeta = meta
+	storedTags = append(storedTags, name)
 	return nil
 }
 
@@ -63,3 +152,8 @@ func callCommit() error {
 	commitCalled = true
 	return nil
 }
+
+func callRollback() error {
+	rollbackCalled = true
+	return nil
+}
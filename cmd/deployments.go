@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/bypasslane/gzr/comms"
 	"github.com/spf13/cobra"
@@ -11,6 +12,18 @@ import (
 // Package-global k8s connection
 var k8sConn *comms.K8sConnection
 
+// forceUpdate deploys images that aren't in the metadata store
+var forceUpdate bool
+
+// toRevision is the revision to roll back to, 0 meaning the previous one
+var toRevision int64
+
+// waitForRollout waits for an updated Deployment to roll out, for up to rolloutTimeout
+var (
+	waitForRollout bool
+	rolloutTimeout time.Duration
+)
+
 // deploymentsCmd represents the deployments command
 var deploymentsCmd = &cobra.Command{
 	Use:   "deployments [subcommand]",
@@ -20,6 +33,8 @@ var deploymentsCmd = &cobra.Command{
 deployments list
 deployments get <DEPLOYMENT NAME>
 deployments update <DEPLOYMENT_NAME> <CONTAINER_NAME> <IMAGE>
+deployments rollback <DEPLOYMENT_NAME> [--to-revision N]
+deployments history <DEPLOYMENT_NAME>
 	`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		var connErr error
@@ -66,15 +81,95 @@ var deploymentUpdateCmd = &cobra.Command{
 	Use:   "update <DEPLOYMENT_NAME> <CONTAINER_NAME> <IMAGE> [flags]",
 	Short: "Update a container in a Deployment to a specific image",
 	Long: `Used to update a particular container in the Deployment's PodSpec by name.
+The image must exist in its Docker registry, and must be in gzr's metadata store
+as NAME:VERSION or NAME@DIGEST unless --force is given. --wait follows the rollout
+until every Pod runs the new image, and fails if the Deployment exceeds its progress
+deadline or the rollout takes longer than --timeout.
 
 deployments update mah-deployment some-pod-container coolthing:latest
+deployments update --force mah-deployment some-pod-container coolthing:untracked
+deployments update --wait --timeout 10m mah-deployment some-pod-container coolthing:latest
 	`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		setupImageStore()
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 3 {
 			erBadUsage("Not enough arguments", cmd)
 		}
 		updateDeploymentHandler(namespace, args[0], args[1], args[2])
 	},
+	PostRun: func(cmd *cobra.Command, args []string) {
+		imageStore.Cleanup()
+	},
+}
+
+// deploymentRollbackCmd rolls a Deployment back to a previous revision
+var deploymentRollbackCmd = &cobra.Command{
+	Use:   "rollback <DEPLOYMENT_NAME> [flags]",
+	Short: "Roll a Deployment back to a previous revision",
+	Long: `Used to restore the Deployment's PodSpec to the one it had at a previous revision,
+as kept in the Deployment's ReplicaSets. Without --to-revision the Deployment rolls back
+to the revision before the current one. The images of both revisions are shown with
+the git commits gzr's metadata store has for them.
+
+deployments rollback mah-deployment
+deployments rollback mah-deployment --to-revision 3
+	`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		setupImageStore()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Not enough arguments", cmd)
+		}
+		rollbackDeploymentHandler(args[0], toRevision)
+	},
+	PostRun: func(cmd *cobra.Command, args []string) {
+		imageStore.Cleanup()
+	},
+}
+
+// deploymentHistoryCmd lists a Deployment's revisions
+var deploymentHistoryCmd = &cobra.Command{
+	Use:   "history <DEPLOYMENT_NAME> [flags]",
+	Short: "List a Deployment's revisions with the code each one ran",
+	Long: `Used to list every revision kept in the Deployment's ReplicaSets, oldest first,
+with when it was created, its container images, and the git commit, tags and origin
+gzr's metadata store has for each image.
+
+deployments history mah-deployment
+	`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		setupImageStore()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Not enough arguments", cmd)
+		}
+		deploymentHistoryHandler(args[0])
+	},
+	PostRun: func(cmd *cobra.Command, args []string) {
+		imageStore.Cleanup()
+	},
+}
+
+// deploymentHistoryHandler prints a Deployment's revisions with their stored metadata
+func deploymentHistoryHandler(deploymentName string) {
+	revisions, err := comms.NewDeployer(k8sConn, imageStore).Revisions(deploymentName)
+	if err != nil {
+		erWithDetails(err, fmt.Sprintf("There was a problem retrieving the history of deployment %q", deploymentName))
+	}
+	revisions.SerializeForCLI(os.Stdout)
+}
+
+// rollbackDeploymentHandler rolls a Deployment back to the given revision and prints what changed
+func rollbackDeploymentHandler(deploymentName string, revision int64) {
+	rollback, err := comms.NewDeployer(k8sConn, imageStore).Rollback(deploymentName, revision)
+	if err != nil {
+		erWithDetails(err, fmt.Sprintf("There was a problem rolling back deployment %q", deploymentName))
+	}
+	rollback.SerializeForCLI(os.Stdout)
 }
 
 // updateDeploymentHandler updates a Deployment container with the info described by the DeploymentContainerInfo argument
@@ -85,14 +180,25 @@ func updateDeploymentHandler(namespace string, deploymentName string, containerN
 		ContainerName:  containerName,
 		Image:          image,
 	}
-	deployment, err := k8sConn.UpdateDeployment(dci)
+	deployment, err := comms.NewDeployer(k8sConn, imageStore).UpdateDeployment(dci, forceUpdate)
 
 	if err != nil {
 		erWithDetails(err, fmt.Sprintf("There was a problem updating container %q on deployment %q", containerName, deploymentName))
 	}
+	if waitForRollout {
+		deployment, err = k8sConn.WaitForRollout(deploymentName, rolloutTimeout, printRolloutStatus)
+		if err != nil {
+			erWithDetails(err, fmt.Sprintf("Deployment %q failed to roll out", deploymentName))
+		}
+	}
 	deployment.SerializeForCLI(os.Stdout)
 }
 
+// printRolloutStatus notes the progress of a Deployment's rollout
+func printRolloutStatus(status comms.RolloutStatus) {
+	notify(status.Message)
+}
+
 // getDeploymentHandler fetches
 func getDeploymentHandler(deploymentName string) {
 	deployment, err := k8sConn.GetDeployment(deploymentName)
@@ -117,6 +223,12 @@ func init() {
 	deploymentsCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "namespace to look for Deployments in")
 	deploymentsCmd.AddCommand(deploymentsListCmd)
 	deploymentsCmd.AddCommand(deploymentGetCmd)
+	deploymentUpdateCmd.Flags().BoolVar(&forceUpdate, "force", false, "deploy the image even if it isn't in the metadata store")
+	deploymentUpdateCmd.Flags().BoolVar(&waitForRollout, "wait", false, "wait for the Deployment to roll out")
+	deploymentUpdateCmd.Flags().DurationVar(&rolloutTimeout, "timeout", comms.DefaultRolloutTimeout, "how long --wait waits for the rollout")
 	deploymentsCmd.AddCommand(deploymentUpdateCmd)
+	deploymentRollbackCmd.Flags().Int64Var(&toRevision, "to-revision", 0, "revision to roll back to, the previous one if 0")
+	deploymentsCmd.AddCommand(deploymentRollbackCmd)
+	deploymentsCmd.AddCommand(deploymentHistoryCmd)
 	RootCmd.AddCommand(deploymentsCmd)
 }
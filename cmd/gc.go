@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	gcDryRun     bool
+	gcNamespaces []string
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc [--dry-run] [--namespace NAMESPACE...]",
+	Short: "Delete stored images that no retention rule keeps",
+	Long: `Evaluate the retention rules in the config file against every stored image, print
+what is kept and what would be removed, and delete the removed images in a single transaction.
+
+An image is kept if any rule matches it:
+{
+    "retention": {
+        "keep_last": <int>,    keep the newest N versions of every image name
+        "keep_days": <int>,    keep every image created within the last N days
+        "keep_tagged": <bool>  keep every image with a git tag (default true)
+    }
+}
+
+Images used by a live Deployment, StatefulSet, DaemonSet or CronJob are always kept, whether
+they are referenced by NAME:VERSION or by the digest the image was pushed with. Workloads in
+every namespace are checked unless --namespace names the ones to check.
+
+On etcd all the deletions are made in a single Txn, so collecting many images at once may
+need etcd's --max-txn-ops flag raised.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		policy := &comms.RetentionPolicy{
+			KeepLast:   viper.GetInt("retention.keep_last"),
+			KeepDays:   viper.GetInt("retention.keep_days"),
+			KeepTagged: viper.GetBool("retention.keep_tagged"),
+		}
+		deployed, err := deployedImages(gcNamespaces)
+		if err != nil {
+			erWithDetails(err, "Failed to find deployed images; refusing to collect anything")
+		}
+		decisions, deleted, err := comms.CollectGarbage(imageStore, policy, deployed, gcDryRun)
+		printRetentionDecisions(decisions)
+		if err != nil {
+			erWithDetails(err, "Failed to collect images")
+		}
+		if !gcDryRun {
+			fmt.Printf("Deleted %d\n", deleted)
+		}
+	},
+}
+
+// deployedImages returns the set of images used by the workloads in the namespaces, or in
+// every namespace if none are given
+func deployedImages(namespaces []string) (map[string]bool, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	deployed := make(map[string]bool)
+	for _, ns := range namespaces {
+		conn, err := comms.NewK8sConnection(ns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to connect to k8s for namespace %q", ns)
+		}
+		workloads, err := conn.ListWorkloads("")
+		if err != nil {
+			return nil, err
+		}
+		for _, workload := range workloads.Workloads {
+			for _, container := range workload.Containers {
+				addDeployedImage(deployed, container.Image)
+			}
+		}
+	}
+	return deployed, nil
+}
+
+// addDeployedImage adds image to deployed. A NAME:TAG@DIGEST reference runs the digest
+// whatever the tag is, so it's also added as NAME@DIGEST
+func addDeployedImage(deployed map[string]bool, image string) {
+	deployed[image] = true
+	at := strings.Index(image, "@")
+	if at < 0 {
+		return
+	}
+	name := image[:at]
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		deployed[name[:colon]+image[at:]] = true
+	}
+}
+
+// printRetentionDecisions writes what is kept and what is removed, and why
+func printRetentionDecisions(decisions []*comms.RetentionDecision) {
+	action := "remove"
+	if gcDryRun {
+		action = "would remove"
+	}
+	for _, decision := range decisions {
+		if decision.Keep {
+			notify(fmt.Sprintf("keep %s: %s", decision.Image.Name, decision.Reason))
+		} else {
+			notify(fmt.Sprintf("%s %s: %s", action, decision.Image.Name, decision.Reason))
+		}
+	}
+}
+
+func init() {
+	viper.SetDefault("retention.keep_tagged", true)
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "only print what would be removed")
+	gcCmd.Flags().StringSliceVarP(&gcNamespaces, "namespace", "n", nil, "namespaces whose workloads' images are always kept (default every namespace)")
+	imageCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddDeployedImage_AddsDigestWithoutTag(t *testing.T) {
+	deployed := make(map[string]bool)
+	addDeployedImage(deployed, "registry:5000/repo/app:1")
+	addDeployedImage(deployed, "registry:5000/repo/app:2@sha256:abc")
+	addDeployedImage(deployed, "registry:5000/repo/other@sha256:def")
+
+	expected := map[string]bool{
+		"registry:5000/repo/app:1":            true,
+		"registry:5000/repo/app:2@sha256:abc": true,
+		"registry:5000/repo/app@sha256:abc":   true,
+		"registry:5000/repo/other@sha256:def": true,
+	}
+	if !reflect.DeepEqual(deployed, expected) {
+		t.Errorf("Expected %v, but got %v", expected, deployed)
+	}
+}
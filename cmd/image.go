@@ -4,10 +4,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/bypasslane/gzr/comms"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,8 +17,24 @@ import (
 
 var latest bool
 
+// findQuery holds the flags for the find command
+var findQuery comms.ImageQuery
+
+// labelSelectors holds the KEY=VALUE label flags for the get command
+var labelSelectors []string
+
+// listLimit, listSort and listContinue hold the paging flags for the get command
+var (
+	listLimit    int
+	listSort     string
+	listContinue string
+)
+
+// schemaVersion holds the version flag for the schema command
+var schemaVersion int
+
 var imageCmd = &cobra.Command{
-	Use:   "image (store|get|delete)",
+	Use:   "image (store|get|history|find|delete|schema|migrate|export|import|gc|sync-registry|inspect-labels)",
 	Short: "manage information about images",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		setupImageStore()
@@ -35,17 +53,28 @@ var storeCmd = &cobra.Command{
 	Use:   "store IMAGE_NAME:VERSION METADATA_PATH",
 	Short: "Store metadata about an image for gzr to track",
 	Long: `Used to store metadata about an image for gzr to track. The name must be formatted as NAME:VERSION.
-Repeated store calls with the same VERSION on the same day will only keep the newest, but different days will be stored.
-In short, only one version per day is allowed.
+Repeated store calls with the same VERSION are all kept as numbered builds. "get" shows the newest
+build of each version and "history" shows every build of a single version.
 
-The structure of the JSON at the METADATA_PATH should be as follows:
+The JSON at the METADATA_PATH is validated against the JSON Schema of its "schema-version",
+printed by "gzr image schema". Documents without a "schema-version" are version 1 and are
+upgraded to the current version when stored. The structure of a current document is:
 {
+    "schema-version": 2,
     "git-commit": <string>,
     "git-tag": [<string>, <string>, ...],
     "git-annotation": [<string>, <string>, ...],
     "git-origin": <string>,
-    "created-at": <ISO 8601-formatted string>
-}`,
+    "created-at": <RFC 3339-formatted string with a time zone>,
+    "labels": {<string>: <string>, ...},
+    "ci": {
+        "build-url": <string>,
+        "job": <string>,
+        "number": <int>
+    },
+    "issues": [<string>, <string>, ...]
+}
+"labels", "ci" and "issues" are optional.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 2 {
 			erBadUsage("Must provide IMAGE_NAME:VERSION and METADATA_PATH", cmd)
@@ -64,7 +93,7 @@ The structure of the JSON at the METADATA_PATH should be as follows:
 		}
 		err = imageStore.Store(args[0], meta)
 		if err != nil {
-			erWithDetails(err, "Error storing image")
+			erWithDetails(rollbackTransaction(err), "Error storing image")
 		}
 		err = imageStore.CommitTransaction()
 		if err != nil {
@@ -75,14 +104,27 @@ The structure of the JSON at the METADATA_PATH should be as follows:
 }
 
 var getCmd = &cobra.Command{
-	Use:   "get IMAGE_NAME",
+	Use:   "get IMAGE_NAME [--label KEY=VALUE...] [--limit N] [--sort ORDER] [--continue TOKEN]",
 	Short: "Get data about the stored images under a particular name",
 	Long: `Get all metadata about the stored images under a particular name,
-including all versions held within gzr`,
+including all versions held within gzr. With --label only the images that
+have every given label are listed.
+
+With --limit at most N images are listed, followed by a token to pass to
+--continue for the next page. --sort orders images by version (the default),
+created-at (oldest first) or -created-at (newest first)`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 1 {
 			erBadUsage("Must provide IMAGE_NAME", cmd)
 		}
+		labels, err := comms.ParseLabelSelectors(labelSelectors)
+		if err != nil {
+			erBadUsage(err.Error(), cmd)
+		}
+		sort, err := comms.ParseListSort(listSort)
+		if err != nil {
+			erBadUsage(err.Error(), cmd)
+		}
 		name := fmt.Sprintf("%s/%s", viper.GetString("repository"), args[0])
 		if latest {
 			image, err := imageStore.GetLatest(name)
@@ -91,7 +133,8 @@ including all versions held within gzr`,
 			}
 			image.SerializeForCLI(os.Stdout)
 		} else {
-			images, err := imageStore.List(name)
+			opts := comms.ListOptions{Limit: listLimit, Sort: sort, Continue: listContinue, Labels: labels}
+			images, err := imageStore.List(name, opts)
 			if err != nil {
 				erWithDetails(err, "Failed to get images")
 			}
@@ -100,6 +143,45 @@ including all versions held within gzr`,
 	},
 }
 
+var historyCmd = &cobra.Command{
+	Use:   "history IMAGE_NAME:VERSION",
+	Short: "Get every stored build of an image:version",
+	Long: `Get the full build history of a single image version, oldest first,
+with the build number and time each build was stored`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Must provide IMAGE_NAME:VERSION", cmd)
+		}
+		name := fmt.Sprintf("%s/%s", viper.GetString("repository"), args[0])
+		history, err := imageStore.History(name)
+		if err != nil {
+			erWithDetails(err, "Failed to get image history")
+		}
+		history.SerializeForCLI(os.Stdout)
+	},
+}
+
+var findCmd = &cobra.Command{
+	Use:   "find [--commit SHA] [--tag TAG] [--origin ORIGIN] [--digest DIGEST]",
+	Short: "Find stored images by git commit, tag, origin or registry digest",
+	Long: `Find every stored image, across all names, built from a matching commit, tag or origin.
+When several flags are given an image must match all of them. Short and full commit hashes
+find each other. Images found by --digest are the same pushed artifact under different tags.
+
+image find --commit 3b70356
+image find --digest sha256:0d4f...`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if findQuery.IsEmpty() {
+			erBadUsage("Must provide --commit, --tag, --origin or --digest", cmd)
+		}
+		images, err := imageStore.Find(findQuery)
+		if err != nil {
+			erWithDetails(err, "Failed to find images")
+		}
+		images.SerializeForCLI(os.Stdout)
+	},
+}
+
 var deleteCmd = &cobra.Command{
 	Use:   "delete IMAGE_NAME:VERSION",
 	Short: "Delete metadata about an image:version within gzr",
@@ -118,7 +200,7 @@ var deleteCmd = &cobra.Command{
 		name := fmt.Sprintf("%s/%s", viper.GetString("repository"), args[0])
 		deleted, err := imageStore.Delete(name)
 		if err != nil {
-			erWithDetails(err, "Failed to delete image")
+			erWithDetails(rollbackTransaction(err), "Failed to delete image")
 		}
 		err = imageStore.CommitTransaction()
 		if err != nil {
@@ -128,10 +210,71 @@ var deleteCmd = &cobra.Command{
 	},
 }
 
+var schemaCmd = &cobra.Command{
+	Use:   "schema [--version N]",
+	Short: "Print the JSON Schema for image metadata documents",
+	Long: `Print the JSON Schema that "store" validates metadata documents against.
+Defaults to the current schema version`,
+	PersistentPreRun:  func(cmd *cobra.Command, args []string) {},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+	Run: func(cmd *cobra.Command, args []string) {
+		schema, err := comms.MetadataSchema(schemaVersion)
+		if err != nil {
+			erBadUsage(err.Error(), cmd)
+		}
+		fmt.Println(schema)
+	},
+}
+
+var inspectLabelsCmd = &cobra.Command{
+	Use:   "inspect-labels IMAGE",
+	Short: "Print the metadata recorded in a local image's OCI labels",
+	Long: `Read the org.opencontainers.image.* labels that "gzr build" sets on the images it builds,
+and print the metadata they describe as a document "store" accepts. Fields that no label
+was found for are noted.
+
+image inspect-labels gzr-dev/my-app:20170210.3b70356`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		setupImageManager()
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Must provide IMAGE", cmd)
+		}
+		labels, err := imageManager.Labels(args[0])
+		if err != nil {
+			erWithDetails(err, "Failed to read image labels")
+		}
+		meta, missing := comms.MetadataFromLabels(labels, "")
+		if len(missing) > 0 {
+			log.Warnf("Could not find %s in the labels of %s", strings.Join(missing, ", "), args[0])
+		}
+		document, err := json.MarshalIndent(meta, "", "    ")
+		if err != nil {
+			erWithDetails(err, "Failed to convert metadata to json")
+		}
+		fmt.Println(string(document))
+	},
+}
+
 func init() {
 	getCmd.Flags().BoolVarP(&latest, "latest", "l", false, "option to just get the latest image")
+	getCmd.Flags().StringSliceVar(&labelSelectors, "label", nil, "only list images with this label, as KEY=VALUE; may be repeated")
+	getCmd.Flags().IntVar(&listLimit, "limit", 0, "list at most this many images, 0 lists every image")
+	getCmd.Flags().StringVar(&listSort, "sort", string(comms.SortByVersion), "order images by version, created-at or -created-at")
+	getCmd.Flags().StringVar(&listContinue, "continue", "", "continue token printed with the previous page")
 	imageCmd.AddCommand(storeCmd)
 	imageCmd.AddCommand(getCmd)
+	imageCmd.AddCommand(historyCmd)
+	findCmd.Flags().StringVar(&findQuery.GitCommit, "commit", "", "git commit hash, short or full")
+	findCmd.Flags().StringVar(&findQuery.GitTag, "tag", "", "git tag")
+	findCmd.Flags().StringVar(&findQuery.GitOrigin, "origin", "", "git remote origin")
+	findCmd.Flags().StringVar(&findQuery.Digest, "digest", "", "registry manifest digest, as sha256:HEX")
+	imageCmd.AddCommand(findCmd)
 	imageCmd.AddCommand(deleteCmd)
+	schemaCmd.Flags().IntVar(&schemaVersion, "version", comms.CurrentSchemaVersion, "schema version to print")
+	imageCmd.AddCommand(schemaCmd)
+	imageCmd.AddCommand(inspectLabelsCmd)
 	RootCmd.AddCommand(imageCmd)
 }
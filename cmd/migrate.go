@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateFrom   string
+	migrateTo     string
+	migrateDryRun bool
+)
+
+// migrateSource and migrateDestination are the stores being migrated between
+var migrateSource, migrateDestination comms.GzrMetadataStore
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate --from TYPE --to TYPE [--dry-run]",
+	Short: "Copy every image from one datastore backend to another",
+	Long: `Copy every image and its build history from one datastore backend to another,
+then verify that the destination holds the same number of images with matching histories.
+Images that already exist in the destination are skipped.
+
+Each backend is configured by its own block in the config file, in the same format as "datastore":
+{
+    "migrate": {
+        "from": {"db_path": "/Users/gzr-dev/.gzr/gzr.db"},
+        "to": {"host": "http://localhost", "port": 2379}
+    }
+}
+
+image migrate --from bolt --to etcd --dry-run`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if migrateFrom == "" || migrateTo == "" {
+			erBadUsage("Must provide --from and --to datastore types", cmd)
+		}
+		var err error
+		migrateSource, err = newImageStoreFromConfig(migrateFrom, "migrate.from")
+		if err != nil {
+			erWithDetails(err, "Failed to initialize source store")
+		}
+		migrateDestination, err = newImageStoreFromConfig(migrateTo, "migrate.to")
+		if err != nil {
+			migrateSource.Cleanup()
+			erWithDetails(err, "Failed to initialize destination store")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := comms.MigrateImages(migrateSource, migrateDestination, migrateDryRun)
+		if report != nil {
+			printMigrationReport(report)
+		}
+		if err != nil {
+			erWithDetails(err, "Failed to migrate images")
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		migrateSource.Cleanup()
+		migrateDestination.Cleanup()
+	},
+}
+
+// printMigrationReport writes a line per image and a summary of the migration
+func printMigrationReport(report *comms.MigrationReport) {
+	action := "copied"
+	if migrateDryRun {
+		action = "would copy"
+	}
+	for _, result := range report.Results {
+		if result.Skipped {
+			notify(fmt.Sprintf("skipped %s: already in %s", result.Name, migrateTo))
+		} else {
+			notify(fmt.Sprintf("%s %s (%d builds, sha256 %s)", action, result.Name, result.Builds, result.Checksum))
+		}
+	}
+	for _, name := range report.Mismatches {
+		notify(fmt.Sprintf("MISMATCH %s: history in %s differs from %s", name, migrateTo, migrateFrom))
+	}
+	fmt.Printf("Source images: %d, %s: %d, skipped: %d\n", report.SourceCount, action, report.Copied(), len(report.Results)-report.Copied())
+	if !migrateDryRun {
+		fmt.Printf("Destination images: %d, mismatched: %d\n", report.DestinationCount, len(report.Mismatches))
+	}
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "datastore type to copy images from")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "datastore type to copy images to")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "only report what would be copied")
+	imageCmd.AddCommand(migrateCmd)
+}
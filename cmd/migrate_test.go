@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewImageStoreFromConfig_LeavesDatastoreAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzr-migrate")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("datastore", map[string]interface{}{"type": "bolt", "db_path": "/tmp/gzr.db"})
+	viper.Set("migrate.from", map[string]interface{}{"root_path": dir})
+	defer viper.Reset()
+
+	store, err := newImageStoreFromConfig("file", "migrate.from")
+	if err != nil {
+		t.Fatalf("newImageStoreFromConfig errored with %s", err)
+	}
+	defer store.Cleanup()
+
+	if storeType := viper.GetString("datastore.type"); storeType != "bolt" {
+		t.Errorf("Expected datastore type to stay %q, but it became %q", "bolt", storeType)
+	}
+	if _, ok := viper.GetStringMap("datastore")["root_path"]; ok {
+		t.Error("Expected the migrate.from settings not to be copied into datastore")
+	}
+}
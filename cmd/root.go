@@ -41,6 +41,12 @@ func init() {
 	viper.BindPFlag("log-format", RootCmd.PersistentFlags().Lookup("log-format"))
 	registeredInterfaces["etcd"] = comms.NewEtcdStorage
 	registeredInterfaces["bolt"] = comms.NewBoltStorage
+	registeredInterfaces["file"] = comms.NewFileStorage
+	registeredInterfaces["postgres"] = comms.NewPostgresStorage
+	registeredBuilders["docker"] = func() (comms.ImageManager, error) { return comms.NewDockerManager(), nil }
+	registeredBuilders["docker-api"] = func() (comms.ImageManager, error) { return comms.NewDockerEngineManager(printProgress) }
+	registeredBuilders["buildah"] = func() (comms.ImageManager, error) { return comms.NewBuildahManager(), nil }
+	registeredBuilders["podman"] = func() (comms.ImageManager, error) { return comms.NewPodmanManager(), nil }
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var syncDryRun bool
+
+var syncRegistryCmd = &cobra.Command{
+	Use:   "sync-registry IMAGE_NAME [--dry-run]",
+	Short: "Create metadata for images in the registry that gzr doesn't know about",
+	Long: `List every tag of IMAGE_NAME in its Docker registry and create metadata for each
+tag that isn't stored yet. The metadata is read from the standard OCI labels of the image:
+  org.opencontainers.image.revision - git-commit
+  org.opencontainers.image.source   - git-origin
+  org.opencontainers.image.version  - git-tag, separated by spaces
+  org.opencontainers.image.created  - created-at, or the image's creation time without it
+along with the image's digest, size, architecture and layer count.
+
+Every image that is imported is printed with the fields that couldn't be inferred, and
+images that couldn't be read are printed with the reason. Credentials for private
+registries are read from "registry.username" and "registry.password" in the config file.
+
+image sync-registry my-app
+image sync-registry --dry-run my-app`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Must provide IMAGE_NAME", cmd)
+		}
+		repository := fmt.Sprintf("%s/%s", viper.GetString("repository"), args[0])
+		report, err := comms.SyncRegistry(imageStore, comms.NewRegistryClient(), repository, syncDryRun)
+		if err != nil {
+			erWithDetails(err, "Failed to sync images from the registry")
+		}
+		printSyncReport(report)
+	},
+}
+
+// printSyncReport writes what was imported and what was inferred, and what couldn't be imported
+func printSyncReport(report *comms.SyncReport) {
+	action := "imported"
+	if syncDryRun {
+		action = "would import"
+	}
+	for _, image := range report.Imported {
+		if len(image.Missing) > 0 {
+			notify(fmt.Sprintf("%s %s: could not infer %s", action, image.Name, strings.Join(image.Missing, ", ")))
+		} else {
+			notify(fmt.Sprintf("%s %s", action, image.Name))
+		}
+	}
+	for _, failure := range report.Failed {
+		notify(fmt.Sprintf("failed %s: %s", failure.Name, failure.Err))
+	}
+	summary := "Imported"
+	if syncDryRun {
+		summary = "Would import"
+	}
+	fmt.Printf("%s %d, already stored %d, failed %d\n", summary, len(report.Imported), len(report.Existing), len(report.Failed))
+}
+
+func init() {
+	syncRegistryCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "only print what would be imported")
+	imageCmd.AddCommand(syncRegistryCmd)
+}
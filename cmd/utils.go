@@ -24,11 +24,17 @@ var logFormat string
 var imageStore comms.GzrMetadataStore
 
 // available interfaces for image storage
-var registeredInterfaces = make(map[string]func() (comms.GzrMetadataStore, error))
+var registeredInterfaces = make(map[string]func(*viper.Viper) (comms.GzrMetadataStore, error))
 
 // imageManager is the backing for image managing (building, pushing)
 var imageManager comms.ImageManager
 
+// available builders for image managing, selected by "builder"
+var registeredBuilders = make(map[string]func() (comms.ImageManager, error))
+
+// DefaultBuilder is the builder used when "builder" isn't configured
+const DefaultBuilder = "docker"
+
 // er prints an error message and exits. Lifted from Cobra source.
 func er(msg interface{}) {
 	log.Error(msg)
@@ -61,6 +67,16 @@ func notify(msg string) {
 	fmt.Printf("[-] %s\n", msg)
 }
 
+// rollbackTransaction rolls back the active imageStore transaction after err and returns err,
+// noting the rollback failure if there was one
+func rollbackTransaction(err error) error {
+	rollbackErr := imageStore.RollbackTransaction()
+	if rollbackErr != nil {
+		return errors.Wrapf(err, "Failed to roll back transaction: %s", rollbackErr)
+	}
+	return err
+}
+
 func setupImageStore() {
 	storeType := viper.GetString("datastore.type")
 	if storeType == "" {
@@ -71,15 +87,70 @@ func setupImageStore() {
 		er("Must provide \"repository\" setting in config file")
 	}
 
-	var storeCreator func() (comms.GzrMetadataStore, error)
-	if creator, ok := registeredInterfaces[storeType]; !ok {
-		er(fmt.Sprintf("%s is not a valid datastore type", storeType))
-	} else {
-		storeCreator = creator
-	}
-	newStore, err := storeCreator()
+	newStore, err := newImageStore(storeType, storeConfig("datastore"))
 	if err != nil {
 		erWithDetails(err, "Failed to initialize store")
 	}
 	imageStore = newStore
 }
+
+// setupImageManager sets the imageManager, which is a no-op mock when "build_env" is "test".
+// Otherwise it is the builder registered for "builder", DefaultBuilder when it isn't configured
+func setupImageManager() {
+	buildEnv := viper.GetString("build_env")
+	if buildEnv == "test" {
+		imageManager = comms.NewDefaultMockManager()
+		return
+	}
+	builder := viper.GetString("builder")
+	if builder == "" {
+		builder = DefaultBuilder
+	}
+	creator, ok := registeredBuilders[builder]
+	if !ok {
+		er(fmt.Sprintf("%s is not a valid builder", builder))
+	}
+	manager, err := creator()
+	if err != nil {
+		erWithDetails(err, "Failed to initialize builder")
+	}
+	imageManager = manager
+}
+
+// printProgress writes build output and push status from the Docker Engine API to stdout
+func printProgress(msg *comms.ProgressMessage) {
+	switch {
+	case msg.Stream != "":
+		fmt.Print(msg.Stream)
+	case msg.Status != "" && msg.ID != "":
+		fmt.Printf("%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+	case msg.Status != "":
+		fmt.Println(msg.Status)
+	}
+}
+
+// newImageStore creates a GzrMetadataStore with the creator registered for storeType, configured by config
+func newImageStore(storeType string, config *viper.Viper) (comms.GzrMetadataStore, error) {
+	creator, ok := registeredInterfaces[storeType]
+	if !ok {
+		return nil, errors.Errorf("%s is not a valid datastore type", storeType)
+	}
+	return creator(config)
+}
+
+// newImageStoreFromConfig creates a GzrMetadataStore of storeType using the datastore
+// settings found under configKey instead of the "datastore" block
+func newImageStoreFromConfig(storeType string, configKey string) (comms.GzrMetadataStore, error) {
+	store, err := newImageStore(storeType, storeConfig(configKey))
+	return store, errors.Wrapf(err, "Failed to initialize %s store from %q", storeType, configKey)
+}
+
+// storeConfig returns the block of datastore settings under key on its own, leaving the
+// global config untouched so stores configured by different blocks can be open at once
+func storeConfig(key string) *viper.Viper {
+	config := viper.Sub(key)
+	if config == nil {
+		return viper.New()
+	}
+	return config
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/spf13/cobra"
+)
+
+// workloadKind is the --kind flag of the workloads commands
+var workloadKind string
+
+// workloadsCmd represents the workloads command
+var workloadsCmd = &cobra.Command{
+	Use:   "workloads [subcommand]",
+	Short: "Manage k8s Deployments, StatefulSets, DaemonSets and CronJobs",
+	Long: `Used to get information on workloads of every kind or update them.
+--kind is one of deployment, statefulset, daemonset or cronjob. It filters
+list, and is only needed by get and update when workloads of different kinds
+share a name
+
+workloads list [--kind KIND]
+workloads get <WORKLOAD_NAME> [--kind KIND]
+workloads update <WORKLOAD_NAME> <CONTAINER_NAME> <IMAGE> [--kind KIND]
+	`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		var connErr error
+		k8sConn, connErr = comms.NewK8sConnection(namespace)
+		if connErr != nil {
+			erWithDetails(connErr, "problem establishing k8s connection")
+		}
+	},
+}
+
+// workloadsListCmd lists workloads
+var workloadsListCmd = &cobra.Command{
+	Use:   "list [flags]",
+	Short: "List k8s workloads",
+	Long: `Used to get the containers of every workload, or of every workload of one kind.
+
+workloads list
+workloads list --kind statefulset
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listWorkloadsHandler(parseWorkloadKind(cmd))
+	},
+}
+
+// workloadsGetCmd gets a single workload
+var workloadsGetCmd = &cobra.Command{
+	Use:   "get <WORKLOAD_NAME> [flags]",
+	Short: "Get a k8s workload by name",
+	Long: `Used to get a single workload by name, showing its containers.
+
+workloads get mah-statefulset
+workloads get --kind cronjob mah-job
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			erBadUsage("Not enough arguments", cmd)
+		}
+		getWorkloadHandler(parseWorkloadKind(cmd), args[0])
+	},
+}
+
+// workloadsUpdateCmd updates a container of a single workload
+var workloadsUpdateCmd = &cobra.Command{
+	Use:   "update <WORKLOAD_NAME> <CONTAINER_NAME> <IMAGE> [flags]",
+	Short: "Update a container in a workload to a specific image",
+	Long: `Used to update a particular container in the workload's PodSpec by name.
+The image must exist in its Docker registry, and must be in gzr's metadata store
+as NAME:VERSION or NAME@DIGEST unless --force is given.
+
+workloads update --kind daemonset mah-daemonset some-pod-container coolthing:latest
+workloads update --force mah-job some-pod-container coolthing:untracked
+	`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		setupImageStore()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 3 {
+			erBadUsage("Not enough arguments", cmd)
+		}
+		updateWorkloadHandler(parseWorkloadKind(cmd), args[0], args[1], args[2])
+	},
+	PostRun: func(cmd *cobra.Command, args []string) {
+		imageStore.Cleanup()
+	},
+}
+
+// parseWorkloadKind returns the kind named by --kind, or an empty kind if it wasn't given
+func parseWorkloadKind(cmd *cobra.Command) comms.WorkloadKind {
+	if workloadKind == "" {
+		return ""
+	}
+	kind, err := comms.ParseWorkloadKind(workloadKind)
+	if err != nil {
+		erBadUsage(err.Error(), cmd)
+	}
+	return kind
+}
+
+// listWorkloadsHandler fetches workloads and prints them to the CLI
+func listWorkloadsHandler(kind comms.WorkloadKind) {
+	workloads, err := k8sConn.ListWorkloads(kind)
+	if err != nil {
+		erWithDetails(err, "Error retrieving workloads")
+	}
+	workloads.SerializeForCLI(os.Stdout)
+}
+
+// getWorkloadHandler fetches a workload and prints it to the CLI
+func getWorkloadHandler(kind comms.WorkloadKind, name string) {
+	workload, err := k8sConn.GetWorkload(kind, name)
+	if err != nil {
+		erWithDetails(err, fmt.Sprintf("There was a problem retrieving workload %q", name))
+	}
+	workload.SerializeForCLI(os.Stdout)
+}
+
+// updateWorkloadHandler updates a workload container to the given image
+func updateWorkloadHandler(kind comms.WorkloadKind, name string, containerName string, image string) {
+	wci := &comms.WorkloadContainerInfo{
+		Kind:          kind,
+		Name:          name,
+		ContainerName: containerName,
+		Image:         image,
+	}
+	workload, err := comms.NewDeployer(k8sConn, imageStore).UpdateWorkload(wci, forceUpdate)
+	if err != nil {
+		erWithDetails(err, fmt.Sprintf("There was a problem updating container %q on workload %q", containerName, name))
+	}
+	workload.SerializeForCLI(os.Stdout)
+}
+
+func init() {
+	workloadsCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "default", "namespace to look for workloads in")
+	workloadsCmd.PersistentFlags().StringVarP(&workloadKind, "kind", "k", "", "kind of workload: deployment, statefulset, daemonset or cronjob")
+	workloadsCmd.AddCommand(workloadsListCmd)
+	workloadsCmd.AddCommand(workloadsGetCmd)
+	workloadsUpdateCmd.Flags().BoolVar(&forceUpdate, "force", false, "deploy the image even if it isn't in the metadata store")
+	workloadsCmd.AddCommand(workloadsUpdateCmd)
+	RootCmd.AddCommand(workloadsCmd)
+}
@@ -0,0 +1,202 @@
+package comms
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ArchiveFormat identifies a gzr image archive in its header
+	ArchiveFormat = "gzr-image-archive"
+	// ArchiveVersion is the archive format version written by ExportImages
+	ArchiveVersion = 1
+)
+
+// ConflictPolicy decides what ImportImages does with an image that already exists in the store
+type ConflictPolicy string
+
+const (
+	// ConflictSkip leaves the existing image alone
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite deletes the existing image and imports the archived one
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictFail aborts the import before anything is written
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// ArchiveHeader is the first line of an image archive
+type ArchiveHeader struct {
+	// Format is always ArchiveFormat
+	Format string `json:"format"`
+	// Version is the archive format version
+	Version int `json:"version"`
+	// Source is the datastore type the archive was exported from
+	Source string `json:"source"`
+	// ExportedAt is the time the export started
+	ExportedAt string `json:"exported-at"`
+}
+
+// ArchiveImage is a single line of an image archive: an Image along with its build history
+type ArchiveImage struct {
+	*Image
+	// Builds is every stored build of the image, oldest first
+	Builds []*ImageBuild `json:"builds,omitempty"`
+}
+
+// ImportReport is the outcome of ImportImages
+type ImportReport struct {
+	// Imported are the names of images that didn't exist before the import
+	Imported []string
+	// Overwritten are the names of existing images replaced by the import
+	Overwritten []string
+	// Skipped are the names of existing images left alone
+	Skipped []string
+}
+
+// ParseConflictPolicy returns the ConflictPolicy named by value
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	policy := ConflictPolicy(strings.ToLower(value))
+	switch policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return policy, nil
+	default:
+		return "", errors.Errorf("Not a valid conflict policy: %q", value)
+	}
+}
+
+// ExportImages writes every image in store to wr as line-delimited JSON, preceded by
+// an ArchiveHeader naming source as the datastore type. It returns the number of images written
+func ExportImages(store GzrMetadataStore, wr io.Writer, source string) (int, error) {
+	encoder := json.NewEncoder(wr)
+	err := encoder.Encode(ArchiveHeader{
+		Format:     ArchiveFormat,
+		Version:    ArchiveVersion,
+		Source:     source,
+		ExportedAt: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to write archive header")
+	}
+
+	images, err := store.ListAll()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to list images to export")
+	}
+	for i, image := range images.Images {
+		builds, err := storedBuilds(store, image)
+		if err != nil {
+			return i, err
+		}
+		err = encoder.Encode(ArchiveImage{Image: image, Builds: builds})
+		if err != nil {
+			return i, errors.Wrapf(err, "Failed to write %q to archive", image.Name)
+		}
+	}
+	return len(images.Images), nil
+}
+
+// ImportImages loads an archive written by ExportImages into store, one transaction per image,
+// keeping the build numbers and store times of each build. The whole archive is read and checked
+// for conflicts before anything is written, so a malformed archive or a conflict under ConflictFail
+// leaves the store untouched. An overwritten image is deleted in the same transaction that imports
+// its replacement, so it's only lost if the import succeeds
+func ImportImages(store GzrMetadataStore, rd io.Reader, policy ConflictPolicy) (*ImportReport, error) {
+	header, entries, err := readArchive(rd)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version > ArchiveVersion {
+		return nil, errors.Errorf("Archive version %d is newer than the supported version %d", header.Version, ArchiveVersion)
+	}
+
+	current, err := store.ListAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list existing images")
+	}
+	existing := make(map[string]bool)
+	for _, image := range current.Images {
+		existing[image.Name] = true
+	}
+
+	var conflicts []string
+	for _, entry := range entries {
+		if existing[entry.Name] {
+			conflicts = append(conflicts, entry.Name)
+		}
+	}
+	if policy == ConflictFail && len(conflicts) > 0 {
+		return nil, errors.Errorf("%d images in the archive already exist: %s", len(conflicts), strings.Join(conflicts, ", "))
+	}
+
+	report := &ImportReport{}
+	for _, entry := range entries {
+		if existing[entry.Name] && policy == ConflictSkip {
+			report.Skipped = append(report.Skipped, entry.Name)
+			continue
+		}
+		if existing[entry.Name] {
+			// Delete works on name prefixes, so refuse when it would take another existing image with it
+			if other := deletesOther(entry.Name, existing); other != "" {
+				return report, errors.Errorf("Overwriting %q would also delete %q", entry.Name, other)
+			}
+		}
+		builds := entry.Builds
+		if len(builds) == 0 {
+			builds = []*ImageBuild{{Build: 1, Meta: entry.Meta}}
+		}
+		err = importBuilds(store, entry.Name, builds, existing[entry.Name])
+		if err != nil {
+			return report, err
+		}
+		if existing[entry.Name] {
+			report.Overwritten = append(report.Overwritten, entry.Name)
+		} else {
+			report.Imported = append(report.Imported, entry.Name)
+		}
+	}
+	return report, nil
+}
+
+// readArchive reads and validates the header and every image in an archive
+func readArchive(rd io.Reader) (*ArchiveHeader, []*ArchiveImage, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, nil, errors.Wrap(scanner.Err(), "Failed to read archive")
+		}
+		return nil, nil, errors.New("Archive is empty")
+	}
+	header := &ArchiveHeader{}
+	err := json.Unmarshal(scanner.Bytes(), header)
+	if err != nil || header.Format != ArchiveFormat {
+		return nil, nil, errors.Errorf("Archive doesn't start with a %s header", ArchiveFormat)
+	}
+
+	var entries []*ArchiveImage
+	line := 1
+	for scanner.Scan() {
+		line += 1
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		entry := &ArchiveImage{Image: &Image{}}
+		err = json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to read image on line %d of archive", line)
+		}
+		if entry.Name == "" {
+			return nil, nil, errors.Errorf("Image on line %d of archive has no name", line)
+		}
+		entries = append(entries, entry)
+	}
+	if scanner.Err() != nil {
+		return nil, nil, errors.Wrap(scanner.Err(), "Failed to read archive")
+	}
+	return header, entries, nil
+}
@@ -0,0 +1,155 @@
+package comms
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExportImportImages_RoundTrip(t *testing.T) {
+	source, cleanupSource := newTestBoltStorage(t)
+	defer cleanupSource()
+	destination, _, cleanupDestination := newTestFileStorage(t)
+	defer cleanupDestination()
+
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+	storeInTransaction(t, source, "repo/app:20170211", ImageMetadata{GitCommit: "ccc"})
+
+	var archive bytes.Buffer
+	exported, err := ExportImages(source, &archive, "bolt")
+	if err != nil {
+		t.Fatalf("ExportImages errored with %s", err)
+	}
+	if exported != 2 {
+		t.Errorf("Expected 2 images exported, but exported %d", exported)
+	}
+	if lines := strings.Count(archive.String(), "\n"); lines != 3 {
+		t.Errorf("Expected a header and 2 image lines, but found %d lines", lines)
+	}
+
+	report, err := ImportImages(destination, bytes.NewReader(archive.Bytes()), ConflictFail)
+	if err != nil {
+		t.Fatalf("ImportImages errored with %s", err)
+	}
+	if len(report.Imported) != 2 {
+		t.Errorf("Expected 2 images imported, but imported %d", len(report.Imported))
+	}
+	history, err := destination.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 2 || history.Builds[1].Meta.GitCommit != "bbb" {
+		t.Errorf("Expected build history to be imported, but found %d builds", len(history.Builds))
+	}
+}
+
+func TestImportImages_ConflictPolicies(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "old"})
+
+	archive := `{"format":"gzr-image-archive","version":1,"source":"etcd"}
+{"name":"repo/app:20170210","metadata":{"git-commit":"new"}}
+{"name":"repo/app:20170211","metadata":{"git-commit":"other"}}
+`
+	_, err := ImportImages(store, strings.NewReader(archive), ConflictFail)
+	if err == nil {
+		t.Error("Expected ConflictFail to error on an existing image")
+	}
+	if image, _ := store.Get("repo/app:20170211"); image != nil {
+		t.Error("Expected ConflictFail to import nothing")
+	}
+
+	report, err := ImportImages(store, strings.NewReader(archive), ConflictSkip)
+	if err != nil {
+		t.Fatalf("ImportImages errored with %s", err)
+	}
+	if len(report.Skipped) != 1 || len(report.Imported) != 1 {
+		t.Errorf("Expected 1 skipped and 1 imported, but report was %+v", report)
+	}
+
+	report, err = ImportImages(store, strings.NewReader(archive), ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("ImportImages errored with %s", err)
+	}
+	if len(report.Overwritten) != 2 {
+		t.Errorf("Expected 2 overwritten, but report was %+v", report)
+	}
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.GitCommit != "new" {
+		t.Errorf("Expected overwritten commit %q, but found %q", "new", image.Meta.GitCommit)
+	}
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 1 {
+		t.Errorf("Expected overwrite to replace history, but found %d builds", len(history.Builds))
+	}
+}
+
+func TestImportImages_RejectsMissingHeader(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	_, err := ImportImages(store, strings.NewReader(`{"name":"repo/app:1","metadata":{}}`), ConflictSkip)
+	if err == nil {
+		t.Error("Expected an archive without a header to be rejected")
+	}
+}
+
+// failingImportStore is a store whose imports always fail
+type failingImportStore struct {
+	GzrMetadataStore
+}
+
+func (store failingImportStore) Import(string, []*ImageBuild) error {
+	return errors.New("import failed")
+}
+
+func TestImportImages_OverwriteKeepsImageWhenImportFails(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "old"})
+
+	archive := `{"format":"gzr-image-archive","version":1,"source":"etcd"}
+{"name":"repo/app:20170210","metadata":{"git-commit":"new"}}
+`
+	_, err := ImportImages(failingImportStore{store}, strings.NewReader(archive), ConflictOverwrite)
+	if err == nil {
+		t.Fatal("Expected ImportImages to error when the import fails")
+	}
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image == nil || image.Meta.GitCommit != "old" {
+		t.Errorf("Expected the existing image to be kept, but found %+v", image)
+	}
+}
+
+func TestImportImages_KeepsStoreTimes(t *testing.T) {
+	store, _, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "old"})
+
+	archive := `{"format":"gzr-image-archive","version":1,"source":"etcd"}
+{"name":"repo/app:20170210","metadata":{"git-commit":"new"},"builds":[{"build":4,"stored-at":"2017-02-10T00:00:00Z","metadata":{"git-commit":"new"}}]}
+`
+	_, err := ImportImages(store, strings.NewReader(archive), ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("ImportImages errored with %s", err)
+	}
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 1 || history.Builds[0].Build != 4 || history.Builds[0].StoredAt != "2017-02-10T00:00:00Z" {
+		t.Errorf("Expected the archived build number and store time, but found %+v", history.Builds)
+	}
+}
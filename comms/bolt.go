@@ -2,6 +2,7 @@ package comms
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,18 +14,26 @@ import (
 
 const (
 	ImageBucket = "images"
+	// BuildBucket holds one nested bucket per NAME:VERSION containing its build history
+	BuildBucket = "builds"
+	// IndexBucket holds the secondary index keys used by Find, with empty values
+	IndexBucket = "index"
 )
 
 // BoltStorage implements GzrMetadataStore and has an un-exported bolt.db pointer
 type BoltStorage struct {
 	db        *bolt.DB
 	activeTxn *bolt.Tx
+	// notifier sends events to Watch. Bolt holds an exclusive lock on the database
+	// file, so every change is made through this process
+	notifier imageNotifier
 }
 
 // NewBoltStorage initializes a BoltDB connection, makes sure the correct buckets exist,
-// and returns a BoltStorage pointer with the established connection
-func NewBoltStorage() (GzrMetadataStore, error) {
-	dbPath := viper.GetString("datastore.db_path")
+// and returns a BoltStorage pointer with the established connection. config holds the
+// datastore settings, normally the "datastore" block of the config file
+func NewBoltStorage(config *viper.Viper) (GzrMetadataStore, error) {
+	dbPath := config.GetString("db_path")
 	debugLog := log.WithFields(log.Fields{"path": dbPath})
 	defer debugLog.Debug("NewBoltStorage")
 	db, err := bolt.Open(dbPath, 0600, nil)
@@ -37,10 +46,20 @@ func NewBoltStorage() (GzrMetadataStore, error) {
 		store.Cleanup()
 		return nil, errors.Wrap(err, "Failed to start transaction in bolt database")
 	}
-	_, err = txn.CreateBucketIfNotExists([]byte(ImageBucket))
-	if err != nil {
-		store.Cleanup()
-		return nil, errors.Wrapf(err, "Failed to create bucket %q", ImageBucket)
+	needsIndex := txn.Bucket([]byte(IndexBucket)) == nil
+	for _, bucket := range []string{ImageBucket, BuildBucket, IndexBucket} {
+		_, err = txn.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			store.Cleanup()
+			return nil, errors.Wrapf(err, "Failed to create bucket %q", bucket)
+		}
+	}
+	if needsIndex {
+		err = indexExisting(txn)
+		if err != nil {
+			store.Cleanup()
+			return nil, errors.Wrap(err, "Failed to index existing images")
+		}
 	}
 	err = txn.Commit()
 	if err != nil {
@@ -51,16 +70,32 @@ func NewBoltStorage() (GzrMetadataStore, error) {
 	return store, nil
 }
 
-// List queries the Bolt store for all images stored under a particular name
-func (store *BoltStorage) List(imageName string) (*ImageList, error) {
+// List queries the Bolt store for a page of the images stored under a particular name.
+// Pages in version order are read straight from the bucket, starting after the continue
+// token; any other order or a label filter reads every image under the name
+func (store *BoltStorage) List(imageName string, opts ListOptions) (*ImageList, error) {
+	after, err := opts.startAfter()
+	if err != nil {
+		return &ImageList{}, err
+	}
 	var images []*Image
 	debugLog := log.WithFields(log.Fields{"imageName": imageName})
 	defer debugLog.Debug("List")
-	err := store.db.View(func(tx *bolt.Tx) error {
+	err = store.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(ImageBucket))
 		c := b.Cursor()
 		prefix := []byte(imageName)
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		start := prefix
+		if opts.inStoreOrder() && after > imageName {
+			start = []byte(after)
+		}
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if opts.inStoreOrder() && string(k) == after {
+				continue
+			}
+			if opts.inStoreOrder() && opts.Limit > 0 && len(images) > opts.Limit {
+				break
+			}
 			debugLog = debugLog.WithField(string(k[:]), string(v[:]))
 			img := store.extractImage(v, k)
 			images = append(images, img)
@@ -70,7 +105,12 @@ func (store *BoltStorage) List(imageName string) (*ImageList, error) {
 	if err != nil {
 		return &ImageList{}, errors.Wrap(err, "Failed to retrieve image list from bolt database")
 	}
-	return &ImageList{Images: images}, nil
+	return pageImages(images, opts)
+}
+
+// ListAll returns every image in the Bolt store
+func (store *BoltStorage) ListAll() (*ImageList, error) {
+	return store.List("", ListOptions{})
 }
 
 // Store stores the metadata about an image associated with its name
@@ -88,6 +128,81 @@ func (store *BoltStorage) Store(imageName string, meta ImageMetadata) error {
 	if err != nil {
 		return errors.Wrapf(err, "Failed to store metadata for key %q in bolt db", imageName)
 	}
+	err = putIndexKeys(store.activeTxn, key, meta)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to index %q in bolt db", imageName)
+	}
+	err = store.appendBuild(key, meta)
+	if err != nil {
+		return err
+	}
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: meta})
+	return nil
+}
+
+// Import records builds as the history of imageName, keeping their build numbers and store times
+func (store *BoltStorage) Import(imageName string, builds []*ImageBuild) error {
+	key, err := createKey(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create db key %q in bolt db", imageName)
+	}
+	if len(builds) == 0 {
+		return nil
+	}
+	history, err := store.activeTxn.Bucket([]byte(BuildBucket)).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create build history for %q in bolt db", key)
+	}
+	for _, build := range builds {
+		data, err := json.Marshal(build)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to convert build into json for image %q", key)
+		}
+		err = history.Put([]byte(buildKey(uint64(build.Build))), data)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store build %d for %q in bolt db", build.Build, key)
+		}
+		err = putIndexKeys(store.activeTxn, key, build.Meta)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to index %q in bolt db", key)
+		}
+	}
+	// later Stores carry on numbering from the last imported build
+	last := builds[len(builds)-1]
+	err = history.SetSequence(uint64(last.Build))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to set next build number for %q in bolt db", key)
+	}
+	data, err := json.Marshal(last.Meta)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to convert metadata into json for image %q", key)
+	}
+	err = store.activeTxn.Bucket([]byte(ImageBucket)).Put([]byte(key), data)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store metadata for key %q in bolt db", key)
+	}
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: last.Meta})
+	return nil
+}
+
+// appendBuild records meta as the next build in the history of key
+func (store *BoltStorage) appendBuild(key string, meta ImageMetadata) error {
+	builds, err := store.activeTxn.Bucket([]byte(BuildBucket)).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create build history for %q in bolt db", key)
+	}
+	seq, err := builds.NextSequence()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get next build number for %q in bolt db", key)
+	}
+	data, err := json.Marshal(newImageBuild(int(seq), meta))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to convert build into json for image %q", key)
+	}
+	err = builds.Put([]byte(buildKey(seq)), data)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store build %d for %q in bolt db", seq, key)
+	}
 	return nil
 }
 
@@ -99,28 +214,57 @@ func (store *BoltStorage) Cleanup() {
 // Delete deletes all information related to IMAGE_NAME:VERSION
 func (store *BoltStorage) Delete(imageName string) (int, error) {
 	b := store.activeTxn.Bucket([]byte(ImageBucket))
+	index := store.activeTxn.Bucket([]byte(IndexBucket))
 	c := b.Cursor()
 	prefix := []byte(imageName)
 	deleted := 0
-	for key, _ := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = c.Next() {
-		err := b.Delete(key)
+	for key, value := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = c.Next() {
+		err := deleteIndexKeys(index, string(key), store.extractImage(value, key).Meta)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to delete index for %q from bolt db", key)
+		}
+		err = b.Delete(key)
 		if err != nil {
 			return 0, errors.Wrapf(err, "Failed to delete key %q from bolt db", key)
 		}
+		store.notifier.queue(ImageDeleted, &Image{Name: string(key)})
 		deleted += 1
 	}
+
+	// Histories are nested buckets, so collect the keys before removing them
+	builds := store.activeTxn.Bucket([]byte(BuildBucket))
+	var histories [][]byte
+	bc := builds.Cursor()
+	for key, _ := bc.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = bc.Next() {
+		histories = append(histories, key)
+	}
+	for _, key := range histories {
+		err := builds.Bucket(key).ForEach(func(_, v []byte) error {
+			var build ImageBuild
+			json.Unmarshal(v, &build)
+			return deleteIndexKeys(index, string(key), build.Meta)
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to delete index for %q from bolt db", key)
+		}
+		err = builds.DeleteBucket(key)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to delete build history %q from bolt db", key)
+		}
+	}
 	return deleted, nil
 }
 
-// Get returns a single image based on a name
+// Get returns the image stored under exactly NAME:VERSION, or nil if there isn't one
 func (store *BoltStorage) Get(imageName string) (*Image, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create db key %q in bolt db", imageName)
+	}
 	var image *Image
-	err := store.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(ImageBucket))
-		c := b.Cursor()
-		prefix := []byte(imageName)
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			image = store.extractImage(v, k)
+	err = store.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(ImageBucket)).Get([]byte(key)); v != nil {
+			image = store.extractImage(v, []byte(key))
 		}
 		return nil
 	})
@@ -132,7 +276,7 @@ func (store *BoltStorage) Get(imageName string) (*Image, error) {
 
 // GetLatest returns the latest image from a name
 func (store *BoltStorage) GetLatest(imageName string) (*Image, error) {
-	images, err := store.List(imageName)
+	images, err := store.List(imageName, ListOptions{})
 	if err != nil {
 		return nil, errors.Wrapf(err, "Unable to get images for %q", imageName)
 	}
@@ -142,6 +286,59 @@ func (store *BoltStorage) GetLatest(imageName string) (*Image, error) {
 	return images.Images[0], nil
 }
 
+// History returns every stored build for a single NAME:VERSION, oldest first
+func (store *BoltStorage) History(imageName string) (*ImageHistory, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create db key %q in bolt db", imageName)
+	}
+	history := &ImageHistory{Name: key}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		builds := tx.Bucket([]byte(BuildBucket)).Bucket([]byte(key))
+		if builds == nil {
+			return nil
+		}
+		return builds.ForEach(func(k, v []byte) error {
+			var build ImageBuild
+			err := json.Unmarshal(v, &build)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to read build %q", k)
+			}
+			history.Builds = append(history.Builds, &build)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get build history for %q from bolt db", imageName)
+	}
+	return history, nil
+}
+
+// Find scans the index bucket for candidate images and returns the ones matching query
+func (store *BoltStorage) Find(query ImageQuery) (*ImageList, error) {
+	if query.IsEmpty() {
+		return nil, errors.New("Must provide a commit, tag, origin or digest to find images by")
+	}
+	var keys []string
+	err := store.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(IndexBucket)).Cursor()
+		prefix := []byte(indexScanPrefix(query))
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, indexedKey(string(k)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to search index in bolt db")
+	}
+	return findIndexed(store, keys, query)
+}
+
+// Watch returns the events for images whose name begins with prefix as transactions are committed
+func (store *BoltStorage) Watch(ctx context.Context, prefix string) (<-chan *ImageEvent, error) {
+	return store.notifier.watch(ctx, prefix), nil
+}
+
 // StartTransaction starts a new Bolt transaction and adds it to the Storage
 func (store *BoltStorage) StartTransaction() error {
 	bTxn, err := store.db.Begin(true)
@@ -152,9 +349,27 @@ func (store *BoltStorage) StartTransaction() error {
 	return nil
 }
 
-// CommitTransaction commits the active transaction
+// CommitTransaction commits the active transaction and sends its events to watchers
 func (store *BoltStorage) CommitTransaction() error {
-	return store.activeTxn.Commit()
+	err := store.activeTxn.Commit()
+	store.activeTxn = nil
+	if err != nil {
+		store.notifier.discard()
+		return err
+	}
+	store.notifier.publish()
+	return nil
+}
+
+// RollbackTransaction rolls back the active transaction, releasing the write lock on the database
+func (store *BoltStorage) RollbackTransaction() error {
+	if store.activeTxn == nil {
+		return nil
+	}
+	err := store.activeTxn.Rollback()
+	store.activeTxn = nil
+	store.notifier.discard()
+	return errors.Wrap(err, "Failed to roll back transaction in bolt db")
 }
 
 // extractImage transforms raw []byte of metadata and key into a full Image
@@ -163,3 +378,47 @@ func (store *BoltStorage) extractImage(data []byte, key []byte) *Image {
 	json.Unmarshal(data, &meta)
 	return &Image{Name: string(key), Meta: meta}
 }
+
+// putIndexKeys adds the index keys for meta stored under key
+func putIndexKeys(tx *bolt.Tx, key string, meta ImageMetadata) error {
+	index := tx.Bucket([]byte(IndexBucket))
+	for _, indexKey := range indexKeys(key, meta) {
+		err := index.Put([]byte(indexKey), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIndexKeys removes the index keys for meta stored under key
+func deleteIndexKeys(index *bolt.Bucket, key string, meta ImageMetadata) error {
+	for _, indexKey := range indexKeys(key, meta) {
+		err := index.Delete([]byte(indexKey))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexExisting fills the index bucket from the images and build histories already
+// stored, for databases created before Find existed
+func indexExisting(tx *bolt.Tx) error {
+	err := tx.Bucket([]byte(ImageBucket)).ForEach(func(k, v []byte) error {
+		var meta ImageMetadata
+		json.Unmarshal(v, &meta)
+		return putIndexKeys(tx, string(k), meta)
+	})
+	if err != nil {
+		return err
+	}
+	builds := tx.Bucket([]byte(BuildBucket))
+	return builds.ForEach(func(key, _ []byte) error {
+		return builds.Bucket(key).ForEach(func(_, v []byte) error {
+			var build ImageBuild
+			json.Unmarshal(v, &build)
+			return putIndexKeys(tx, string(key), build.Meta)
+		})
+	})
+}
@@ -0,0 +1,321 @@
+package comms
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestBoltStorage returns a BoltStorage backed by a temporary file and a func to remove it
+func newTestBoltStorage(t *testing.T) (GzrMetadataStore, func()) {
+	dir, err := ioutil.TempDir("", "gzr-bolt")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	config := viper.New()
+	config.Set("db_path", filepath.Join(dir, "gzr.db"))
+	store, err := NewBoltStorage(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create bolt storage: %s", err)
+	}
+	return store, func() {
+		store.Cleanup()
+		os.RemoveAll(dir)
+	}
+}
+
+func storeInTransaction(t *testing.T, store GzrMetadataStore, name string, meta ImageMetadata) {
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := store.Store(name, meta); err != nil {
+		t.Fatalf("Failed to store %q: %s", name, err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+}
+
+func TestBoltStorage_History_KeepsEveryBuild(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 2 {
+		t.Fatalf("Expected 2 builds, but found %d", len(history.Builds))
+	}
+	if history.Builds[0].Build != 1 || history.Builds[1].Build != 2 {
+		t.Errorf("Expected builds numbered 1 and 2, but found %d and %d", history.Builds[0].Build, history.Builds[1].Build)
+	}
+	if history.Builds[1].Meta.GitCommit != "bbb" {
+		t.Errorf("Expected newest build to have commit %q, but found %q", "bbb", history.Builds[1].Meta.GitCommit)
+	}
+
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.GitCommit != "bbb" {
+		t.Errorf("Expected Get to return newest commit %q, but found %q", "bbb", image.Meta.GitCommit)
+	}
+}
+
+func TestBoltStorage_Delete_RemovesHistory(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	deleted, err := store.Delete("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Delete errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted image, but deleted %d", deleted)
+	}
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 0 {
+		t.Errorf("Expected no builds after delete, but found %d", len(history.Builds))
+	}
+}
+
+func TestBoltStorage_RollbackTransaction_DiscardsStore(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := store.Store("repo/app:20170210", ImageMetadata{GitCommit: "aaa"}); err != nil {
+		t.Fatalf("Failed to store: %s", err)
+	}
+	if err := store.RollbackTransaction(); err != nil {
+		t.Fatalf("RollbackTransaction errored with %s", err)
+	}
+
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image != nil {
+		t.Errorf("Expected no image after rollback, but found %q", image.Name)
+	}
+}
+
+func TestBoltStorage_RollbackTransaction_AfterCommit(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+
+	if err := store.RollbackTransaction(); err != nil {
+		t.Errorf("Expected rolling back a committed transaction to do nothing, but it errored with %s", err)
+	}
+}
+
+func TestBoltStorage_Get_MatchesVersionExactly(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:10", ImageMetadata{GitCommit: "aaa"})
+
+	image, err := store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image != nil {
+		t.Errorf("Expected no image for version 1, but found %q", image.Name)
+	}
+
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "bbb"})
+	image, err = store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image == nil || image.Name != "repo/app:1" || image.Meta.GitCommit != "bbb" {
+		t.Errorf("Expected repo/app:1 with commit %q, but found %+v", "bbb", image)
+	}
+}
+
+func TestBoltStorage_Find(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "3b70356", GitTag: []string{"v1"}, GitOrigin: "https://github.com/bypasslane/gzr"})
+	storeInTransaction(t, store, "repo/other:1", ImageMetadata{GitCommit: "3b70356", GitOrigin: "https://github.com/bypasslane/other"})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{GitCommit: "aaaaaaa", GitOrigin: "https://github.com/bypasslane/gzr"})
+
+	images, err := store.Find(ImageQuery{GitCommit: "3b703566512e427a424e5c4348bc1c56abbf07fe"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 2 {
+		t.Errorf("Expected full hash to find 2 images, but found %d", len(images.Images))
+	}
+
+	images, err = store.Find(ImageQuery{GitTag: "v1", GitOrigin: "https://github.com/bypasslane/gzr"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 1 || images.Images[0].Name != "repo/app:1" {
+		t.Errorf("Expected tag and origin to find only repo/app:1, but found %d images", len(images.Images))
+	}
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if _, err := store.Delete("repo/other:1"); err != nil {
+		t.Fatalf("Delete errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+	images, err = store.Find(ImageQuery{GitCommit: "3b70356"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 1 {
+		t.Errorf("Expected deleted image to drop out of the index, but found %d images", len(images.Images))
+	}
+}
+
+func TestBoltStorage_Watch(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := store.Watch(ctx, "repo/app:")
+	if err != nil {
+		t.Fatalf("Watch errored with %s", err)
+	}
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	store.Store("repo/app:rolled-back", ImageMetadata{GitCommit: "aaa"})
+	store.RollbackTransaction()
+	storeInTransaction(t, store, "repo/other:1", ImageMetadata{GitCommit: "bbb"})
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "ccc"})
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	store.Delete("repo/app:1")
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+
+	expected := []ImageEvent{
+		{Type: ImageStored, Image: &Image{Name: "repo/app:1"}},
+		{Type: ImageDeleted, Image: &Image{Name: "repo/app:1"}},
+	}
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			if event.Type != want.Type || event.Image.Name != want.Image.Name {
+				t.Errorf("Expected %s of %q, but received %s of %q", want.Type, want.Image.Name, event.Type, event.Image.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s of %q", want.Type, want.Image.Name)
+		}
+	}
+
+	cancel()
+	for event := range events {
+		t.Errorf("Unexpected %s of %q", event.Type, event.Image.Name)
+	}
+}
+
+func TestBoltStorage_List_Pages(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{CreatedAt: "2017-02-12T00:00:00Z"})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{CreatedAt: "2017-02-10T00:00:00Z"})
+	storeInTransaction(t, store, "repo/app:3", ImageMetadata{CreatedAt: "2017-02-11T00:00:00Z"})
+	storeInTransaction(t, store, "repo/other:1", ImageMetadata{CreatedAt: "2017-02-13T00:00:00Z"})
+
+	cases := map[ListSort][]string{
+		SortByVersion:       {"repo/app:1", "repo/app:2", "repo/app:3"},
+		SortByCreatedAt:     {"repo/app:2", "repo/app:3", "repo/app:1"},
+		SortByCreatedAtDesc: {"repo/app:1", "repo/app:3", "repo/app:2"},
+	}
+	for sort, expected := range cases {
+		var names []string
+		opts := ListOptions{Limit: 2, Sort: sort}
+		for pages := 0; pages < len(expected); pages++ {
+			images, err := store.List("repo/app", opts)
+			if err != nil {
+				t.Fatalf("List sorted by %s errored with %s", sort, err)
+			}
+			for _, image := range images.Images {
+				names = append(names, image.Name)
+			}
+			if images.Continue == "" {
+				break
+			}
+			opts.Continue = images.Continue
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Expected pages sorted by %s to list %v, but found %v", sort, expected, names)
+		}
+	}
+}
+
+func TestBoltStorage_List_RejectsTokenForOtherSort(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{})
+
+	images, err := store.List("repo/app", ListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("List errored with %s", err)
+	}
+	_, err = store.List("repo/app", ListOptions{Limit: 1, Sort: SortByCreatedAt, Continue: images.Continue})
+	if err == nil {
+		t.Error("Expected a continue token for another sort to be rejected")
+	}
+	_, err = store.List("repo/app", ListOptions{Continue: "not a token"})
+	if err == nil {
+		t.Error("Expected a malformed continue token to be rejected")
+	}
+}
+
+func TestBoltStorage_Find_ByDigest(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	registry := &RegistryInfo{Digest: "sha256:aaaa", Size: 10, Architecture: "amd64", Layers: 2}
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "aaa", Registry: registry})
+	storeInTransaction(t, store, "repo/app:latest", ImageMetadata{GitCommit: "aaa", Registry: registry})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{GitCommit: "bbb", Registry: &RegistryInfo{Digest: "sha256:bbbb"}})
+
+	images, err := store.Find(ImageQuery{Digest: "sha256:aaaa"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 2 {
+		t.Fatalf("Expected both tags of the same artifact, but found %d images", len(images.Images))
+	}
+	if ref := images.Images[0].DigestReference(); ref != "repo/app@sha256:aaaa" {
+		t.Errorf("Expected digest reference %q, but found %q", "repo/app@sha256:aaaa", ref)
+	}
+}
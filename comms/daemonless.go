@@ -0,0 +1,168 @@
+package comms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DaemonlessManager implements ImageManager with buildah or podman, which build and push
+// images without a Docker daemon
+type DaemonlessManager struct {
+	// binary is the builder that is run, "buildah" or "podman"
+	binary string
+	// registry holds the credentials pushes authenticate with, and reads what was pushed
+	registry *RegistryClient
+	// digests holds the manifest digest of every image pushed by this manager
+	digests map[string]string
+}
+
+// NewBuildahManager returns a DaemonlessManager running buildah
+func NewBuildahManager() *DaemonlessManager {
+	return &DaemonlessManager{binary: "buildah", registry: NewRegistryClient(), digests: make(map[string]string)}
+}
+
+// NewPodmanManager returns a DaemonlessManager running podman
+func NewPodmanManager() *DaemonlessManager {
+	return &DaemonlessManager{binary: "podman", registry: NewRegistryClient(), digests: make(map[string]string)}
+}
+
+// Build takes a series of docker build style arguments and builds an image, tagging it
+// with each of the tags and setting each of the labels with --label
+func (manager *DaemonlessManager) Build(opts BuildOptions, args ...string) error {
+	err := manager.run(manager.buildArgs(opts, args)...)
+	return errors.Wrapf(err, "Failed to build with %s", manager.binary)
+}
+
+// Push pushes name to its registry, recording the digest of the pushed manifest
+func (manager *DaemonlessManager) Push(name string) error {
+	digestFile, err := ioutil.TempFile("", "gzr-digest")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create digest file")
+	}
+	digestFile.Close()
+	defer os.Remove(digestFile.Name())
+	authFile, err := manager.writeAuthFile(name)
+	if err != nil {
+		return err
+	}
+	if authFile != "" {
+		defer os.Remove(authFile)
+	}
+
+	err = manager.run(manager.pushArgs(name, digestFile.Name(), authFile)...)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push %q with %s", name, manager.binary)
+	}
+	digest, err := ioutil.ReadFile(digestFile.Name())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read the pushed digest of %q", name)
+	}
+	manager.digests[name] = strings.TrimSpace(string(digest))
+	return nil
+}
+
+// Inspect reads the digest, size, architecture and layer count of a pushed image from
+// its registry, since there is no daemon keeping them. The digest recorded by Push is
+// used when there is one
+func (manager *DaemonlessManager) Inspect(name string) (*RegistryInfo, error) {
+	config, err := manager.registry.ImageConfig(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read pushed image %q from its registry", name)
+	}
+	if digest := manager.digests[name]; digest != "" {
+		config.Registry.Digest = digest
+	}
+	return config.Registry, nil
+}
+
+// Labels returns the labels a local image was built with
+func (manager *DaemonlessManager) Labels(name string) (map[string]string, error) {
+	format := "{{json .Config.Labels}}"
+	args := []string{"image", "inspect", "--format", format, name}
+	if manager.binary == "buildah" {
+		format = "{{json .OCIv1.Config.Labels}}"
+		args = []string{"inspect", "--type", "image", "--format", format, name}
+	}
+	out, err := exec.Command(manager.binary, args...).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to inspect image %q with %s", name, manager.binary)
+	}
+	var labels map[string]string
+	err = json.Unmarshal(out, &labels)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read labels of image %q", name)
+	}
+	return labels, nil
+}
+
+// buildArgs returns the arguments building an image with opts from the docker build style args
+func (manager *DaemonlessManager) buildArgs(opts BuildOptions, args []string) []string {
+	buildArgs := []string{"build"}
+	if manager.binary == "buildah" {
+		// bud is the build command in every buildah release, where "build" is only an alias in newer ones
+		buildArgs = []string{"bud"}
+	}
+	for _, tag := range opts.Tags {
+		buildArgs = append(buildArgs, "-t", tag)
+	}
+	return append(append(buildArgs, labelArgs(opts.Labels)...), args...)
+}
+
+// pushArgs returns the arguments pushing name to its registry, writing the digest to
+// digestFile and authenticating with the credentials in authFile when it isn't ""
+func (manager *DaemonlessManager) pushArgs(name string, digestFile string, authFile string) []string {
+	args := []string{"push", "--digestfile", digestFile}
+	if authFile != "" {
+		args = append(args, "--authfile", authFile)
+	}
+	if manager.registry.Insecure {
+		args = append(args, "--tls-verify=false")
+	}
+	return append(args, name, "docker://"+name)
+}
+
+// writeAuthFile writes the "registry" credentials for name's registry to a temporary auth
+// file, so the password isn't passed on the command line. It returns "" when there are
+// no credentials, leaving the builder to use its own login
+func (manager *DaemonlessManager) writeAuthFile(name string) (string, error) {
+	if manager.registry.Username == "" {
+		return "", nil
+	}
+	ref, err := parseImageReference(name)
+	if err != nil {
+		return "", err
+	}
+	registry := ref.Registry
+	if registry == dockerHubRegistry {
+		registry = "docker.io"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(manager.registry.Username + ":" + manager.registry.Password))
+	data, _ := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{registry: map[string]string{"auth": auth}},
+	})
+	file, err := ioutil.TempFile("", "gzr-auth")
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create auth file")
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", errors.Wrap(err, "Failed to write auth file")
+	}
+	return file.Name(), nil
+}
+
+// run runs the builder with args, streaming its output
+func (manager *DaemonlessManager) run(args ...string) error {
+	cmd := exec.Command(manager.binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
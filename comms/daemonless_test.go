@@ -0,0 +1,78 @@
+package comms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDaemonlessManager_BuildArgs(t *testing.T) {
+	opts := BuildOptions{Tags: []string{"repo/app:1", "repo/app:latest"}, Labels: map[string]string{OCIRevisionLabel: "aaa"}}
+	cases := map[*DaemonlessManager][]string{
+		NewBuildahManager(): {"bud", "-t", "repo/app:1", "-t", "repo/app:latest", "--label", OCIRevisionLabel + "=aaa", "-f", "Dockerfile.ci", "."},
+		NewPodmanManager():  {"build", "-t", "repo/app:1", "-t", "repo/app:latest", "--label", OCIRevisionLabel + "=aaa", "-f", "Dockerfile.ci", "."},
+	}
+	for manager, expected := range cases {
+		args := manager.buildArgs(opts, []string{"-f", "Dockerfile.ci", "."})
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("Expected %s arguments %v, but found %v", manager.binary, expected, args)
+		}
+	}
+}
+
+func TestDaemonlessManager_PushArgs(t *testing.T) {
+	manager := NewPodmanManager()
+	manager.registry = &RegistryClient{Insecure: true}
+	args := manager.pushArgs("registry.example.com/repo/app:1", "/tmp/digest", "/tmp/auth.json")
+	expected := []string{"push", "--digestfile", "/tmp/digest", "--authfile", "/tmp/auth.json", "--tls-verify=false",
+		"registry.example.com/repo/app:1", "docker://registry.example.com/repo/app:1"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, but found %v", expected, args)
+	}
+}
+
+func TestDaemonlessManager_WriteAuthFile(t *testing.T) {
+	manager := NewBuildahManager()
+	manager.registry = &RegistryClient{}
+	path, err := manager.writeAuthFile("repo/app:1")
+	if err != nil || path != "" {
+		t.Errorf("Expected no auth file without credentials, but got %q, %v", path, err)
+	}
+
+	manager.registry = &RegistryClient{Username: "gzr", Password: "secret"}
+	path, err = manager.writeAuthFile("repo/app:1")
+	if err != nil {
+		t.Fatalf("writeAuthFile errored with %s", err)
+	}
+	defer os.Remove(path)
+	data, _ := ioutil.ReadFile(path)
+	authFile := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	json.Unmarshal(data, &authFile)
+	if authFile.Auths["docker.io"].Auth != "Z3pyOnNlY3JldA==" {
+		t.Errorf("Expected docker.io credentials in the auth file, but found %s", data)
+	}
+}
+
+func TestDaemonlessManager_Inspect(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	manager := NewPodmanManager()
+	manager.registry = &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+	name := testRegistryHost(server) + "/team/app:multi"
+	manager.digests[name] = "sha256:pushed"
+
+	info, err := manager.Inspect(name)
+	if err != nil {
+		t.Fatalf("Inspect errored with %s", err)
+	}
+	expected := RegistryInfo{Digest: "sha256:pushed", Size: 3100, Architecture: "amd64", Layers: 2}
+	if *info != expected {
+		t.Errorf("Expected %+v, but found %+v", expected, *info)
+	}
+}
@@ -0,0 +1,165 @@
+package comms
+
+import (
+	e "errors"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrImageNotInStore = e.New("Requested image couldn't be found in the metadata store, force the update to deploy it anyway")
+)
+
+// Deployer updates Deployments and other workloads, refusing images gzr has no metadata for.
+// The CLI and web server both deploy through it so they accept and refuse the same images
+type Deployer struct {
+	k8sConn    K8sCommunicator
+	imageStore GzrMetadataStore
+}
+
+// NewDeployer returns a Deployer updating workloads through k8sConn to images found in imageStore
+func NewDeployer(k8sConn K8sCommunicator, imageStore GzrMetadataStore) *Deployer {
+	return &Deployer{
+		k8sConn:    k8sConn,
+		imageStore: imageStore,
+	}
+}
+
+// UpdateDeployment updates the Deployment's container to the image described by dci. Unless
+// force is set, the image must be stored as NAME:VERSION, or as NAME@DIGEST of a pushed image
+func (d *Deployer) UpdateDeployment(dci *DeploymentContainerInfo, force bool) (*GzrDeployment, error) {
+	err := d.checkStored(dci.Image, force)
+	if err != nil {
+		return nil, err
+	}
+	return d.k8sConn.UpdateDeployment(dci)
+}
+
+// UpdateWorkload updates the workload's container to the image described by wci, checking
+// the metadata store like UpdateDeployment
+func (d *Deployer) UpdateWorkload(wci *WorkloadContainerInfo, force bool) (*Workload, error) {
+	err := d.checkStored(wci.Image, force)
+	if err != nil {
+		return nil, err
+	}
+	return d.k8sConn.UpdateWorkload(wci)
+}
+
+// checkStored returns ErrImageNotInStore if the store has no metadata for image, unless force is set
+func (d *Deployer) checkStored(image string, force bool) error {
+	if force {
+		return nil
+	}
+	stored, err := d.imageStored(image)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to look up image %q in the metadata store", image)
+	}
+	if !stored {
+		return errors.Wrapf(ErrImageNotInStore, "%q", image)
+	}
+	return nil
+}
+
+// Revisions returns the Deployment's revision history, with the metadata stored for every container image.
+// Images the store can't key, such as untagged ones, have no metadata
+func (d *Deployer) Revisions(deploymentName string) (*DeploymentRevisionList, error) {
+	revisions, err := d.k8sConn.ListRevisions(deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	err = d.addMetadata(revisions)
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Rollback restores the Deployment's Pod template to the given revision, or to the revision before the
+// current one if revision is 0. Rolling back to the current revision is refused with ErrRevisionIsCurrent.
+// The revisions' metadata is looked up after rolling back, and left out if the lookup fails
+func (d *Deployer) Rollback(deploymentName string, revision int64) (*Rollback, error) {
+	revisions, err := d.k8sConn.ListRevisions(deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	to := revisions.Previous()
+	if revision != 0 {
+		to = revisions.Find(revision)
+	}
+	if to == nil {
+		return nil, errors.Wrapf(ErrRevisionNotFound, "revision %d of deployment %q", revision, deploymentName)
+	}
+	if to.Current {
+		return nil, errors.Wrapf(ErrRevisionIsCurrent, "revision %d of deployment %q", to.Revision, deploymentName)
+	}
+	_, err = d.k8sConn.RollbackDeployment(deploymentName, to)
+	if err != nil {
+		return nil, err
+	}
+	err = d.addMetadata(revisions)
+	if err != nil {
+		log.WithError(err).WithField("deployment", deploymentName).Warn("Rolled back without the revisions' metadata")
+	}
+	return &Rollback{Deployment: deploymentName, From: revisions.Current(), To: to}, nil
+}
+
+// addMetadata sets the metadata stored for every container image of the revisions
+func (d *Deployer) addMetadata(revisions *DeploymentRevisionList) error {
+	for _, revision := range revisions.Revisions {
+		for i, container := range revision.Containers {
+			image, err := d.storedImage(container.Image)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to look up image %q in the metadata store", container.Image)
+			}
+			if image != nil {
+				revision.Containers[i].Meta = &image.Meta
+			}
+		}
+	}
+	return nil
+}
+
+// imageStored returns true if the store has metadata for image
+func (d *Deployer) imageStored(image string) (bool, error) {
+	stored, err := d.storedImage(image)
+	return stored != nil, err
+}
+
+// storedImage returns the stored image for an image stored as NAME:VERSION, or for the
+// NAME@DIGEST of a pushed image, or nil if the store has neither or image can't be a key
+func (d *Deployer) storedImage(image string) (*Image, error) {
+	at := strings.Index(image, "@")
+	if at < 0 {
+		if !isStoreKey(image) {
+			return nil, nil
+		}
+		stored, err := d.imageStore.Get(image)
+		if err != nil || stored == nil || stored.Name == "" {
+			return nil, err
+		}
+		return stored, nil
+	}
+	images, err := d.imageStore.Find(ImageQuery{Digest: image[at+1:]})
+	if err != nil {
+		return nil, err
+	}
+	for _, stored := range images.Images {
+		if stored.DigestReference() == image {
+			return stored, nil
+		}
+	}
+	return nil, nil
+}
+
+// isStoreKey returns true if image is a NAME:VERSION the store can hold. The version follows the
+// last colon after the last "/", so images without one, like nginx or registry:5000/app, aren't
+// keys, and neither are ones with a registry port, since keys only have the separating colon
+func isStoreKey(image string) bool {
+	if strings.LastIndex(image, ":") <= strings.LastIndex(image, "/") {
+		return false
+	}
+	_, err := createKey(image)
+	return err == nil
+}
@@ -0,0 +1,85 @@
+package comms
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// newTestDeployer returns a Deployer over a bolt store holding repo/app:1, pushed with
+// digest sha256:aaaa, and a func returning the images Deployments were updated to
+func newTestDeployer(t *testing.T) (*Deployer, func() []string, func()) {
+	store, cleanup := newTestBoltStorage(t)
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "aaa", Registry: &RegistryInfo{Digest: "sha256:aaaa"}})
+	var deployed []string
+	k8sConn := &MockK8sCommunicator{
+		OnUpdateDeployment: func(dci *DeploymentContainerInfo) (*GzrDeployment, error) {
+			deployed = append(deployed, dci.Image)
+			return &GzrDeployment{}, nil
+		},
+	}
+	return NewDeployer(k8sConn, store), func() []string { return deployed }, cleanup
+}
+
+func TestDeployer_UpdateDeployment(t *testing.T) {
+	deployer, deployed, cleanup := newTestDeployer(t)
+	defer cleanup()
+
+	for _, image := range []string{"repo/app:1", "repo/app@sha256:aaaa"} {
+		_, err := deployer.UpdateDeployment(&DeploymentContainerInfo{Image: image}, false)
+		if err != nil {
+			t.Errorf("Expected stored image %q to deploy, but got %s", image, err)
+		}
+	}
+	if len(deployed()) != 2 {
+		t.Errorf("Expected 2 deployments to be updated, but found %v", deployed())
+	}
+}
+
+func TestDeployer_UpdateDeploymentImageNotInStore(t *testing.T) {
+	deployer, deployed, cleanup := newTestDeployer(t)
+	defer cleanup()
+
+	for _, image := range []string{"repo/app:2", "repo/other@sha256:aaaa", "nginx", "registry:5000/app", "host:5000/team/app:1"} {
+		_, err := deployer.UpdateDeployment(&DeploymentContainerInfo{Image: image}, false)
+		if errors.Cause(err) != ErrImageNotInStore {
+			t.Errorf("Expected ErrImageNotInStore for %q, but got %v", image, err)
+		}
+	}
+	if len(deployed()) != 0 {
+		t.Errorf("Expected no deployments to be updated, but found %v", deployed())
+	}
+
+	_, err := deployer.UpdateDeployment(&DeploymentContainerInfo{Image: "repo/app:2"}, true)
+	if err != nil {
+		t.Errorf("Expected a forced update to deploy, but got %s", err)
+	}
+	if len(deployed()) != 1 {
+		t.Errorf("Expected the forced deployment to be updated, but found %v", deployed())
+	}
+}
+
+func TestDeployer_UpdateWorkload(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "aaa"})
+	var deployed []string
+	deployer := NewDeployer(&MockK8sCommunicator{
+		OnUpdateWorkload: func(wci *WorkloadContainerInfo) (*Workload, error) {
+			deployed = append(deployed, wci.Image)
+			return &Workload{Kind: wci.Kind, Name: wci.Name}, nil
+		},
+	}, store)
+
+	_, err := deployer.UpdateWorkload(&WorkloadContainerInfo{Kind: KindStatefulSet, Image: "repo/app:1"}, false)
+	if err != nil {
+		t.Errorf("Expected stored image to deploy, but got %s", err)
+	}
+	_, err = deployer.UpdateWorkload(&WorkloadContainerInfo{Kind: KindStatefulSet, Image: "repo/app:2"}, false)
+	if errors.Cause(err) != ErrImageNotInStore {
+		t.Errorf("Expected ErrImageNotInStore, but got %v", err)
+	}
+	if len(deployed) != 1 {
+		t.Errorf("Expected only the stored image to be deployed, but found %v", deployed)
+	}
+}
@@ -1,19 +1,31 @@
 package comms
 
 import (
-	"fmt"
+	"encoding/json"
 	"os"
 	"os/exec"
-	"time"
+	"strings"
 
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
 )
 
+// BuildOptions are the names and labels an ImageManager builds an image with
+type BuildOptions struct {
+	// Tags are the full NAME:TAG names of the image, the first being its primary name
+	Tags []string
+	// Labels are set on the image
+	Labels map[string]string
+}
+
 // ImageManager is an interface for building an application's image
 type ImageManager interface {
-	Build(...string) error
+	// Build builds an image with the given options from the builder's arguments
+	Build(BuildOptions, ...string) error
 	Push(string) error
+	// Inspect returns the registry data of an image that has been pushed
+	Inspect(string) (*RegistryInfo, error)
+	// Labels returns the labels of a local image
+	Labels(string) (map[string]string, error)
 }
 
 // DockerManager implements ImageManager in order to manage images for Docker
@@ -24,17 +36,18 @@ func NewDockerManager() *DockerManager {
 	return &DockerManager{}
 }
 
-// Build takes a series of arguments to be sent to Docker and builds an image
-func (docker *DockerManager) Build(args ...string) error {
-	tag, err := GetDockerTag()
-	if err != nil {
-		return err
+// Build takes a series of arguments to be sent to Docker and builds an image, tagging it
+// with each of the tags and setting each of the labels with --label
+func (docker *DockerManager) Build(opts BuildOptions, args ...string) error {
+	buildArgs := []string{"build"}
+	for _, tag := range opts.Tags {
+		buildArgs = append(buildArgs, "-t", tag)
 	}
-	args = append([]string{"build", "-t", tag}, args...)
+	args = append(append(buildArgs, labelArgs(opts.Labels)...), args...)
 	build := exec.Command("docker", args...)
 	build.Stdout = os.Stdout
 	build.Stderr = os.Stderr
-	err = build.Run()
+	err := build.Run()
 	if err != nil {
 		return err
 	}
@@ -54,23 +67,75 @@ func (docker *DockerManager) Push(name string) error {
 	return nil
 }
 
-// GetDockerTag combines a configured Docker repository name, the current working directory,
-// the current time, and a git hash to create a Docker tag appropriate to gzr
-// Output format: `repository/$CWD:YYYYMMDD.SHORT_HASH`
-func GetDockerTag() (string, error) {
-	// The cwd call isn't needed. The commit hash function already uses the current working directory
-	// and less work is done if the path isn't set
-	gm := NewLocalGitManager()
-	hash, err := gm.CommitHash()
+// dockerInspection is the part of `docker inspect` output for an image that gzr records
+type dockerInspection struct {
+	RepoDigests  []string
+	Size         int64
+	Architecture string
+	RootFS       struct {
+		Layers []string
+	}
+	Config struct {
+		Labels map[string]string
+	}
+}
+
+// inspect returns Docker's inspection of a local image
+func (docker *DockerManager) inspect(name string) (*dockerInspection, error) {
+	out, err := exec.Command("docker", "inspect", "--type=image", name).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to inspect image %q", name)
+	}
+	var inspected []dockerInspection
+	err = json.Unmarshal(out, &inspected)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to retrive git commit hash")
+		return nil, errors.Wrapf(err, "Failed to read inspection of image %q", name)
 	}
+	if len(inspected) == 0 {
+		return nil, errors.Errorf("Docker has no image %q", name)
+	}
+	return &inspected[0], nil
+}
 
-	name, err := gm.RepoName()
+// Inspect reads the digest Docker recorded for name when it was pushed, along with
+// the image's size, architecture and layer count
+func (docker *DockerManager) Inspect(name string) (*RegistryInfo, error) {
+	inspected, err := docker.inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	digest := repoDigest(name, inspected.RepoDigests)
+	if digest == "" {
+		return nil, errors.Errorf("Docker has no digest for %q, it may not have been pushed", name)
+	}
+	return &RegistryInfo{
+		Digest:       digest,
+		Size:         inspected.Size,
+		Architecture: inspected.Architecture,
+		Layers:       len(inspected.RootFS.Layers),
+	}, nil
+}
 
+// Labels returns the labels a local image was built with
+func (docker *DockerManager) Labels(name string) (map[string]string, error) {
+	inspected, err := docker.inspect(name)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to retrive repository name from git")
+		return nil, err
 	}
+	return inspected.Config.Labels, nil
+}
 
-	return fmt.Sprintf("%s/%s:%s.%s", viper.GetString("repository"), name, time.Now().Format("20060102"), hash), nil
+// repoDigest returns the digest of the REPOSITORY@DIGEST entry for the repository
+// of the name REPOSITORY[:TAG], or "" if there isn't one
+func repoDigest(name string, repoDigests []string) string {
+	repository := name
+	if sep := strings.LastIndex(name, ":"); sep > strings.LastIndex(name, "/") {
+		repository = name[:sep]
+	}
+	for _, repoDigest := range repoDigests {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			return strings.TrimPrefix(repoDigest, repository+"@")
+		}
+	}
+	return ""
 }
@@ -0,0 +1,477 @@
+package comms
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// DefaultDockerHost is the Docker Engine API socket used when "docker.host" isn't configured
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+var (
+	ErrBuildStepFailed    = e.New("Image build step failed")
+	ErrRegistryAuthDenied = e.New("Registry denied access to the image")
+	ErrLayerPushFailed    = e.New("Pushing an image layer failed")
+)
+
+// ProgressMessage is a single message of a Docker Engine build or push progress stream
+type ProgressMessage struct {
+	// Stream is a line of build output
+	Stream string `json:"stream,omitempty"`
+	// Status is the state of a push, or of the layer named by ID
+	Status string `json:"status,omitempty"`
+	// ID is the layer a Status is about
+	ID string `json:"id,omitempty"`
+	// Progress is a progress bar of the layer named by ID
+	Progress string `json:"progress,omitempty"`
+	// Error is set when the build or push failed
+	Error       string `json:"error,omitempty"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail,omitempty"`
+	// Aux carries the result of a build or push, such as the pushed digest
+	Aux json.RawMessage `json:"aux,omitempty"`
+}
+
+// ProgressFunc receives every progress message of a build or push as it arrives
+type ProgressFunc func(*ProgressMessage)
+
+// DockerEngineManager implements ImageManager with the Docker Engine API, talking to the
+// daemon directly instead of running the docker binary
+type DockerEngineManager struct {
+	// Progress receives the progress of builds and pushes, and may be nil
+	Progress ProgressFunc
+	// host is the base URL requests are sent to
+	host   string
+	client *http.Client
+	// registry holds the credentials pushes authenticate with
+	registry *RegistryClient
+}
+
+// engineBuild is the part of the docker build arguments the Engine API supports
+type engineBuild struct {
+	contextDir string
+	dockerfile string
+	buildArgs  map[string]string
+	target     string
+	noCache    bool
+	pull       bool
+}
+
+// NewDockerEngineManager returns a DockerEngineManager for the daemon at "docker.host",
+// DefaultDockerHost when it isn't configured, reporting progress to progress
+func NewDockerEngineManager(progress ProgressFunc) (*DockerEngineManager, error) {
+	dockerHost := viper.GetString("docker.host")
+	if dockerHost == "" {
+		dockerHost = DefaultDockerHost
+	}
+	hostURL, err := url.Parse(dockerHost)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse docker host %q", dockerHost)
+	}
+	manager := &DockerEngineManager{Progress: progress, registry: NewRegistryClient()}
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		manager.host = "http://docker"
+		manager.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	case "tcp", "http":
+		manager.host = "http://" + hostURL.Host
+		manager.client = &http.Client{}
+	default:
+		return nil, errors.Errorf("Unsupported docker host %q, must be unix:// or tcp://", dockerHost)
+	}
+	return manager, nil
+}
+
+// Build sends the build context to the daemon and builds an image with every tag and
+// label in opts. args are the docker build arguments, of which the context directory,
+// -f/--file, --build-arg, --target, --no-cache and --pull are supported
+func (engine *DockerEngineManager) Build(opts BuildOptions, args ...string) error {
+	build, err := parseBuildArgs(args)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for _, tag := range opts.Tags {
+		query.Add("t", tag)
+	}
+	query.Set("dockerfile", build.dockerfile)
+	if len(opts.Labels) > 0 {
+		labels, _ := json.Marshal(opts.Labels)
+		query.Set("labels", string(labels))
+	}
+	if len(build.buildArgs) > 0 {
+		buildArgs, _ := json.Marshal(build.buildArgs)
+		query.Set("buildargs", string(buildArgs))
+	}
+	if build.target != "" {
+		query.Set("target", build.target)
+	}
+	if build.noCache {
+		query.Set("nocache", "1")
+	}
+	if build.pull {
+		query.Set("pull", "1")
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, build.contextDir, build.dockerfile))
+	}()
+	defer reader.Close()
+	req, err := http.NewRequest("POST", engine.host+"/build?"+query.Encode(), reader)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create build request")
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+	res, err := engine.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var step string
+	return engine.readProgress(res.Body, func(msg *ProgressMessage) error {
+		if strings.HasPrefix(msg.Stream, "Step ") {
+			step = strings.TrimSpace(msg.Stream)
+		}
+		if message := msg.errorMessage(); message != "" {
+			if step == "" {
+				return errors.Wrap(ErrBuildStepFailed, message)
+			}
+			return errors.Wrapf(ErrBuildStepFailed, "%s: %s", step, message)
+		}
+		return nil
+	})
+}
+
+// Push pushes NAME:TAG to its registry, authenticating with the "registry" credentials
+func (engine *DockerEngineManager) Push(name string) error {
+	ref, err := parseImageReference(name)
+	if err != nil {
+		return err
+	}
+	repository, tag := name, ref.Reference
+	if sep := strings.LastIndex(name, ":"); sep > strings.LastIndex(name, "/") {
+		repository = name[:sep]
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/images/%s/push?%s", engine.host, repository, url.Values{"tag": {tag}}.Encode()), nil)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create push request for %q", name)
+	}
+	req.Header.Set("X-Registry-Auth", engine.registryAuth(ref.Registry))
+	res, err := engine.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var layer string
+	return engine.readProgress(res.Body, func(msg *ProgressMessage) error {
+		if msg.ID != "" && msg.ID != tag {
+			layer = msg.ID
+		}
+		message := msg.errorMessage()
+		switch {
+		case message == "":
+			return nil
+		case isAuthError(message):
+			return errors.Wrapf(ErrRegistryAuthDenied, "%q: %s", name, message)
+		case layer != "":
+			return errors.Wrapf(ErrLayerPushFailed, "layer %s of %q: %s", layer, name, message)
+		default:
+			return errors.Errorf("Failed to push %q: %s", name, message)
+		}
+	})
+}
+
+// Inspect reads the digest the daemon recorded for name when it was pushed, along with
+// the image's size, architecture and layer count
+func (engine *DockerEngineManager) Inspect(name string) (*RegistryInfo, error) {
+	inspected, err := engine.inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	digest := repoDigest(name, inspected.RepoDigests)
+	if digest == "" {
+		return nil, errors.Errorf("Docker has no digest for %q, it may not have been pushed", name)
+	}
+	return &RegistryInfo{
+		Digest:       digest,
+		Size:         inspected.Size,
+		Architecture: inspected.Architecture,
+		Layers:       len(inspected.RootFS.Layers),
+	}, nil
+}
+
+// Labels returns the labels a local image was built with
+func (engine *DockerEngineManager) Labels(name string) (map[string]string, error) {
+	inspected, err := engine.inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	return inspected.Config.Labels, nil
+}
+
+// inspect returns the daemon's inspection of a local image
+func (engine *DockerEngineManager) inspect(name string) (*dockerInspection, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/images/%s/json", engine.host, name), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create inspect request for %q", name)
+	}
+	res, err := engine.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to inspect image %q", name)
+	}
+	defer res.Body.Close()
+	inspected := &dockerInspection{}
+	err = json.NewDecoder(res.Body).Decode(inspected)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read inspection of image %q", name)
+	}
+	return inspected, nil
+}
+
+// do sends a request to the daemon, turning error responses into errors
+func (engine *DockerEngineManager) do(req *http.Request) (*http.Response, error) {
+	res, err := engine.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to reach the Docker daemon")
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	body := struct {
+		Message string `json:"message"`
+	}{}
+	json.NewDecoder(res.Body).Decode(&body)
+	return nil, errors.Errorf("Docker daemon responded %s: %s", res.Status, body.Message)
+}
+
+// readProgress passes every message of a progress stream to the Progress callback and
+// then to check, stopping at the first error check returns
+func (engine *DockerEngineManager) readProgress(rd io.Reader, check func(*ProgressMessage) error) error {
+	decoder := json.NewDecoder(bufio.NewReader(rd))
+	for {
+		msg := &ProgressMessage{}
+		err := decoder.Decode(msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed to read progress from the Docker daemon")
+		}
+		if engine.Progress != nil {
+			engine.Progress(msg)
+		}
+		err = check(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// registryAuth returns the X-Registry-Auth header for pushing to registry
+func (engine *DockerEngineManager) registryAuth(registry string) string {
+	auth := map[string]string{}
+	if engine.registry != nil && engine.registry.Username != "" {
+		auth["username"] = engine.registry.Username
+		auth["password"] = engine.registry.Password
+		auth["serveraddress"] = registry
+	}
+	data, _ := json.Marshal(auth)
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// errorMessage returns the error of a progress message, or "" if it isn't one
+func (msg *ProgressMessage) errorMessage() string {
+	if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+		return msg.ErrorDetail.Message
+	}
+	return msg.Error
+}
+
+// isAuthError returns true if a push error is the registry refusing the credentials
+func isAuthError(message string) bool {
+	message = strings.ToLower(message)
+	for _, denied := range []string{"denied", "unauthorized", "authentication required"} {
+		if strings.Contains(message, denied) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBuildArgs reads the docker build arguments the Engine API supports
+func parseBuildArgs(args []string) (*engineBuild, error) {
+	build := &engineBuild{dockerfile: "Dockerfile", buildArgs: map[string]string{}}
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := args[i], "", false
+		if eq := strings.Index(flag, "="); strings.HasPrefix(flag, "-") && eq >= 0 {
+			flag, value, hasValue = flag[:eq], flag[eq+1:], true
+		}
+		needValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", errors.Errorf("Build argument %s needs a value", flag)
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch flag {
+		case "-f", "--file":
+			build.dockerfile, err = needValue()
+		case "--build-arg":
+			var buildArg string
+			buildArg, err = needValue()
+			pair := strings.SplitN(buildArg, "=", 2)
+			if len(pair) == 2 {
+				build.buildArgs[pair[0]] = pair[1]
+			} else {
+				build.buildArgs[pair[0]] = os.Getenv(pair[0])
+			}
+		case "--target":
+			build.target, err = needValue()
+		case "--no-cache":
+			build.noCache = true
+		case "--pull":
+			build.pull = true
+		default:
+			if strings.HasPrefix(flag, "-") {
+				return nil, errors.Errorf("Build argument %s isn't supported by the Docker Engine API builder", flag)
+			}
+			positional = append(positional, flag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch len(positional) {
+	case 0:
+		build.contextDir = "."
+	case 1:
+		build.contextDir = positional[0]
+	default:
+		return nil, errors.Errorf("Expected a single build context, but found %s", strings.Join(positional, " "))
+	}
+	return build, nil
+}
+
+// writeBuildContext writes the files of dir as a tar archive, leaving out the paths
+// matched by its .dockerignore, except for the Dockerfile
+func writeBuildContext(wr io.Writer, dir string, dockerfile string) error {
+	ignored, err := readDockerignore(dir)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewWriter(wr)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != dockerfile && isIgnored(rel, ignored) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() || !info.Mode().IsRegular() {
+			if info.Mode()&os.ModeSymlink != 0 {
+				header.Linkname, err = os.Readlink(path)
+				if err != nil {
+					return err
+				}
+			}
+			return archive.WriteHeader(header)
+		}
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(archive, file)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to archive build context %q", dir)
+	}
+	return errors.Wrap(archive.Close(), "Failed to archive build context")
+}
+
+// readDockerignore returns the patterns in the .dockerignore of dir
+func readDockerignore(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read .dockerignore")
+	}
+	defer file.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimPrefix(filepath.ToSlash(filepath.Clean(pattern)), "/"))
+	}
+	return patterns, errors.Wrap(scanner.Err(), "Failed to read .dockerignore")
+}
+
+// isIgnored returns true if path, or a directory it is in, matches a .dockerignore pattern.
+// Patterns starting with "!" include paths an earlier pattern ignored
+func isIgnored(path string, patterns []string) bool {
+	ignored := false
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for prefix := path; prefix != "."; prefix = filepath.ToSlash(filepath.Dir(prefix)) {
+			if matched, _ := filepath.Match(pattern, prefix); matched {
+				ignored = !exclude
+				break
+			}
+		}
+	}
+	return ignored
+}
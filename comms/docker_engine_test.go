@@ -0,0 +1,219 @@
+package comms
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// newTestEngineManager returns a DockerEngineManager talking to a stand-in daemon
+// answering with handler, and the messages its progress callback received
+func newTestEngineManager(t *testing.T, handler http.HandlerFunc) (*DockerEngineManager, *[]*ProgressMessage, func()) {
+	server := httptest.NewServer(handler)
+	viper.Set("docker.host", "tcp://"+server.Listener.Addr().String())
+	defer viper.Set("docker.host", "")
+	var messages []*ProgressMessage
+	manager, err := NewDockerEngineManager(func(msg *ProgressMessage) {
+		messages = append(messages, msg)
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to create engine manager: %s", err)
+	}
+	return manager, &messages, server.Close
+}
+
+// newTestBuildContext returns a build context directory with a Dockerfile, a source file
+// and an ignored file, and a func to remove it
+func newTestBuildContext(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gzr-build")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	files := map[string]string{
+		"Dockerfile":    "FROM scratch\nCOPY app /app\n",
+		".dockerignore": "# build output\nlogs\n*.tmp\n",
+		"app":           "app",
+		"scratch.tmp":   "ignored",
+		"logs/out.log":  "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDockerEngineManager_Build(t *testing.T) {
+	dir, cleanup := newTestBuildContext(t)
+	defer cleanup()
+	var archived []string
+	manager, messages, closeServer := newTestEngineManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/build" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if !reflect.DeepEqual(query["t"], []string{"repo/app:1", "repo/app:latest"}) || query.Get("labels") != `{"team":"platform"}` || query.Get("buildargs") != `{"VERSION":"1"}` {
+			t.Errorf("Expected tags, labels and build args in the query, but found %v", query)
+		}
+		reader := tar.NewReader(r.Body)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read build context: %s", err)
+			}
+			archived = append(archived, header.Name)
+		}
+		fmt.Fprint(w, `{"stream": "Step 1/2 : FROM scratch\n"}`+"\n"+`{"stream": "Step 2/2 : COPY app /app\n"}`+"\n"+`{"aux": {"ID": "sha256:aaaa"}}`)
+	})
+	defer closeServer()
+
+	err := manager.Build(BuildOptions{Tags: []string{"repo/app:1", "repo/app:latest"}, Labels: map[string]string{"team": "platform"}}, "--build-arg", "VERSION=1", dir)
+	if err != nil {
+		t.Fatalf("Build errored with %s", err)
+	}
+	sort.Strings(archived)
+	if !reflect.DeepEqual(archived, []string{".dockerignore", "Dockerfile", "app"}) {
+		t.Errorf("Expected the build context without ignored files, but found %v", archived)
+	}
+	if len(*messages) != 3 {
+		t.Errorf("Expected 3 progress messages, but found %d", len(*messages))
+	}
+}
+
+func TestDockerEngineManager_BuildStepFailed(t *testing.T) {
+	dir, cleanup := newTestBuildContext(t)
+	defer cleanup()
+	manager, _, closeServer := newTestEngineManager(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, `{"stream": "Step 2/2 : RUN make\n"}`+"\n"+`{"errorDetail": {"message": "make: not found"}, "error": "make: not found"}`)
+	})
+	defer closeServer()
+
+	err := manager.Build(BuildOptions{Tags: []string{"repo/app:1"}}, dir)
+	if errors.Cause(err) != ErrBuildStepFailed {
+		t.Fatalf("Expected ErrBuildStepFailed, but got %v", err)
+	}
+	if err.Error() != "Step 2/2 : RUN make: make: not found: Image build step failed" {
+		t.Errorf("Expected the failed step in the error, but found %q", err)
+	}
+}
+
+func TestDockerEngineManager_PushErrors(t *testing.T) {
+	cases := map[string]struct {
+		stream   string
+		expected error
+	}{
+		"auth": {
+			`{"status": "The push refers to repository [registry.example.com/repo/app]"}` + "\n" +
+				`{"errorDetail": {"message": "denied: requested access to the resource is denied"}, "error": "denied"}`,
+			ErrRegistryAuthDenied,
+		},
+		"layer": {
+			`{"status": "Pushing", "id": "5f70bf18a086", "progress": "[==>   ]"}` + "\n" +
+				`{"errorDetail": {"message": "blob upload unknown"}, "error": "blob upload unknown"}`,
+			ErrLayerPushFailed,
+		},
+	}
+	for name, c := range cases {
+		manager, _, closeServer := newTestEngineManager(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/images/registry.example.com/repo/app/push" || r.URL.Query().Get("tag") != "1" {
+				t.Errorf("Expected a push of registry.example.com/repo/app:1, but found %s", r.URL)
+			}
+			if r.Header.Get("X-Registry-Auth") == "" {
+				t.Error("Expected an X-Registry-Auth header")
+			}
+			fmt.Fprint(w, c.stream)
+		})
+		err := manager.Push("registry.example.com/repo/app:1")
+		if errors.Cause(err) != c.expected {
+			t.Errorf("Expected %v for a %s failure, but got %v", c.expected, name, err)
+		}
+		closeServer()
+	}
+}
+
+func TestDockerEngineManager_Inspect(t *testing.T) {
+	manager, _, closeServer := newTestEngineManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/repo/app:1/json" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such image"}`)
+			return
+		}
+		fmt.Fprint(w, `{"RepoDigests": ["repo/app@sha256:aaaa"], "Size": 1024, "Architecture": "amd64",
+			"RootFS": {"Layers": ["sha256:1", "sha256:2"]}, "Config": {"Labels": {"team": "platform"}}}`)
+	})
+	defer closeServer()
+
+	info, err := manager.Inspect("repo/app:1")
+	if err != nil {
+		t.Fatalf("Inspect errored with %s", err)
+	}
+	expected := RegistryInfo{Digest: "sha256:aaaa", Size: 1024, Architecture: "amd64", Layers: 2}
+	if *info != expected {
+		t.Errorf("Expected %+v, but found %+v", expected, *info)
+	}
+	labels, err := manager.Labels("repo/app:1")
+	if err != nil || labels["team"] != "platform" {
+		t.Errorf("Expected the image's labels, but got %v, %v", labels, err)
+	}
+	_, err = manager.Inspect("repo/app:2")
+	if err == nil {
+		t.Error("Expected an error inspecting a missing image")
+	}
+}
+
+func TestParseBuildArgs(t *testing.T) {
+	build, err := parseBuildArgs([]string{"--file=docker/Dockerfile", "--build-arg", "A=1", "--no-cache", "--target", "release", "src"})
+	if err != nil {
+		t.Fatalf("parseBuildArgs errored with %s", err)
+	}
+	expected := &engineBuild{contextDir: "src", dockerfile: "docker/Dockerfile", buildArgs: map[string]string{"A": "1"}, target: "release", noCache: true}
+	if !reflect.DeepEqual(build, expected) {
+		t.Errorf("Expected %+v, but found %+v", expected, build)
+	}
+	for _, args := range [][]string{{"--squash", "."}, {"a", "b"}, {"-f"}} {
+		if _, err := parseBuildArgs(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestWriteBuildContext_KeepsIgnoredDockerfile(t *testing.T) {
+	dir, cleanup := newTestBuildContext(t)
+	defer cleanup()
+	ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*\n!app\n"), 0644)
+
+	var buf bytes.Buffer
+	if err := writeBuildContext(&buf, dir, "Dockerfile"); err != nil {
+		t.Fatalf("writeBuildContext errored with %s", err)
+	}
+	var archived []string
+	reader := tar.NewReader(&buf)
+	for header, err := reader.Next(); err == nil; header, err = reader.Next() {
+		archived = append(archived, header.Name)
+	}
+	sort.Strings(archived)
+	if !reflect.DeepEqual(archived, []string{"Dockerfile", "app"}) {
+		t.Errorf("Expected only the Dockerfile and the re-included file, but found %v", archived)
+	}
+}
@@ -0,0 +1,60 @@
+package comms
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRepoDigest(t *testing.T) {
+	repoDigests := []string{
+		"registry.example.com:5000/team/app@sha256:aaaa",
+		"team/app@sha256:bbbb",
+	}
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"team/app:20170210.3b70356", "sha256:bbbb"},
+		{"registry.example.com:5000/team/app:1", "sha256:aaaa"},
+		{"registry.example.com:5000/team/app", "sha256:aaaa"},
+		{"team/other:1", ""},
+	}
+	for _, c := range cases {
+		digest := repoDigest(c.name, repoDigests)
+		if digest != c.expected {
+			t.Errorf("Expected digest %q for %s, but found %q", c.expected, c.name, digest)
+		}
+	}
+}
+
+func TestMetadataLabels_RoundTrip(t *testing.T) {
+	meta := ImageMetadata{
+		SchemaVersion: CurrentSchemaVersion,
+		GitCommit:     "3b703566512e427a424e5c4348bc1c56abbf07fe",
+		GitTag:        []string{"v1.0", "stable"},
+		GitOrigin:     "https://github.com/bypasslane/gzr",
+		CreatedAt:     "2017-02-10T17:11:56Z",
+	}
+	labels := MetadataLabels(meta)
+	if labels[OCIVersionLabel] != "v1.0 stable" {
+		t.Errorf("Expected git tags in %s, but found %q", OCIVersionLabel, labels[OCIVersionLabel])
+	}
+	inferred, missing := MetadataFromLabels(labels, "")
+	if len(missing) > 0 {
+		t.Errorf("Expected every field to be inferred, but %v were missing", missing)
+	}
+	if !reflect.DeepEqual(inferred, meta) {
+		t.Errorf("Expected %+v from labels, but found %+v", meta, inferred)
+	}
+}
+
+func TestLabelArgs(t *testing.T) {
+	args := labelArgs(map[string]string{OCISourceLabel: "https://github.com/bypasslane/gzr", OCIRevisionLabel: "aaa"})
+	expected := []string{
+		"--label", OCIRevisionLabel + "=aaa",
+		"--label", OCISourceLabel + "=https://github.com/bypasslane/gzr",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, but found %v", expected, args)
+	}
+}
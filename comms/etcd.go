@@ -4,26 +4,49 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/bradfitz/slice"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
+// etcdBuildPrefix is the key prefix under which build histories are kept, as
+// etcdBuildPrefix + NAME:VERSION/ + build number
+const etcdBuildPrefix = "gzr-builds/"
+
+// etcdIndexPrefix is the key prefix under which the secondary index keys used by Find are kept
+const etcdIndexPrefix = "gzr-index/"
+
+// etcdIndexMarker is set once images stored before Find existed have been indexed
+const etcdIndexMarker = "gzr-index-built"
+
+// etcdCommitAttempts is how many times a transaction is tried before giving up on images
+// that other writers keep changing
+const etcdCommitAttempts = 5
+
 // EtcdStorage implements GzrMetadataStore and has exported
 // Etcd clients and KV accessors
 type EtcdStorage struct {
-	Client    *clientv3.Client
-	KV        clientv3.KV
-	activeTxn clientv3.Txn
+	Client *clientv3.Client
+	KV     clientv3.KV
+	// txn collects the writes of the active transaction, which are sent to etcd in a
+	// single Txn when it's committed
+	txn *etcdTxn
+	// writes are the Stores and Deletes of the active transaction, made again on a
+	// fresh etcdTxn if another writer changes their images before it's committed
+	writes []func(*etcdTxn) error
 }
 
 // NewEtcdStorage initializes and returns a pointer to an EtcdStorage
-// with a connected Client and KV
-func NewEtcdStorage() (GzrMetadataStore, error) {
+// with a connected Client and KV. config holds the datastore settings,
+// normally the "datastore" block of the config file
+func NewEtcdStorage(config *viper.Viper) (GzrMetadataStore, error) {
 	newEtcd := &EtcdStorage{}
-	cxnString := fmt.Sprintf("%s:%s", viper.GetString("datastore.host"), viper.GetString("datastore.port"))
+	cxnString := fmt.Sprintf("%s:%s", config.GetString("host"), config.GetString("port"))
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints: []string{cxnString},
 	})
@@ -37,13 +60,52 @@ func NewEtcdStorage() (GzrMetadataStore, error) {
 	return newEtcd, nil
 }
 
-// List queries the etcd store for all images stored under a particular name
-func (store *EtcdStorage) List(imageName string) (*ImageList, error) {
-	resp, err := store.KV.Get(context.Background(), fmt.Sprintf("%s:", imageName), clientv3.WithPrefix())
+// List queries the etcd store for a page of the images stored under a particular name.
+// Pages in version order are read with a ranged Get starting after the continue token;
+// any other order or a label filter reads every image under the name
+func (store *EtcdStorage) List(imageName string, opts ListOptions) (*ImageList, error) {
+	after, err := opts.startAfter()
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("%s:", imageName)
+	start := prefix
+	getOpts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if opts.inStoreOrder() {
+		if after >= prefix {
+			start = after + "\x00"
+		}
+		getOpts = []clientv3.OpOption{clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix))}
+		if opts.Limit > 0 {
+			getOpts = append(getOpts, clientv3.WithLimit(int64(opts.Limit+1)))
+		}
+	}
+	resp, err := store.KV.Get(context.Background(), start, getOpts...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to retrieve images from etcd for %q", imageName)
 	}
-	return store.extractImages(resp)
+	images, err := store.extractImages(resp)
+	if err != nil {
+		return nil, err
+	}
+	return pageImages(images.Images, opts)
+}
+
+// ListAll returns every image in etcd, leaving out build histories
+func (store *EtcdStorage) ListAll() (*ImageList, error) {
+	resp, err := store.KV.Get(context.Background(), "", clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve all images from etcd")
+	}
+	var images []*Image
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if strings.HasPrefix(key, etcdBuildPrefix) || strings.HasPrefix(key, etcdIndexPrefix) || key == etcdIndexMarker {
+			continue
+		}
+		images = append(images, store.extractImage(kv.Value, kv.Key))
+	}
+	return &ImageList{Images: images}, nil
 }
 
 // Store stores the metadata about an image associated with its name in etcd
@@ -57,11 +119,67 @@ func (store *EtcdStorage) Store(imageName string, meta ImageMetadata) error {
 	if err != nil {
 		return errors.Wrapf(err, "Failed to create key %q in etcd", imageName)
 	}
-	store.activeTxn = store.activeTxn.Then(clientv3.OpPut(key, string(data)))
+
+	build := newImageBuild(0, meta)
+	return store.write(func(txn *etcdTxn) error {
+		builds, err := txn.get(etcdHistoryPrefix(key))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get build history for image %q from etcd", imageName)
+		}
+		// imported histories can have gaps, so the build after the highest one is next
+		seq := uint64(1)
+		for historyKey := range builds {
+			last, err := strconv.ParseUint(strings.TrimPrefix(historyKey, etcdHistoryPrefix(key)), 10, 64)
+			if err == nil && last >= seq {
+				seq = last + 1
+			}
+		}
+		build.Build = int(seq)
+		buildData, err := json.Marshal(build)
+		if err != nil {
+			return errors.Wrap(err, "Failed to convert image build into json")
+		}
+
+		txn.put(key, string(data))
+		// a concurrent Store of the same image takes the same build number, so only one of them commits
+		txn.expectUnchanged(etcdHistoryPrefix(key) + buildKey(seq))
+		txn.put(etcdHistoryPrefix(key)+buildKey(seq), string(buildData))
+		for _, indexKey := range indexKeys(key, meta) {
+			txn.put(etcdIndexPrefix+indexKey, "")
+		}
+		return nil
+	})
+}
+
+// Import records builds as the history of imageName, keeping their build numbers and store times
+func (store *EtcdStorage) Import(imageName string, builds []*ImageBuild) error {
+	key, err := createKey(imageName)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to store image metadata for image %q in etcd", imageName)
+		return errors.Wrapf(err, "Failed to create key %q in etcd", imageName)
 	}
-	return nil
+	if len(builds) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(builds[len(builds)-1].Meta)
+	if err != nil {
+		return errors.Wrap(err, "Failed to convert image metadata into json")
+	}
+	return store.write(func(txn *etcdTxn) error {
+		txn.put(key, string(data))
+		for _, build := range builds {
+			buildData, err := json.Marshal(build)
+			if err != nil {
+				return errors.Wrap(err, "Failed to convert image build into json")
+			}
+			historyKey := etcdHistoryPrefix(key) + buildKey(uint64(build.Build))
+			txn.expectUnchanged(historyKey)
+			txn.put(historyKey, string(buildData))
+			for _, indexKey := range indexKeys(key, build.Meta) {
+				txn.put(etcdIndexPrefix+indexKey, "")
+			}
+		}
+		return nil
+	})
 }
 
 // Cleanup closes the etcd client connection
@@ -69,30 +187,74 @@ func (store *EtcdStorage) Cleanup() {
 	store.Client.Close()
 }
 
-// Delete deletes all information related to IMAGE_NAME:VERSION
+// Delete deletes all information related to IMAGE_NAME:VERSION, along with its build
+// history and index keys, when the active transaction is committed
 func (store *EtcdStorage) Delete(imageName string) (int, error) {
-	resp, err := store.KV.Delete(context.Background(), imageName, clientv3.WithPrefix())
-	return int(resp.Deleted), errors.Wrapf(err, "Failed to delete image %q", imageName)
+	var deleted int
+	err := store.write(func(txn *etcdTxn) error {
+		var err error
+		deleted, err = store.deleteImages(txn, imageName)
+		return err
+	})
+	return deleted, err
+}
+
+// deleteImages deletes the images under imageName in txn and returns how many there were
+func (store *EtcdStorage) deleteImages(txn *etcdTxn, imageName string) (int, error) {
+	images, err := txn.get(imageName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get images to delete for %q", imageName)
+	}
+	deleted := 0
+	for key, value := range images {
+		if strings.HasPrefix(key, etcdBuildPrefix) || strings.HasPrefix(key, etcdIndexPrefix) || key == etcdIndexMarker {
+			continue
+		}
+		image := store.extractImage([]byte(value), []byte(key))
+		for _, indexKey := range indexKeys(image.Name, image.Meta) {
+			txn.delete(etcdIndexPrefix + indexKey)
+		}
+		// a concurrent Store of the image adds index keys this delete doesn't know about
+		txn.expectUnchanged(key)
+		txn.delete(key)
+		deleted += 1
+	}
+	builds, err := txn.get(etcdBuildPrefix + imageName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get build history to delete for %q", imageName)
+	}
+	for historyKey, value := range builds {
+		var build ImageBuild
+		json.Unmarshal([]byte(value), &build)
+		key := strings.TrimPrefix(historyKey, etcdBuildPrefix)
+		key = key[:strings.LastIndex(key, "/")]
+		for _, indexKey := range indexKeys(key, build.Meta) {
+			txn.delete(etcdIndexPrefix + indexKey)
+		}
+		txn.delete(historyKey)
+	}
+	return deleted, nil
 }
 
-// Get returns a single image based on a name
+// Get returns the image stored under exactly NAME:VERSION, or nil if there isn't one
 func (store *EtcdStorage) Get(imageName string) (*Image, error) {
-	resp, err := store.KV.Get(context.Background(), fmt.Sprintf("%s", imageName), clientv3.WithPrefix())
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q in etcd", imageName)
+	}
+	resp, err := store.KV.Get(context.Background(), key)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to get image %q from etcd", imageName)
 	}
 	if len(resp.Kvs) == 0 {
 		return nil, nil
 	}
-	if len(resp.Kvs) > 1 {
-		return nil, errors.Errorf("Found multiple images for %q", imageName)
-	}
 	return store.extractImage(resp.Kvs[0].Value, resp.Kvs[0].Key), nil
 }
 
 // GetLatest returns the latest image from a name
 func (store *EtcdStorage) GetLatest(imageName string) (*Image, error) {
-	images, err := store.List(imageName)
+	images, err := store.List(imageName, ListOptions{})
 	if err != nil {
 		return nil, errors.Wrapf(err, "Unable to get images for %q", imageName)
 	}
@@ -102,17 +264,166 @@ func (store *EtcdStorage) GetLatest(imageName string) (*Image, error) {
 	return images.Images[0], nil
 }
 
-// StartTransaction sets a new transaction on the EtcdStorage
+// History returns every stored build for a single NAME:VERSION, oldest first
+func (store *EtcdStorage) History(imageName string) (*ImageHistory, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q in etcd", imageName)
+	}
+	resp, err := store.KV.Get(context.Background(), etcdHistoryPrefix(key), clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get build history for %q from etcd", imageName)
+	}
+	history := &ImageHistory{Name: key}
+	for _, kv := range resp.Kvs {
+		var build ImageBuild
+		err = json.Unmarshal(kv.Value, &build)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read build %q from etcd", kv.Key)
+		}
+		history.Builds = append(history.Builds, &build)
+	}
+	return history, nil
+}
+
+// Find scans the index keys for candidate images and returns the ones matching query
+func (store *EtcdStorage) Find(query ImageQuery) (*ImageList, error) {
+	if query.IsEmpty() {
+		return nil, errors.New("Must provide a commit, tag, origin or digest to find images by")
+	}
+	err := store.indexExisting()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := store.KV.Get(context.Background(), etcdIndexPrefix+indexScanPrefix(query), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to search index in etcd")
+	}
+	var keys []string
+	for _, kv := range resp.Kvs {
+		keys = append(keys, indexedKey(strings.TrimPrefix(string(kv.Key), etcdIndexPrefix)))
+	}
+	return findIndexed(store, keys, query)
+}
+
+// Watch uses etcd's native watch to stream changes to images whose name begins with prefix,
+// including ones made by other gzr processes. Build history and index keys are left out
+func (store *EtcdStorage) Watch(ctx context.Context, prefix string) (<-chan *ImageEvent, error) {
+	events := make(chan *ImageEvent, watchBuffer)
+	changes := store.Client.Watch(ctx, prefix, clientv3.WithPrefix())
+	go func() {
+		defer close(events)
+		for resp := range changes {
+			if err := resp.Err(); err != nil {
+				log.WithError(err).Warnf("Stopped watching %q in etcd", prefix)
+				return
+			}
+			for _, change := range resp.Events {
+				key := string(change.Kv.Key)
+				if strings.HasPrefix(key, etcdBuildPrefix) || strings.HasPrefix(key, etcdIndexPrefix) || key == etcdIndexMarker {
+					continue
+				}
+				event := &ImageEvent{Type: ImageStored, Image: store.extractImage(change.Kv.Value, change.Kv.Key)}
+				if change.Type == clientv3.EventTypeDelete {
+					event = &ImageEvent{Type: ImageDeleted, Image: &Image{Name: key}}
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// indexExisting writes index keys for every image and build in etcd the first time Find is
+// used, for stores created before Find existed
+func (store *EtcdStorage) indexExisting() error {
+	resp, err := store.KV.Get(context.Background(), etcdIndexMarker, clientv3.WithCountOnly())
+	if err != nil {
+		return errors.Wrap(err, "Failed to check for index in etcd")
+	}
+	if resp.Count > 0 {
+		return nil
+	}
+	images, err := store.ListAll()
+	if err != nil {
+		return errors.Wrap(err, "Failed to list images to index")
+	}
+	for _, image := range images.Images {
+		builds, err := storedBuilds(store, image)
+		if err != nil {
+			return err
+		}
+		for _, build := range builds {
+			for _, indexKey := range indexKeys(image.Name, build.Meta) {
+				_, err = store.KV.Put(context.Background(), etcdIndexPrefix+indexKey, "")
+				if err != nil {
+					return errors.Wrapf(err, "Failed to index %q in etcd", image.Name)
+				}
+			}
+		}
+	}
+	_, err = store.KV.Put(context.Background(), etcdIndexMarker, "")
+	return errors.Wrap(err, "Failed to mark index as built in etcd")
+}
+
+// StartTransaction starts collecting writes for a new transaction on the EtcdStorage
 func (store *EtcdStorage) StartTransaction() error {
-	eTxn := store.KV.Txn(context.Background())
-	store.activeTxn = eTxn
+	store.txn = newEtcdTxn(store.KV)
+	store.writes = nil
+	return nil
+}
+
+// write makes a Store or Delete in the active transaction and keeps it to make again if the
+// transaction is retried
+func (store *EtcdStorage) write(w func(*etcdTxn) error) error {
+	err := w(store.txn)
+	if err != nil {
+		return err
+	}
+	store.writes = append(store.writes, w)
 	return nil
 }
 
-// CommitTransaction commits the active transaction
+// CommitTransaction applies every write collected in the active transaction in a single etcd Txn,
+// so either all of them are made or none are. The Txn fails if another writer changed the keys
+// it depends on, such as by taking the same build number, and is then retried from fresh reads.
+// etcd limits the operations in a Txn with its --max-txn-ops flag, which very large transactions
+// may need raised
 func (store *EtcdStorage) CommitTransaction() error {
-	_, err := store.activeTxn.Commit()
-	return errors.Wrap(err, "Failed to commit transaction to etcd")
+	txn, writes := store.txn, store.writes
+	store.txn, store.writes = nil, nil
+	for attempt := 1; ; attempt++ {
+		resp, err := store.KV.Txn(context.Background()).If(txn.cmps()...).Then(txn.ops()...).Commit()
+		if err != nil {
+			return errors.Wrap(err, "Failed to commit transaction to etcd")
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if attempt == etcdCommitAttempts {
+			return errors.Errorf("Failed to commit transaction to etcd, its images were changed by other writers %d times", attempt)
+		}
+		log.Debugf("Retrying transaction in etcd after its images were changed by another writer")
+		txn = newEtcdTxn(store.KV)
+		for _, w := range writes {
+			err = w(txn)
+			if err != nil {
+				return errors.Wrap(err, "Failed to retry transaction in etcd")
+			}
+		}
+	}
+}
+
+// RollbackTransaction discards the writes collected in the active transaction. Stores and
+// deletes are only sent to etcd when the transaction is committed, so dropping them is enough
+func (store *EtcdStorage) RollbackTransaction() error {
+	store.txn, store.writes = nil, nil
+	return nil
 }
 
 // extractImage transforms raw []byte of metadata and key into a full Image
@@ -133,3 +444,106 @@ func (store *EtcdStorage) extractImages(resp *clientv3.GetResponse) (*ImageList,
 	}
 	return &ImageList{Images: images}, nil
 }
+
+// etcdHistoryPrefix returns the prefix holding every build of a NAME:VERSION key
+func etcdHistoryPrefix(key string) string {
+	return fmt.Sprintf("%s%s/", etcdBuildPrefix, key)
+}
+
+// etcdTxn collects the writes of a transaction. A clientv3.Txn only takes one Then and
+// rejects a key written twice, so each key keeps only its last write until they're all
+// sent in a single Txn
+type etcdTxn struct {
+	kv   clientv3.KV
+	keys []string
+	// values are the last value written to each key, or nil if it was deleted
+	values map[string]*string
+	// revisions are the mod revision of every key read from etcd
+	revisions map[string]int64
+	// expected are the revisions keys must still have for the Txn to succeed
+	expected map[string]int64
+}
+
+// newEtcdTxn returns an empty etcdTxn reading from kv
+func newEtcdTxn(kv clientv3.KV) *etcdTxn {
+	return &etcdTxn{
+		kv:        kv,
+		values:    make(map[string]*string),
+		revisions: make(map[string]int64),
+		expected:  make(map[string]int64),
+	}
+}
+
+// expectUnchanged makes the Txn fail if another writer changes key before it's committed.
+// A key that wasn't read from etcd is expected to still be missing
+func (t *etcdTxn) expectUnchanged(key string) {
+	if _, expected := t.expected[key]; !expected {
+		t.expected[key] = t.revisions[key]
+	}
+}
+
+// cmps returns the comparisons guarding the Txn against keys changed since they were read
+func (t *etcdTxn) cmps() []clientv3.Cmp {
+	var cmps []clientv3.Cmp
+	for key, revision := range t.expected {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", revision))
+	}
+	return cmps
+}
+
+// put writes value to key when the transaction is committed
+func (t *etcdTxn) put(key string, value string) {
+	t.set(key, &value)
+}
+
+// delete removes key when the transaction is committed
+func (t *etcdTxn) delete(key string) {
+	t.set(key, nil)
+}
+
+func (t *etcdTxn) set(key string, value *string) {
+	if _, written := t.values[key]; !written {
+		t.keys = append(t.keys, key)
+	}
+	t.values[key] = value
+}
+
+// get returns the value of every key beginning with prefix as the transaction leaves them,
+// which is what's in etcd with the transaction's writes applied
+func (t *etcdTxn) get(prefix string) (map[string]string, error) {
+	resp, err := t.kv.Get(context.Background(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = string(kv.Value)
+		if _, read := t.revisions[string(kv.Key)]; !read {
+			t.revisions[string(kv.Key)] = kv.ModRevision
+		}
+	}
+	for key, value := range t.values {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value == nil {
+			delete(values, key)
+		} else {
+			values[key] = *value
+		}
+	}
+	return values, nil
+}
+
+// ops returns an operation for the last write to each key, in the order the keys were first written
+func (t *etcdTxn) ops() []clientv3.Op {
+	var ops []clientv3.Op
+	for _, key := range t.keys {
+		if value := t.values[key]; value != nil {
+			ops = append(ops, clientv3.OpPut(key, *value))
+		} else {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+	}
+	return ops
+}
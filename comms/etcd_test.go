@@ -0,0 +1,273 @@
+package comms
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/spf13/viper"
+)
+
+// newTestEtcdStorage returns an EtcdStorage on the etcd at $GZR_TEST_ETCD_ENDPOINT, formatted as
+// HOST:PORT, skipping the test when it isn't set. Every key is deleted first
+func newTestEtcdStorage(t *testing.T) GzrMetadataStore {
+	store, err := NewEtcdStorage(testEtcdConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to create etcd storage: %s", err)
+	}
+	_, err = store.(*EtcdStorage).KV.Delete(context.Background(), "", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("Failed to empty etcd: %s", err)
+	}
+	return store
+}
+
+// testEtcdConfig returns datastore settings for the etcd at $GZR_TEST_ETCD_ENDPOINT
+func testEtcdConfig(t *testing.T) *viper.Viper {
+	endpoint := os.Getenv("GZR_TEST_ETCD_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GZR_TEST_ETCD_ENDPOINT not set")
+	}
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		t.Fatalf("GZR_TEST_ETCD_ENDPOINT must be formatted as HOST:PORT: %s", err)
+	}
+	config := viper.New()
+	config.Set("host", host)
+	config.Set("port", port)
+	return config
+}
+
+func TestEtcdStorage_Store_TwoImagesInOneTransaction(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	for _, name := range []string{"repo/app:20170210", "repo/app:latest"} {
+		if err := store.Store(name, ImageMetadata{GitCommit: "aaa"}); err != nil {
+			t.Fatalf("Failed to store %q: %s", name, err)
+		}
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+
+	for _, name := range []string{"repo/app:20170210", "repo/app:latest"} {
+		history, err := store.History(name)
+		if err != nil {
+			t.Fatalf("History errored with %s", err)
+		}
+		if len(history.Builds) != 1 || history.Builds[0].Meta.GitCommit != "aaa" {
+			t.Errorf("Expected 1 build of %q with commit %q, but found %+v", name, "aaa", history.Builds)
+		}
+	}
+}
+
+func TestEtcdStorage_RollbackTransaction_DiscardsDelete(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	deleted, err := store.Delete("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Delete errored with %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 image deleted, but found %d", deleted)
+	}
+	if err := store.RollbackTransaction(); err != nil {
+		t.Fatalf("Failed to roll back transaction: %s", err)
+	}
+
+	images, err := store.Find(ImageQuery{GitCommit: "aaa"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 1 {
+		t.Errorf("Expected rolled back delete to keep the image, but found %d images", len(images.Images))
+	}
+}
+
+func TestEtcdStorage_Delete_RemovesHistoryAndIndex(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if _, err := store.Delete("repo/app:20170210"); err != nil {
+		t.Fatalf("Delete errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+
+	resp, err := store.(*EtcdStorage).KV.Get(context.Background(), "", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		t.Fatalf("Failed to list keys: %s", err)
+	}
+	for _, kv := range resp.Kvs {
+		if string(kv.Key) != etcdIndexMarker {
+			t.Errorf("Expected every key of the image to be deleted, but found %q", kv.Key)
+		}
+	}
+}
+
+func TestEtcdStorage_CommitTransaction_RetriesConcurrentStore(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+	other, err := NewEtcdStorage(testEtcdConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to create etcd storage: %s", err)
+	}
+	defer other.Cleanup()
+
+	for _, s := range []GzrMetadataStore{store, other} {
+		if err := s.StartTransaction(); err != nil {
+			t.Fatalf("Failed to start transaction: %s", err)
+		}
+	}
+	if err := store.Store("repo/app:20170210", ImageMetadata{GitCommit: "aaa"}); err != nil {
+		t.Fatalf("Failed to store: %s", err)
+	}
+	if err := other.Store("repo/app:20170210", ImageMetadata{GitCommit: "bbb"}); err != nil {
+		t.Fatalf("Failed to store: %s", err)
+	}
+	for _, s := range []GzrMetadataStore{store, other} {
+		if err := s.CommitTransaction(); err != nil {
+			t.Fatalf("Failed to commit transaction: %s", err)
+		}
+	}
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 2 {
+		t.Fatalf("Expected both builds to be kept, but found %d", len(history.Builds))
+	}
+	if history.Builds[0].Build != 1 || history.Builds[1].Build != 2 || history.Builds[1].Meta.GitCommit != "bbb" {
+		t.Errorf("Expected the later commit to be retried as build 2, but found %+v and %+v", history.Builds[0], history.Builds[1])
+	}
+}
+
+func TestEtcdStorage_Get_MatchesVersionExactly(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+	storeInTransaction(t, store, "repo/app:10", ImageMetadata{GitCommit: "aaa"})
+
+	image, err := store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image != nil {
+		t.Errorf("Expected no image for version 1, but found %q", image.Name)
+	}
+
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{GitCommit: "bbb"})
+	image, err = store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image == nil || image.Name != "repo/app:1" || image.Meta.GitCommit != "bbb" {
+		t.Errorf("Expected repo/app:1 with commit %q, but found %+v", "bbb", image)
+	}
+}
+
+func TestEtcdStorage_Import_KeepsBuildNumbersAndStoreTimes(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+
+	builds := []*ImageBuild{
+		{Build: 1, StoredAt: "2017-02-10T00:00:00Z", Meta: ImageMetadata{GitCommit: "aaa"}},
+		{Build: 2, StoredAt: "2017-02-11T00:00:00Z", Meta: ImageMetadata{GitCommit: "bbb"}},
+	}
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := store.Import("repo/app:20170210", builds); err != nil {
+		t.Fatalf("Import errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "ccc"})
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 3 || !sameBuilds(history.Builds[:2], builds) || history.Builds[2].Build != 3 {
+		t.Errorf("Expected imported builds followed by build 3, but found %+v", history.Builds)
+	}
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.GitCommit != "ccc" {
+		t.Errorf("Expected newest commit %q, but found %q", "ccc", image.Meta.GitCommit)
+	}
+}
+
+func TestEtcdStorage_Store_FollowsHighestImportedBuild(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+
+	builds := []*ImageBuild{
+		{Build: 1, StoredAt: "2017-02-10T00:00:00Z", Meta: ImageMetadata{GitCommit: "aaa"}},
+		{Build: 3, StoredAt: "2017-02-11T00:00:00Z", Meta: ImageMetadata{GitCommit: "ccc"}},
+	}
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := store.Import("repo/app:20170210", builds); err != nil {
+		t.Fatalf("Import errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "ddd"})
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 3 || !sameBuilds(history.Builds[:2], builds) || history.Builds[2].Build != 4 {
+		t.Errorf("Expected imported builds 1 and 3 followed by build 4, but found %+v", history.Builds)
+	}
+}
+
+func TestEtcdStorage_DeleteAndImportInOneTransaction(t *testing.T) {
+	store := newTestEtcdStorage(t)
+	defer store.Cleanup()
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "old"})
+
+	builds := []*ImageBuild{{Build: 1, StoredAt: "2017-02-10T00:00:00Z", Meta: ImageMetadata{GitCommit: "new"}}}
+	if err := importBuilds(store, "repo/app:20170210", builds, true); err != nil {
+		t.Fatalf("importBuilds errored with %s", err)
+	}
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if !sameBuilds(history.Builds, builds) {
+		t.Errorf("Expected the history to be replaced, but found %+v", history.Builds)
+	}
+	images, err := store.Find(ImageQuery{GitCommit: "old"})
+	if err != nil {
+		t.Fatalf("Find errored with %s", err)
+	}
+	if len(images.Images) != 0 {
+		t.Errorf("Expected the replaced build to be unindexed, but found %d images", len(images.Images))
+	}
+}
@@ -0,0 +1,485 @@
+package comms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bradfitz/slice"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// fileLockName is the lock file held in the root directory for the life of a transaction
+	fileLockName = ".gzr.lock"
+	// fileExtension is the extension of every image document
+	fileExtension = ".json"
+	// fileLockStaleAge is how old a lock file that doesn't name the process holding it must
+	// be before a new transaction takes it over
+	fileLockStaleAge = time.Minute
+)
+
+// FileStorage implements GzrMetadataStore by keeping one JSON document per image
+// under a directory tree laid out as <root>/<repo>/<name>/<version>.json.
+// Writes are staged in memory during a transaction and written with atomic renames on commit
+type FileStorage struct {
+	root string
+	// lock is the held lock file, nil when no transaction is active
+	lock *os.File
+	// pendingWrites are documents to write on commit, keyed by path
+	pendingWrites map[string]*ImageHistory
+	// pendingDeletes are documents to remove on commit, keyed by path
+	pendingDeletes map[string]bool
+	// notifier sends events to Watch. Only changes made through this process are seen
+	notifier imageNotifier
+}
+
+// NewFileStorage makes sure the configured root directory exists and returns a FileStorage using it.
+// config holds the datastore settings, normally the "datastore" block of the config file
+func NewFileStorage(config *viper.Viper) (GzrMetadataStore, error) {
+	root := config.GetString("root_path")
+	debugLog := log.WithFields(log.Fields{"root": root})
+	defer debugLog.Debug("NewFileStorage")
+	if root == "" {
+		return nil, errors.New("Must provide \"root_path\" datastore setting in config file")
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create root directory %q", root)
+	}
+	return &FileStorage{root: root}, nil
+}
+
+// List reads every document whose image name begins with imageName and returns a page of them
+func (store *FileStorage) List(imageName string, opts ListOptions) (*ImageList, error) {
+	var images []*Image
+	err := store.walk(imageName, func(key string, history *ImageHistory) error {
+		if len(history.Builds) > 0 {
+			images = append(images, &Image{Name: key, Meta: history.Builds[len(history.Builds)-1].Meta})
+		}
+		return nil
+	})
+	if err != nil {
+		return &ImageList{}, errors.Wrapf(err, "Failed to retrieve image list for %q from %q", imageName, store.root)
+	}
+	return pageImages(images, opts)
+}
+
+// ListAll reads every document under the root directory
+func (store *FileStorage) ListAll() (*ImageList, error) {
+	return store.List("", ListOptions{})
+}
+
+// Store stages meta as the next build in the image's document
+func (store *FileStorage) Store(imageName string, meta ImageMetadata) error {
+	if store.lock == nil {
+		return errors.New("Must start a transaction before storing")
+	}
+	key, err := createKey(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create key %q for file store", imageName)
+	}
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	history, ok := store.pendingWrites[path]
+	if !ok {
+		history, err = store.read(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read existing document for %q", imageName)
+		}
+		if history == nil || store.pendingDeletes[path] {
+			history = &ImageHistory{Name: key}
+		}
+	}
+	seq := 1
+	if len(history.Builds) > 0 {
+		seq = history.Builds[len(history.Builds)-1].Build + 1
+	}
+	history.Builds = append(history.Builds, newImageBuild(seq, meta))
+	store.pendingWrites[path] = history
+	delete(store.pendingDeletes, path)
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: meta})
+	return nil
+}
+
+// Import stages builds as the image's document, keeping their build numbers and store times
+func (store *FileStorage) Import(imageName string, builds []*ImageBuild) error {
+	if store.lock == nil {
+		return errors.New("Must start a transaction before importing")
+	}
+	key, err := createKey(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create key %q for file store", imageName)
+	}
+	if len(builds) == 0 {
+		return nil
+	}
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	store.pendingWrites[path] = &ImageHistory{Name: key, Builds: builds}
+	delete(store.pendingDeletes, path)
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: builds[len(builds)-1].Meta})
+	return nil
+}
+
+// Cleanup releases the lock if a transaction was left open
+func (store *FileStorage) Cleanup() {
+	store.RollbackTransaction()
+}
+
+// Delete stages removal of every document whose image name begins with imageName
+func (store *FileStorage) Delete(imageName string) (int, error) {
+	if store.lock == nil {
+		return 0, errors.New("Must start a transaction before deleting")
+	}
+	deleted := 0
+	err := store.walk(imageName, func(key string, _ *ImageHistory) error {
+		path, err := store.path(key)
+		if err != nil {
+			return err
+		}
+		store.pendingDeletes[path] = true
+		delete(store.pendingWrites, path)
+		store.notifier.queue(ImageDeleted, &Image{Name: key})
+		deleted += 1
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to delete images for %q", imageName)
+	}
+	return deleted, nil
+}
+
+// Get returns the newest build of a single NAME:VERSION, or nil if it isn't stored
+func (store *FileStorage) Get(imageName string) (*Image, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q for file store", imageName)
+	}
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.read(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get image %q", imageName)
+	}
+	if history == nil || len(history.Builds) == 0 {
+		return nil, nil
+	}
+	return &Image{Name: key, Meta: history.Builds[len(history.Builds)-1].Meta}, nil
+}
+
+// GetLatest returns the latest image from a name
+func (store *FileStorage) GetLatest(imageName string) (*Image, error) {
+	images, err := store.List(imageName, ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get images for %q", imageName)
+	}
+	if len(images.Images) == 0 {
+		return nil, errors.Errorf("No images found for %q", imageName)
+	}
+	slice.Sort(images.Images, func(i, j int) bool {
+		return images.Images[j].Meta.CreatedAt < images.Images[i].Meta.CreatedAt
+	})
+	return images.Images[0], nil
+}
+
+// Find reads every document and returns the images with a build matching query
+func (store *FileStorage) Find(query ImageQuery) (*ImageList, error) {
+	if query.IsEmpty() {
+		return nil, errors.New("Must provide a commit, tag, origin or digest to find images by")
+	}
+	var images []*Image
+	err := store.walk("", func(key string, history *ImageHistory) error {
+		history.Name = key
+		if image := findInHistory(history, query); image != nil {
+			images = append(images, image)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to search images in %q", store.root)
+	}
+	return &ImageList{Images: images}, nil
+}
+
+// History returns every stored build for a single NAME:VERSION, oldest first
+func (store *FileStorage) History(imageName string) (*ImageHistory, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q for file store", imageName)
+	}
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+	history, err := store.read(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get build history for %q", imageName)
+	}
+	if history == nil {
+		return &ImageHistory{Name: key}, nil
+	}
+	return history, nil
+}
+
+// Watch returns the events for images whose name begins with prefix as transactions are
+// committed by this process. Changes made by other processes sharing the root directory aren't seen
+func (store *FileStorage) Watch(ctx context.Context, prefix string) (<-chan *ImageEvent, error) {
+	return store.notifier.watch(ctx, prefix), nil
+}
+
+// StartTransaction takes the lock file in the root directory. It fails if another
+// transaction already holds the lock, unless the process that took it is no longer running
+func (store *FileStorage) StartTransaction() error {
+	lockPath := filepath.Join(store.root, fileLockName)
+	lock, err := createLockFile(lockPath)
+	if os.IsExist(err) && staleLock(lockPath) {
+		log.WithField("path", lockPath).Warn("Removing lock file left by a gzr process that is no longer running")
+		os.Remove(lockPath)
+		lock, err = createLockFile(lockPath)
+	}
+	if os.IsExist(err) {
+		return errors.Errorf("Another transaction holds the lock file in %q", store.root)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to create lock file")
+	}
+	store.lock = lock
+	store.pendingWrites = make(map[string]*ImageHistory)
+	store.pendingDeletes = make(map[string]bool)
+	return nil
+}
+
+// CommitTransaction writes every staged document through a temporary file and rename,
+// removes staged deletions, releases the lock and sends the transaction's events to watchers
+func (store *FileStorage) CommitTransaction() error {
+	if store.lock == nil {
+		return errors.New("No active transaction to commit")
+	}
+	defer store.release()
+	for path, history := range store.pendingWrites {
+		err := writeFileAtomic(path, history)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write document for %q", history.Name)
+		}
+	}
+	for path := range store.pendingDeletes {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to remove %q", path)
+		}
+	}
+	store.notifier.publish()
+	return nil
+}
+
+// RollbackTransaction discards everything staged and releases the lock
+func (store *FileStorage) RollbackTransaction() error {
+	if store.lock == nil {
+		return nil
+	}
+	return errors.Wrap(store.release(), "Failed to release lock file")
+}
+
+// release drops the staged changes and events and removes the lock file
+func (store *FileStorage) release() error {
+	store.pendingWrites = nil
+	store.pendingDeletes = nil
+	store.notifier.discard()
+	store.lock.Close()
+	store.lock = nil
+	return os.Remove(filepath.Join(store.root, fileLockName))
+}
+
+// path returns the document path for a NAME:VERSION key. Keys that would reach outside
+// the root directory are rejected
+func (store *FileStorage) path(key string) (string, error) {
+	name, version, err := splitKey(key)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(version, "/") {
+		return "", errors.Errorf("Version of %q must not contain a slash", key)
+	}
+	err = checkPathSegments(name + "/" + version)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to find a document path for %q", key)
+	}
+	return filepath.Join(store.root, filepath.FromSlash(name), version+fileExtension), nil
+}
+
+// checkPathSegments returns an error if the slash separated path is absolute or has a ".."
+// segment, either of which could lead outside the root directory
+func checkPathSegments(path string) error {
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(filepath.FromSlash(path)) {
+		return errors.Errorf("%q must not be an absolute path", path)
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(filepath.FromSlash(path)), "/") {
+		if segment == ".." {
+			return errors.Errorf("%q must not contain a \"..\" segment", path)
+		}
+	}
+	return nil
+}
+
+// key returns the NAME:VERSION key for a document path
+func (store *FileStorage) key(path string) (string, error) {
+	rel, err := filepath.Rel(store.root, path)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(strings.TrimSuffix(rel, fileExtension))
+	sep := strings.LastIndex(rel, "/")
+	if sep < 0 {
+		return "", errors.Errorf("Document %q is not under an image name", path)
+	}
+	return rel[:sep] + ":" + rel[sep+1:], nil
+}
+
+// read returns the document at path, or nil if there isn't one
+func (store *FileStorage) read(path string) (*ImageHistory, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history ImageHistory
+	err = json.Unmarshal(data, &history)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse %q", path)
+	}
+	return &history, nil
+}
+
+// walk calls fn with every document whose key begins with prefix, stopping at the first error fn returns
+func (store *FileStorage) walk(prefix string, fn func(string, *ImageHistory) error) error {
+	// Only the directory up to the prefix's last slash can hold matches
+	start := store.root
+	if sep := strings.LastIndex(prefix, "/"); sep >= 0 {
+		err := checkPathSegments(prefix[:sep])
+		if err != nil {
+			return err
+		}
+		start = filepath.Join(store.root, filepath.FromSlash(prefix[:sep]))
+	}
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != fileExtension {
+			return nil
+		}
+		key, err := store.key(path)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		history, err := store.read(path)
+		if err != nil {
+			return err
+		}
+		return fn(key, history)
+	})
+}
+
+// createLockFile creates the lock file at path, failing if it already exists, and records
+// the process and host holding it
+func createLockFile(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	_, err = fmt.Fprintf(lock, "%d %s\n", os.Getpid(), hostname)
+	if err != nil {
+		lock.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return lock, nil
+}
+
+// staleLock returns true if the lock file at path was left by a process on this host that is no
+// longer running, or doesn't name its process and is older than fileLockStaleAge. Locks taken on
+// other hosts sharing the root directory are never stale, as their processes can't be checked
+func staleLock(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var pid int
+	var host string
+	_, err = fmt.Sscanf(string(data), "%d %s", &pid, &host)
+	if err != nil {
+		return time.Since(info.ModTime()) > fileLockStaleAge
+	}
+	hostname, _ := os.Hostname()
+	return host == hostname && !processRunning(pid)
+}
+
+// processRunning returns true if a process with the pid is running on this host
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	// a process owned by another user can't be signalled, but is running
+	if sysErr, ok := err.(*os.SyscallError); ok && sysErr.Err == syscall.EPERM {
+		return true
+	}
+	return err == nil
+}
+
+// writeFileAtomic writes history as indented JSON to a temporary file next to path
+// and renames it into place, so readers never see a partial document
+func writeFileAtomic(path string, history *ImageHistory) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".gzr-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,214 @@
+package comms
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// newTestFileStorage returns a FileStorage rooted in a temporary directory and a func to remove it
+func newTestFileStorage(t *testing.T) (GzrMetadataStore, string, func()) {
+	dir, err := ioutil.TempDir("", "gzr-file")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	store, err := NewFileStorage(fileStorageConfig(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create file storage: %s", err)
+	}
+	return store, dir, func() {
+		store.Cleanup()
+		os.RemoveAll(dir)
+	}
+}
+
+// fileStorageConfig returns datastore settings for a FileStorage rooted in dir
+func fileStorageConfig(dir string) *viper.Viper {
+	config := viper.New()
+	config.Set("root_path", dir)
+	return config
+}
+
+func TestFileStorage_Store_WritesDocumentPerImage(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+
+	if _, err := os.Stat(filepath.Join(dir, "repo", "app", "20170210.json")); err != nil {
+		t.Fatalf("Expected document to exist: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileLockName)); !os.IsNotExist(err) {
+		t.Error("Expected lock file to be released after commit")
+	}
+
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.GitCommit != "bbb" {
+		t.Errorf("Expected newest commit %q, but found %q", "bbb", image.Meta.GitCommit)
+	}
+
+	images, err := store.List("repo/app", ListOptions{})
+	if err != nil {
+		t.Fatalf("List errored with %s", err)
+	}
+	if len(images.Images) != 1 || images.Images[0].Name != "repo/app:20170210" {
+		t.Errorf("Expected to list only %q, but found %d images", "repo/app:20170210", len(images.Images))
+	}
+}
+
+func TestFileStorage_StartTransaction_Locked(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	other, err := NewFileStorage(fileStorageConfig(dir))
+	if err != nil {
+		t.Fatalf("Failed to create file storage: %s", err)
+	}
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := other.StartTransaction(); err == nil {
+		t.Error("Expected second transaction to fail while the lock is held")
+	}
+	if err := store.RollbackTransaction(); err != nil {
+		t.Fatalf("RollbackTransaction errored with %s", err)
+	}
+	if err := other.StartTransaction(); err != nil {
+		t.Errorf("Expected transaction to start after rollback, but errored with %s", err)
+	}
+	other.RollbackTransaction()
+}
+
+func TestFileStorage_StartTransaction_TakesOverStaleLock(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+	// a finished process's pid stands in for a gzr process that crashed holding the lock
+	finished := exec.Command(os.Args[0], "-test.run=^$")
+	if err := finished.Run(); err != nil {
+		t.Fatalf("Failed to run process: %s", err)
+	}
+	hostname, _ := os.Hostname()
+	lock := []byte(fmt.Sprintf("%d %s\n", finished.Process.Pid, hostname))
+	if err := ioutil.WriteFile(filepath.Join(dir, fileLockName), lock, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %s", err)
+	}
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Expected stale lock to be taken over, but errored with %s", err)
+	}
+	store.RollbackTransaction()
+
+	lock = []byte(fmt.Sprintf("%d %s\n", finished.Process.Pid, "other-host"))
+	if err := ioutil.WriteFile(filepath.Join(dir, fileLockName), lock, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %s", err)
+	}
+	if err := store.StartTransaction(); err == nil {
+		t.Error("Expected a lock taken on another host to be kept")
+	}
+}
+
+func TestFileStorage_RejectsPathsOutsideRoot(t *testing.T) {
+	store, _, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	defer store.RollbackTransaction()
+	for _, name := range []string{"../outside/app:1", "repo/../../app:1", "/etc/app:1", "repo/app:.."} {
+		if err := store.Store(name, ImageMetadata{GitCommit: "aaa"}); err == nil {
+			t.Errorf("Expected storing %q to fail", name)
+		}
+		if _, err := store.Get(name); err == nil {
+			t.Errorf("Expected getting %q to fail", name)
+		}
+	}
+	if _, err := store.List("../outside/app", ListOptions{}); err == nil {
+		t.Error("Expected listing outside the root to fail")
+	}
+}
+
+func TestFileStorage_Delete(t *testing.T) {
+	store, _, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, store, "repo/app:20170211", ImageMetadata{GitCommit: "bbb"})
+
+	if err := store.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	deleted, err := store.Delete("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Delete errored with %s", err)
+	}
+	if err := store.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted image, but deleted %d", deleted)
+	}
+
+	images, err := store.List("repo/app", ListOptions{})
+	if err != nil {
+		t.Fatalf("List errored with %s", err)
+	}
+	if len(images.Images) != 1 {
+		t.Errorf("Expected 1 remaining image, but found %d", len(images.Images))
+	}
+}
+
+func TestFileStorage_Store_RoundTripsLabelsAndCI(t *testing.T) {
+	store, _, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	meta := ImageMetadata{
+		SchemaVersion: CurrentSchemaVersion,
+		GitCommit:     "aaa",
+		Labels:        map[string]string{"team": "platform"},
+		CI:            &CIInfo{BuildURL: "https://ci.example.com/job/app/7/", Job: "app", Number: 7},
+		Issues:        []string{"APP-1", "APP-2"},
+	}
+	storeInTransaction(t, store, "repo/app:1", meta)
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{GitCommit: "bbb"})
+
+	image, err := store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if !reflect.DeepEqual(image.Meta, meta) {
+		t.Errorf("Expected %+v, but found %+v", meta, image.Meta)
+	}
+
+	labeled, err := store.List("repo/app", ListOptions{Labels: map[string]string{"team": "platform"}})
+	if err != nil {
+		t.Fatalf("List errored with %s", err)
+	}
+	if len(labeled.Images) != 1 || labeled.Images[0].Name != "repo/app:1" {
+		t.Errorf("Expected label filter to find only %q, but found %d images", "repo/app:1", len(labeled.Images))
+	}
+}
+
+func TestParseLabelSelectors(t *testing.T) {
+	labels, err := ParseLabelSelectors([]string{"team=platform", "env=a=b"})
+	if err != nil {
+		t.Fatalf("ParseLabelSelectors errored with %s", err)
+	}
+	if labels["team"] != "platform" || labels["env"] != "a=b" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if _, err := ParseLabelSelectors([]string{"team"}); err == nil {
+		t.Error("Expected a selector without = to be rejected")
+	}
+}
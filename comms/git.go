@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,7 +34,7 @@ const (
 
 // NewImageMetadata returns a populated ImageMetadata based on a LocalGitManager
 func NewImageMetadata() (ImageMetadata, error) {
-	meta := ImageMetadata{}
+	meta := ImageMetadata{SchemaVersion: CurrentSchemaVersion}
 	path, err := os.Getwd()
 	if err != nil {
 		return meta, errors.Wrap(err, failedToGetwdMsg)
@@ -59,10 +60,26 @@ func NewImageMetadata() (ImageMetadata, error) {
 	meta.GitCommit = hash
 
 	meta.CreatedAt = time.Now().Format(time.RFC3339)
+	meta.CI = ciInfoFromEnv()
 
 	return meta, nil
 }
 
+// ciInfoFromEnv returns the CIInfo described by the environment variables Jenkins
+// sets for a build, or nil when not running in one
+func ciInfoFromEnv() *CIInfo {
+	buildURL := os.Getenv("BUILD_URL")
+	if buildURL == "" {
+		return nil
+	}
+	number, _ := strconv.Atoi(os.Getenv("BUILD_NUMBER"))
+	return &CIInfo{
+		BuildURL: buildURL,
+		Job:      os.Getenv("JOB_NAME"),
+		Number:   number,
+	}
+}
+
 // NewLocalGitManager returns a pointer to an initialized LocalGitManager and takes a `path`
 func NewLocalGitManager(path ...string) *LocalGitManager {
 	var thePath string
@@ -97,6 +114,42 @@ func (gm *LocalGitManager) CommitHash() (string, error) {
 	return stripped, nil
 }
 
+// FullCommitHash returns the full commit hash of a git repo at either the set path or
+// current working directory
+func (gm *LocalGitManager) FullCommitHash() (string, error) {
+	hash, err := gm.output("rev-parse", "HEAD")
+	return hash, errors.Wrap(err, "Failed to retrive full git commit hash from git")
+}
+
+// Branch returns the current branch of a git repo at either the set path or current
+// working directory. CI servers usually check out a detached HEAD, so the branch is
+// then read from the BRANCH_NAME or GIT_BRANCH variables Jenkins sets instead
+func (gm *LocalGitManager) Branch() (string, error) {
+	branch, err := gm.output("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrive git branch from git")
+	}
+	if branch != "HEAD" {
+		return branch, nil
+	}
+	if branch = os.Getenv("BRANCH_NAME"); branch != "" {
+		return branch, nil
+	}
+	return strings.TrimPrefix(os.Getenv("GIT_BRANCH"), "origin/"), nil
+}
+
+// output runs git with args in the set path or current working directory and returns
+// its trimmed output
+func (gm *LocalGitManager) output(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = gm.path
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // Remote returns the remote of a git repo at either the set path or current
 // working directory
 func (gm *LocalGitManager) Remote() (string, error) {
@@ -7,12 +7,16 @@ import (
 	"io"
 	"os"
 	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -20,10 +24,50 @@ var (
 	ErrContainerNotFound        = e.New("Requested container couldn't be found")
 	ErrDeploymentNotFound       = e.New("Requested deployment couldn't be found")
 	ErrNoDeploymentsInNamespace = e.New("No deployments found in specified namespace")
+	ErrImageNotInRegistry       = e.New("Requested image couldn't be found in the registry")
 )
 
-// GzrDeployment is just here to let us declare methods on k8s Deployments
-type GzrDeployment v1beta1.Deployment
+// GzrDeployment is a k8s Deployment read from whichever group version the cluster serves
+// Deployments from. It serializes to the same metadata, spec and status JSON as a Deployment
+type GzrDeployment struct {
+	ObjectMeta metav1.ObjectMeta   `json:"metadata"`
+	Spec       GzrDeploymentSpec   `json:"spec"`
+	Status     GzrDeploymentStatus `json:"status"`
+}
+
+// GzrDeploymentSpec is the part of a Deployment's spec gzr reads
+type GzrDeploymentSpec struct {
+	Replicas                *int32                    `json:"replicas,omitempty"`
+	Selector                *metav1.LabelSelector     `json:"selector,omitempty"`
+	Template                corev1.PodTemplateSpec    `json:"template"`
+	Strategy                appsv1.DeploymentStrategy `json:"strategy,omitempty"`
+	MinReadySeconds         int32                     `json:"minReadySeconds,omitempty"`
+	RevisionHistoryLimit    *int32                    `json:"revisionHistoryLimit,omitempty"`
+	Paused                  bool                      `json:"paused,omitempty"`
+	ProgressDeadlineSeconds *int32                    `json:"progressDeadlineSeconds,omitempty"`
+}
+
+// GzrDeploymentStatus is a Deployment's most recently observed status
+type GzrDeploymentStatus struct {
+	ObservedGeneration  int64                    `json:"observedGeneration,omitempty"`
+	Replicas            int32                    `json:"replicas,omitempty"`
+	UpdatedReplicas     int32                    `json:"updatedReplicas,omitempty"`
+	ReadyReplicas       int32                    `json:"readyReplicas,omitempty"`
+	AvailableReplicas   int32                    `json:"availableReplicas,omitempty"`
+	UnavailableReplicas int32                    `json:"unavailableReplicas,omitempty"`
+	Conditions          []GzrDeploymentCondition `json:"conditions,omitempty"`
+	CollisionCount      *int32                   `json:"collisionCount,omitempty"`
+}
+
+// GzrDeploymentCondition is the state of a Deployment at a certain point, such as whether it's progressing
+type GzrDeploymentCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastUpdateTime     metav1.Time            `json:"lastUpdateTime,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
 
 // GzrDeploymentList is a collection of GzrDeployments
 type GzrDeploymentList struct {
@@ -58,6 +102,18 @@ type K8sCommunicator interface {
 	GetDeployment(string) (*GzrDeployment, error)
 	// UpdateDeployment updates the Deployment's container in the manner specified by the argument
 	UpdateDeployment(*DeploymentContainerInfo) (*GzrDeployment, error)
+	// ListRevisions returns the revision history of the named Deployment
+	ListRevisions(string) (*DeploymentRevisionList, error)
+	// RollbackDeployment restores the named Deployment's Pod template to a revision returned by ListRevisions
+	RollbackDeployment(string, *DeploymentRevision) (*GzrDeployment, error)
+	// WaitForRollout waits up to the timeout for the named Deployment's rollout to finish, reporting progress
+	WaitForRollout(string, time.Duration, RolloutProgressFunc) (*GzrDeployment, error)
+	// ListWorkloads returns the workloads of the given kind, or of every kind if it's empty
+	ListWorkloads(WorkloadKind) (*WorkloadList, error)
+	// GetWorkload returns the workload matching the given kind and name
+	GetWorkload(WorkloadKind, string) (*Workload, error)
+	// UpdateWorkload updates the workload's container in the manner specified by the argument
+	UpdateWorkload(*WorkloadContainerInfo) (*Workload, error)
 	// GetNamespace returns the namespace
 	GetNamespace() string
 }
@@ -65,9 +121,14 @@ type K8sCommunicator interface {
 // K8sConnection implements the K8sCommunicator interface and holds a live connection to a k8s cluster
 type K8sConnection struct {
 	// clientset is a collection of Kubernetes API clients
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 	// namespace is the k8s namespace active for this connection used to talk
 	namespace string
+	// served is the set of API group versions the cluster serves, used to fall back to older
+	// group versions on older clusters
+	served map[string]bool
+	// registry is where images are looked up before a Deployment is updated to them
+	registry ImageRegistry
 }
 
 // NewK8sConnection returns a K8sConnection with an active v1.Clientset.
@@ -87,9 +148,16 @@ func NewK8sConnection(namespace string) (*K8sConnection, error) {
 		return k, err
 	}
 
+	served, err := servedGroupVersions(clientset.Discovery())
+	if err != nil {
+		return k, err
+	}
+
 	k = &K8sConnection{
 		clientset: clientset,
 		namespace: namespace,
+		served:    served,
+		registry:  NewRegistryClient(),
 	}
 
 	return k, nil
@@ -97,15 +165,14 @@ func NewK8sConnection(namespace string) (*K8sConnection, error) {
 
 // GetDeployment returns a GzrDeployment matching the deploymentName in the given namespace
 func (k *K8sConnection) GetDeployment(deploymentName string) (*GzrDeployment, error) {
-	var gd *GzrDeployment
-	deployment, err := k.clientset.ExtensionsV1beta1().Deployments(k.GetNamespace()).Get(deploymentName, v1.GetOptions{})
+	workload, err := k.getObject(KindDeployment, deploymentName)
+	if apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(ErrDeploymentNotFound, "%q", deploymentName)
+	}
 	if err != nil {
-		return gd, errors.Wrapf(err, "Failed to get deployment %q in namespace %q", deployment, k.GetNamespace())
+		return nil, errors.Wrapf(err, "Failed to get deployment %q in namespace %q", deploymentName, k.GetNamespace())
 	}
-	gdp := GzrDeployment(*deployment)
-	gd = &gdp
-
-	return gd, err
+	return newGzrDeployment(workload)
 }
 
 // GetNamespace returns the namespace for the connection
@@ -114,62 +181,59 @@ func (k *K8sConnection) GetNamespace() string {
 }
 
 // UpdateDeployment updates a Deployment on the server to the structure represented by the argument
-// TODO: verify that requested image exists in the store
-// TODO: verify that requested image exists in the registry
+// after checking that the requested image exists in the registry. Use a Deployer to also
+// check that it exists in the metadata store
 func (k *K8sConnection) UpdateDeployment(dci *DeploymentContainerInfo) (*GzrDeployment, error) {
-	var gd *GzrDeployment
-	var containerIndex int
-	found := false
-
-	deployment, err := k.clientset.ExtensionsV1beta1().Deployments(k.namespace).Get(dci.DeploymentName, v1.GetOptions{})
-	// no Name in ObjectMeta means it was returned empty
-	if deployment.ObjectMeta.Name == "" {
-		return gd, errors.WithStack(ErrDeploymentNotFound)
-	}
-
-	for index, container := range deployment.Spec.Template.Spec.Containers {
-		if container.Name == dci.ContainerName {
-			containerIndex = index
-			found = true
-		}
+	workload, err := k.updateContainerImage(&WorkloadContainerInfo{
+		Kind:          KindDeployment,
+		Name:          dci.DeploymentName,
+		ContainerName: dci.ContainerName,
+		Image:         dci.Image,
+	})
+	if errors.Cause(err) == ErrWorkloadNotFound {
+		return nil, errors.Wrapf(ErrDeploymentNotFound, "%q", dci.DeploymentName)
 	}
-
-	if !found {
-		return gd, errors.WithStack(ErrContainerNotFound)
-	}
-
-	deployment.Spec.Template.Spec.Containers[containerIndex].Image = dci.Image
-	deployment, err = k.clientset.ExtensionsV1beta1().Deployments(dci.Namespace).Update(deployment)
-
 	if err != nil {
-		return gd, errors.Wrap(err, "Failed to update deployment")
+		return nil, err
 	}
-
-	gdp := GzrDeployment(*deployment)
-	gd = &gdp
-
-	return gd, nil
+	return newGzrDeployment(workload)
 }
 
 // ListDeployments returns the active k8s Deployments for the given namespace
 func (k *K8sConnection) ListDeployments() (*GzrDeploymentList, error) {
 	var gzrDeploymentList GzrDeploymentList
-	deploymentList, err := k.clientset.ExtensionsV1beta1().Deployments(k.GetNamespace()).List(v1.ListOptions{})
+	workloads, err := k.listObjects(KindDeployment)
 	if err != nil {
 		return &gzrDeploymentList, errors.Wrapf(err, "Failed to get list of deployments in namespace %q", k.GetNamespace())
 	}
 
-	if len(deploymentList.Items) == 0 {
+	if len(workloads) == 0 {
 		return nil, errors.WithStack(ErrNoDeploymentsInNamespace)
 	}
 
-	for _, deployment := range deploymentList.Items {
-		gzrDeploymentList.Deployments = append(gzrDeploymentList.Deployments, GzrDeployment(deployment))
+	for _, workload := range workloads {
+		gd, err := newGzrDeployment(workload)
+		if err != nil {
+			return nil, err
+		}
+		gzrDeploymentList.Deployments = append(gzrDeploymentList.Deployments, *gd)
 	}
 
 	return &gzrDeploymentList, nil
 }
 
+// newGzrDeployment returns the GzrDeployment for an apps/v1 or extensions/v1beta1 Deployment.
+// Both versions serialize to the JSON a GzrDeployment reads, so it's converted through that
+func newGzrDeployment(workload runtime.Object) (*GzrDeployment, error) {
+	data, err := json.Marshal(workload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to convert deployment to json")
+	}
+	gd := &GzrDeployment{}
+	err = json.Unmarshal(data, gd)
+	return gd, errors.Wrap(err, "Failed to read deployment from json")
+}
+
 // SerializeForCLI takes an io.Writer and writes templatized data to it representing a Deployment
 func (d GzrDeployment) SerializeForCLI(wr io.Writer) error {
 	return errors.Wrap(d.cliTemplate().Execute(wr, d), "Failed to serialize deployment ")
@@ -195,6 +259,17 @@ func (d GzrDeployment) SerializeForWire() ([]byte, error) {
 	return data, errors.Wrap(err, "Failed to convert deployment to json")
 }
 
+// Images returns the image of every container in every Deployment in the list
+func (dl *GzrDeploymentList) Images() []string {
+	var images []string
+	for _, deployment := range dl.Deployments {
+		for _, container := range deployment.Spec.Template.Spec.Containers {
+			images = append(images, container.Image)
+		}
+	}
+	return images
+}
+
 // SerializeForWire returns a JSON representation of the DeploymentList
 func (dl *GzrDeploymentList) SerializeForWire() ([]byte, error) {
 	data, err := json.Marshal(dl)
@@ -0,0 +1,335 @@
+package comms
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	batchv2alpha1 "k8s.io/api/batch/v2alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+)
+
+// Group versions gzr prefers when the cluster serves them. Older clusters get Deployments and
+// DaemonSets from extensions/v1beta1, StatefulSets from apps/v1beta1 and CronJobs from batch/v1beta1
+// or batch/v2alpha1
+const (
+	appsV1GroupVersion       = "apps/v1"
+	batchV1GroupVersion      = "batch/v1"
+	batchV1beta1GroupVersion = "batch/v1beta1"
+	// batchV1CronJobs is served when batch/v1 has CronJobs, which it has had since Kubernetes 1.21
+	batchV1CronJobs = "batch/v1/cronjobs"
+)
+
+// servedGroupVersions asks the cluster which API group versions it serves, such as "apps/v1".
+// batch/v1 served Jobs long before CronJobs, so batchV1CronJobs is added if it has CronJobs
+func servedGroupVersions(client discovery.DiscoveryInterface) (map[string]bool, error) {
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to discover the API groups the cluster serves")
+	}
+	served := map[string]bool{}
+	for _, group := range groups.Groups {
+		for _, version := range group.Versions {
+			served[version.GroupVersion] = true
+		}
+	}
+	if served[batchV1GroupVersion] {
+		resources, err := client.ServerResourcesForGroupVersion(batchV1GroupVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to discover the resources %s serves", batchV1GroupVersion)
+		}
+		for _, resource := range resources.APIResources {
+			if resource.Name == "cronjobs" {
+				served[batchV1CronJobs] = true
+			}
+		}
+	}
+	return served, nil
+}
+
+// batchV1CronJob is a CronJob from batch/v1, which replaced batch/v1beta1 in Kubernetes 1.25.
+// The client-go gzr builds with has no batch/v1 CronJob client, so it's read as JSON through the
+// batch/v1 REST client into the batch/v1beta1 type. That type lacks fields batch/v1 added since,
+// such as spec.timeZone, so a batchV1CronJob is only read and is changed with patches
+type batchV1CronJob struct {
+	batchv1beta1.CronJob
+}
+
+// batchV1CronJobList is a list of CronJobs from batch/v1
+type batchV1CronJobList struct {
+	Items []batchV1CronJob `json:"items"`
+}
+
+// getBatchV1CronJob returns the named batch/v1 CronJob. Errors from the server are returned
+// as they are, so they can be checked with apierrors
+func (k *K8sConnection) getBatchV1CronJob(name string) (runtime.Object, error) {
+	data, err := k.clientset.BatchV1().RESTClient().Get().
+		Namespace(k.GetNamespace()).Resource("cronjobs").Name(name).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	cronJob := &batchV1CronJob{}
+	err = json.Unmarshal(data, cronJob)
+	return cronJob, errors.Wrapf(err, "Failed to read %s CronJob %q", batchV1GroupVersion, name)
+}
+
+// listBatchV1CronJobs returns every batch/v1 CronJob in the namespace
+func (k *K8sConnection) listBatchV1CronJobs() ([]runtime.Object, error) {
+	data, err := k.clientset.BatchV1().RESTClient().Get().
+		Namespace(k.GetNamespace()).Resource("cronjobs").DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &batchV1CronJobList{}
+	err = json.Unmarshal(data, list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read %s CronJobs", batchV1GroupVersion)
+	}
+	var objects []runtime.Object
+	for i := range list.Items {
+		objects = append(objects, &list.Items[i])
+	}
+	return objects, nil
+}
+
+// patchBatchV1CronJob applies patch, of type pt, to the named batch/v1 CronJob and returns the
+// CronJob the server stored
+func (k *K8sConnection) patchBatchV1CronJob(namespace, name string, pt types.PatchType, patch []byte) (runtime.Object, error) {
+	data, err := k.clientset.BatchV1().RESTClient().Patch(pt).
+		Namespace(namespace).Resource("cronjobs").Name(name).Body(patch).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	patched := &batchV1CronJob{}
+	err = json.Unmarshal(data, patched)
+	return patched, errors.Wrapf(err, "Failed to read %s CronJob %q", batchV1GroupVersion, name)
+}
+
+// getObject returns the workload of the given kind and name from the newest group version serving it
+func (k *K8sConnection) getObject(kind WorkloadKind, name string) (runtime.Object, error) {
+	namespace := k.GetNamespace()
+	opts := metav1.GetOptions{}
+	appsV1 := k.served[appsV1GroupVersion]
+	switch {
+	case kind == KindDeployment && appsV1:
+		return k.clientset.AppsV1().Deployments(namespace).Get(name, opts)
+	case kind == KindDeployment:
+		return k.clientset.ExtensionsV1beta1().Deployments(namespace).Get(name, opts)
+	case kind == KindStatefulSet && appsV1:
+		return k.clientset.AppsV1().StatefulSets(namespace).Get(name, opts)
+	case kind == KindStatefulSet:
+		return k.clientset.AppsV1beta1().StatefulSets(namespace).Get(name, opts)
+	case kind == KindDaemonSet && appsV1:
+		return k.clientset.AppsV1().DaemonSets(namespace).Get(name, opts)
+	case kind == KindDaemonSet:
+		return k.clientset.ExtensionsV1beta1().DaemonSets(namespace).Get(name, opts)
+	case kind == KindCronJob && k.served[batchV1CronJobs]:
+		return k.getBatchV1CronJob(name)
+	case kind == KindCronJob && k.served[batchV1beta1GroupVersion]:
+		return k.clientset.BatchV1beta1().CronJobs(namespace).Get(name, opts)
+	case kind == KindCronJob:
+		return k.clientset.BatchV2alpha1().CronJobs(namespace).Get(name, opts)
+	}
+	return nil, errors.Wrapf(ErrUnsupportedWorkload, "%q", kind)
+}
+
+// listObjects returns every workload of the given kind from the newest group version serving it
+func (k *K8sConnection) listObjects(kind WorkloadKind) ([]runtime.Object, error) {
+	namespace := k.GetNamespace()
+	opts := metav1.ListOptions{}
+	appsV1 := k.served[appsV1GroupVersion]
+	var objects []runtime.Object
+	switch {
+	case kind == KindDeployment && appsV1:
+		list, err := k.clientset.AppsV1().Deployments(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindDeployment:
+		list, err := k.clientset.ExtensionsV1beta1().Deployments(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindStatefulSet && appsV1:
+		list, err := k.clientset.AppsV1().StatefulSets(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindStatefulSet:
+		list, err := k.clientset.AppsV1beta1().StatefulSets(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindDaemonSet && appsV1:
+		list, err := k.clientset.AppsV1().DaemonSets(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindDaemonSet:
+		list, err := k.clientset.ExtensionsV1beta1().DaemonSets(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindCronJob && k.served[batchV1CronJobs]:
+		return k.listBatchV1CronJobs()
+	case kind == KindCronJob && k.served[batchV1beta1GroupVersion]:
+		list, err := k.clientset.BatchV1beta1().CronJobs(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	case kind == KindCronJob:
+		list, err := k.clientset.BatchV2alpha1().CronJobs(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedWorkload, "%q", kind)
+	}
+	return objects, nil
+}
+
+// patchObject applies patch, of type pt, to a workload returned by getObject in the group version it
+// was read from, and returns the workload the server stored. Only the fields the patch names change,
+// so fields the client-go gzr builds with doesn't know of, like those of a newer PodSpec, are kept
+func (k *K8sConnection) patchObject(object runtime.Object, pt types.PatchType, patch []byte) (runtime.Object, error) {
+	switch o := object.(type) {
+	case *appsv1.Deployment:
+		return k.clientset.AppsV1().Deployments(o.Namespace).Patch(o.Name, pt, patch)
+	case *v1beta1.Deployment:
+		return k.clientset.ExtensionsV1beta1().Deployments(o.Namespace).Patch(o.Name, pt, patch)
+	case *appsv1.StatefulSet:
+		return k.clientset.AppsV1().StatefulSets(o.Namespace).Patch(o.Name, pt, patch)
+	case *appsv1beta1.StatefulSet:
+		return k.clientset.AppsV1beta1().StatefulSets(o.Namespace).Patch(o.Name, pt, patch)
+	case *appsv1.DaemonSet:
+		return k.clientset.AppsV1().DaemonSets(o.Namespace).Patch(o.Name, pt, patch)
+	case *v1beta1.DaemonSet:
+		return k.clientset.ExtensionsV1beta1().DaemonSets(o.Namespace).Patch(o.Name, pt, patch)
+	case *batchV1CronJob:
+		return k.patchBatchV1CronJob(o.Namespace, o.Name, pt, patch)
+	case *batchv1beta1.CronJob:
+		return k.clientset.BatchV1beta1().CronJobs(o.Namespace).Patch(o.Name, pt, patch)
+	case *batchv2alpha1.CronJob:
+		return k.clientset.BatchV2alpha1().CronJobs(o.Namespace).Patch(o.Name, pt, patch)
+	}
+	return nil, errors.Errorf("Failed to patch unsupported object %T", object)
+}
+
+// updateContainerImage sets the image of the container named by wci in the workload's Pod
+// template, once the registry confirms the image exists, and returns the updated workload.
+// The image is set with a strategic merge patch, which merges containers by name
+func (k *K8sConnection) updateContainerImage(wci *WorkloadContainerInfo) (runtime.Object, error) {
+	object, err := k.getObject(wci.Kind, wci.Name)
+	if apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(ErrWorkloadNotFound, "%s %q", wci.Kind, wci.Name)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get %s %q in namespace %q", wci.Kind, wci.Name, k.GetNamespace())
+	}
+	err = k.setContainerImage(podSpec(object), wci)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(podTemplatePatch(object, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []map[string]string{{"name": wci.ContainerName, "image": wci.Image}},
+		},
+	}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create patch for %s %q", wci.Kind, wci.Name)
+	}
+	object, err = k.patchObject(object, types.StrategicMergePatchType, patch)
+	return object, errors.Wrapf(err, "Failed to update %s %q", wci.Kind, wci.Name)
+}
+
+// podTemplatePatch returns a patch setting template as the workload's Pod template, which CronJobs
+// keep in their job template
+func podTemplatePatch(object runtime.Object, template interface{}) map[string]interface{} {
+	switch object.(type) {
+	case *batchV1CronJob, *batchv1beta1.CronJob, *batchv2alpha1.CronJob:
+		template = map[string]interface{}{"jobTemplate": map[string]interface{}{
+			"spec": map[string]interface{}{"template": template},
+		}}
+	default:
+		template = map[string]interface{}{"template": template}
+	}
+	return map[string]interface{}{"spec": template}
+}
+
+// setContainerImage sets the image of the container named by wci in spec, once the
+// registry confirms the image exists
+func (k *K8sConnection) setContainerImage(spec *corev1.PodSpec, wci *WorkloadContainerInfo) error {
+	for index, container := range spec.Containers {
+		if container.Name != wci.ContainerName {
+			continue
+		}
+		exists, err := k.registry.ImageExists(wci.Image)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to look up image %q in the registry", wci.Image)
+		}
+		if !exists {
+			return errors.Wrapf(ErrImageNotInRegistry, "%q", wci.Image)
+		}
+		spec.Containers[index].Image = wci.Image
+		return nil
+	}
+	return errors.Wrapf(ErrContainerNotFound, "%q", wci.ContainerName)
+}
+
+// podSpec returns the spec of the Pods the workload runs, which every kind keeps in a different place
+func podSpec(object runtime.Object) *corev1.PodSpec {
+	switch o := object.(type) {
+	case *appsv1.Deployment:
+		return &o.Spec.Template.Spec
+	case *v1beta1.Deployment:
+		return &o.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &o.Spec.Template.Spec
+	case *appsv1beta1.StatefulSet:
+		return &o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template.Spec
+	case *v1beta1.DaemonSet:
+		return &o.Spec.Template.Spec
+	case *batchV1CronJob:
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	case *batchv1beta1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	case *batchv2alpha1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return &corev1.PodSpec{}
+}
@@ -0,0 +1,176 @@
+package comms
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// newTestK8sConnection returns a K8sConnection to a fake cluster in namespace "default" serving
+// groupVersions and holding objects, whose registry has every image
+func newTestK8sConnection(t *testing.T, groupVersions []string, objects ...runtime.Object) *K8sConnection {
+	clientset := fake.NewSimpleClientset(objects...)
+	discovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	for _, groupVersion := range groupVersions {
+		discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{GroupVersion: groupVersion})
+	}
+	served, err := servedGroupVersions(discovery)
+	if err != nil {
+		t.Fatalf("Failed to discover fake group versions: %s", err)
+	}
+	return &K8sConnection{
+		clientset: clientset,
+		namespace: "default",
+		served:    served,
+		registry:  &MockRegistry{OnImageExists: func(string) (bool, error) { return true, nil }},
+	}
+}
+
+func testPodTemplate() corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "repo/app:1"}}}}
+}
+
+func TestK8sConnection_AppsV1Deployments(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Template: testPodTemplate()},
+	}
+	k := newTestK8sConnection(t, []string{"apps/v1", "extensions/v1beta1"}, deployment)
+
+	list, err := k.ListDeployments()
+	if err != nil {
+		t.Fatalf("Expected apps/v1 deployments to list, but got %s", err)
+	}
+	if len(list.Deployments) != 1 || list.Deployments[0].ObjectMeta.Name != "web" {
+		t.Errorf("Expected the web deployment, but got %+v", list.Deployments)
+	}
+
+	updated, err := k.UpdateDeployment(&DeploymentContainerInfo{DeploymentName: "web", ContainerName: "app", Image: "repo/app:2"})
+	if err != nil {
+		t.Fatalf("Expected the deployment to update, but got %s", err)
+	}
+	if updated.Spec.Template.Spec.Containers[0].Image != "repo/app:2" {
+		t.Errorf("Expected the updated deployment to run repo/app:2, but got %v", updated.Spec.Template.Spec.Containers)
+	}
+	stored, err := k.clientset.AppsV1().Deployments("default").Get("web", metav1.GetOptions{})
+	if err != nil || stored.Spec.Template.Spec.Containers[0].Image != "repo/app:2" {
+		t.Errorf("Expected the apps/v1 deployment to be updated, but got %v and %v", stored, err)
+	}
+}
+
+func TestK8sConnection_UpdateDeployment_KeepsUnknownFields(t *testing.T) {
+	// hostUsers is newer than the apps/v1 PodSpec gzr reads Deployments into
+	stored := []byte(`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"},
+		"spec":{"template":{"spec":{"hostUsers":false,"containers":[{"name":"app","image":"repo/app:1"}]}}}}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/apis/apps/v1/namespaces/default/deployments/web":
+			w.Write(stored)
+		case r.Method == "PATCH" && r.URL.Path == "/apis/apps/v1/namespaces/default/deployments/web":
+			patch, _ := ioutil.ReadAll(r.Body)
+			stored, _ = strategicpatch.StrategicMergePatch(stored, patch, appsv1.Deployment{})
+			w.Write(stored)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create clientset: %s", err)
+	}
+	k := &K8sConnection{
+		clientset: clientset,
+		namespace: "default",
+		served:    map[string]bool{appsV1GroupVersion: true},
+		registry:  &MockRegistry{OnImageExists: func(string) (bool, error) { return true, nil }},
+	}
+
+	_, err = k.UpdateDeployment(&DeploymentContainerInfo{DeploymentName: "web", ContainerName: "app", Image: "repo/app:2"})
+	if err != nil {
+		t.Fatalf("Expected the deployment to update, but got %s", err)
+	}
+	if !strings.Contains(string(stored), "repo/app:2") || !strings.Contains(string(stored), `"hostUsers":false`) {
+		t.Errorf("Expected repo/app:2 to be stored with the Pod template's hostUsers, but got %s", stored)
+	}
+}
+
+func TestK8sConnection_ExtensionsV1beta1Fallback(t *testing.T) {
+	deployment := &v1beta1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       v1beta1.DeploymentSpec{Template: testPodTemplate()},
+	}
+	k := newTestK8sConnection(t, []string{"extensions/v1beta1"}, deployment)
+
+	gd, err := k.GetDeployment("web")
+	if err != nil {
+		t.Fatalf("Expected the extensions/v1beta1 deployment, but got %s", err)
+	}
+	if gd.ObjectMeta.Name != "web" || gd.Spec.Template.Spec.Containers[0].Image != "repo/app:1" {
+		t.Errorf("Expected the web deployment running repo/app:1, but got %+v", gd)
+	}
+
+	_, err = k.GetDeployment("api")
+	if errors.Cause(err) != ErrDeploymentNotFound {
+		t.Errorf("Expected ErrDeploymentNotFound, but got %v", err)
+	}
+}
+
+func TestNewGzrDeployment_KeepsStrategyAndCollisionCount(t *testing.T) {
+	maxSurge := intstr.FromString("25%")
+	collisions := int32(2)
+	deployments := []runtime.Object{
+		&appsv1.Deployment{
+			Spec: appsv1.DeploymentSpec{
+				Template:        testPodTemplate(),
+				MinReadySeconds: 10,
+				Strategy:        appsv1.DeploymentStrategy{Type: appsv1.RollingUpdateDeploymentStrategyType, RollingUpdate: &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge}},
+			},
+			Status: appsv1.DeploymentStatus{CollisionCount: &collisions},
+		},
+		&v1beta1.Deployment{
+			Spec: v1beta1.DeploymentSpec{
+				Template:        testPodTemplate(),
+				MinReadySeconds: 10,
+				Strategy:        v1beta1.DeploymentStrategy{Type: v1beta1.RollingUpdateDeploymentStrategyType, RollingUpdate: &v1beta1.RollingUpdateDeployment{MaxSurge: &maxSurge}},
+			},
+			Status: v1beta1.DeploymentStatus{CollisionCount: &collisions},
+		},
+	}
+	for _, deployment := range deployments {
+		gd, err := newGzrDeployment(deployment)
+		if err != nil {
+			t.Fatalf("Failed to convert %T: %s", deployment, err)
+		}
+		strategy := gd.Spec.Strategy
+		if strategy.Type != appsv1.RollingUpdateDeploymentStrategyType || strategy.RollingUpdate == nil || strategy.RollingUpdate.MaxSurge.String() != "25%" {
+			t.Errorf("Expected the rolling update strategy of %T, but got %+v", deployment, strategy)
+		}
+		if gd.Spec.MinReadySeconds != 10 {
+			t.Errorf("Expected minReadySeconds of %T to be 10, but got %d", deployment, gd.Spec.MinReadySeconds)
+		}
+		if gd.Status.CollisionCount == nil || *gd.Status.CollisionCount != 2 {
+			t.Errorf("Expected collisionCount of %T to be 2, but got %v", deployment, gd.Status.CollisionCount)
+		}
+		if gd.Spec.Template.Spec.Containers[0].Image != "repo/app:1" {
+			t.Errorf("Expected the Pod template of %T, but got %+v", deployment, gd.Spec.Template)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package comms
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Standard OCI image annotations, set as labels on the images gzr builds and read back
+// from images gzr didn't build
+const (
+	OCICreatedLabel  = "org.opencontainers.image.created"
+	OCISourceLabel   = "org.opencontainers.image.source"
+	OCIRevisionLabel = "org.opencontainers.image.revision"
+	// OCIVersionLabel holds the git tags of the commit, separated by spaces, which
+	// git doesn't allow in tag names
+	OCIVersionLabel = "org.opencontainers.image.version"
+)
+
+// MetadataLabels returns the OCI labels describing meta, leaving out empty fields
+func MetadataLabels(meta ImageMetadata) map[string]string {
+	labels := make(map[string]string)
+	add := func(label string, value string) {
+		if value != "" {
+			labels[label] = value
+		}
+	}
+	add(OCIRevisionLabel, meta.GitCommit)
+	add(OCISourceLabel, meta.GitOrigin)
+	add(OCICreatedLabel, meta.CreatedAt)
+	add(OCIVersionLabel, strings.Join(meta.GitTag, " "))
+	return labels
+}
+
+// labelArgs returns the --label flags setting every label, in a stable order
+func labelArgs(labels map[string]string) []string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, key := range keys {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", key, labels[key]))
+	}
+	return args
+}
+
+// MetadataFromLabels infers ImageMetadata from an image's OCI labels, falling back to
+// created when there is no created label. It returns the names of the metadata fields
+// that couldn't be inferred
+func MetadataFromLabels(labels map[string]string, created string) (ImageMetadata, []string) {
+	meta := ImageMetadata{
+		SchemaVersion: CurrentSchemaVersion,
+		GitCommit:     labels[OCIRevisionLabel],
+		GitOrigin:     labels[OCISourceLabel],
+		GitTag:        strings.Fields(labels[OCIVersionLabel]),
+	}
+	if value := labels[OCICreatedLabel]; value != "" {
+		created = value
+	}
+	if createdAt, err := parseCreatedAt(created); err == nil {
+		meta.CreatedAt = createdAt.Format(time.RFC3339Nano)
+	}
+
+	var missing []string
+	if meta.GitCommit == "" {
+		missing = append(missing, "git-commit")
+	}
+	if meta.GitOrigin == "" {
+		missing = append(missing, "git-origin")
+	}
+	if meta.CreatedAt == "" {
+		missing = append(missing, "created-at")
+	}
+	return meta, missing
+}
@@ -0,0 +1,162 @@
+package comms
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	e "errors"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMigrationUnverified = e.New("Destination store doesn't match the source after migrating")
+)
+
+// MigrationResult describes what happened to a single image during a migration
+type MigrationResult struct {
+	// Name is the image's full name
+	Name string
+	// Builds is the number of builds in the image's history
+	Builds int
+	// Skipped is true when the image already existed in the destination and wasn't copied
+	Skipped bool
+	// Checksum is the checksum of the image's build history in the source
+	Checksum string
+}
+
+// MigrationReport is the outcome of MigrateImages
+type MigrationReport struct {
+	// Results has an entry per image in the source, in the order they were migrated
+	Results []*MigrationResult
+	// SourceCount is the number of images found in the source
+	SourceCount int
+	// DestinationCount is the number of images found in the destination after migrating
+	DestinationCount int
+	// Mismatches are the names of images whose history in the destination doesn't match the source
+	Mismatches []string
+}
+
+// Copied returns the number of images copied to the destination
+func (report *MigrationReport) Copied() int {
+	copied := 0
+	for _, result := range report.Results {
+		if !result.Skipped {
+			copied += 1
+		}
+	}
+	return copied
+}
+
+// MigrateImages copies every image and its build history from source to destination,
+// one transaction per image, then verifies the destination against the source.
+// Images that already exist in the destination are skipped. ErrMigrationUnverified is
+// returned with the report if the destination has fewer images than the source or any
+// history doesn't match. With dryRun set nothing is written or verified, but the report
+// still describes what would be copied
+func MigrateImages(source GzrMetadataStore, destination GzrMetadataStore, dryRun bool) (*MigrationReport, error) {
+	images, err := source.ListAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list images in source store")
+	}
+	report := &MigrationReport{SourceCount: len(images.Images)}
+
+	for _, image := range images.Images {
+		builds, err := storedBuilds(source, image)
+		if err != nil {
+			return report, err
+		}
+		result := &MigrationResult{Name: image.Name, Builds: len(builds), Checksum: checksumBuilds(builds)}
+		report.Results = append(report.Results, result)
+
+		existing, err := destination.Get(image.Name)
+		if err != nil {
+			return report, errors.Wrapf(err, "Failed to check destination for %q", image.Name)
+		}
+		if existing != nil {
+			result.Skipped = true
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		err = importBuilds(destination, image.Name, builds, false)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	copied, err := destination.ListAll()
+	if err != nil {
+		return report, errors.Wrap(err, "Failed to list images in destination store")
+	}
+	report.DestinationCount = len(copied.Images)
+	for _, result := range report.Results {
+		builds, err := storedBuilds(destination, &Image{Name: result.Name})
+		if err != nil {
+			return report, err
+		}
+		if checksumBuilds(builds) != result.Checksum {
+			report.Mismatches = append(report.Mismatches, result.Name)
+		}
+	}
+	if report.DestinationCount < report.SourceCount || len(report.Mismatches) > 0 {
+		return report, errors.Wrapf(ErrMigrationUnverified, "%d of %d images found, %d mismatched",
+			report.DestinationCount, report.SourceCount, len(report.Mismatches))
+	}
+	return report, nil
+}
+
+// importBuilds imports every build under name, with its build number and store time, in its
+// own transaction on the destination. With replace set the existing image is deleted in the
+// same transaction, so it's kept if the import fails
+func importBuilds(destination GzrMetadataStore, name string, builds []*ImageBuild, replace bool) error {
+	err := destination.StartTransaction()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to start transaction for %q", name)
+	}
+	if replace {
+		_, err = destination.Delete(name)
+		if err != nil {
+			destination.RollbackTransaction()
+			return errors.Wrapf(err, "Failed to delete %q before overwriting", name)
+		}
+	}
+	err = destination.Import(name, builds)
+	if err != nil {
+		destination.RollbackTransaction()
+		return errors.Wrapf(err, "Failed to import builds of %q", name)
+	}
+	return errors.Wrapf(destination.CommitTransaction(), "Failed to commit %q", name)
+}
+
+// storedBuilds returns the build history of an image. Images stored before build
+// histories were kept have none, so their current metadata counts as the only build
+func storedBuilds(store GzrMetadataStore, image *Image) ([]*ImageBuild, error) {
+	history, err := store.History(image.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get build history for %q", image.Name)
+	}
+	if len(history.Builds) > 0 {
+		return history.Builds, nil
+	}
+	current, err := store.Get(image.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get %q", image.Name)
+	}
+	if current == nil {
+		return nil, nil
+	}
+	return []*ImageBuild{{Build: 1, Meta: current.Meta}}, nil
+}
+
+// checksumBuilds returns a SHA-256 of each build in order, including its build number and
+// store time, so a copy only matches if the history was carried over exactly
+func checksumBuilds(builds []*ImageBuild) string {
+	data, _ := json.Marshal(builds)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
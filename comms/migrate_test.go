@@ -0,0 +1,171 @@
+package comms
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMigrateImages_CopiesHistoryAndVerifies(t *testing.T) {
+	source, _, cleanupSource := newTestFileStorage(t)
+	defer cleanupSource()
+	destination, cleanupDestination := newTestBoltStorage(t)
+	defer cleanupDestination()
+
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+	storeInTransaction(t, source, "repo/other:20170211", ImageMetadata{GitCommit: "ccc"})
+
+	report, err := MigrateImages(source, destination, false)
+	if err != nil {
+		t.Fatalf("MigrateImages errored with %s", err)
+	}
+	if report.SourceCount != 2 || report.DestinationCount != 2 || report.Copied() != 2 {
+		t.Errorf("Expected 2 images copied, but report was %+v", report)
+	}
+	if len(report.Mismatches) != 0 {
+		t.Errorf("Expected no mismatches, but found %v", report.Mismatches)
+	}
+
+	history, err := destination.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 2 {
+		t.Errorf("Expected 2 builds copied, but found %d", len(history.Builds))
+	}
+
+	report, err = MigrateImages(source, destination, false)
+	if err != nil {
+		t.Fatalf("MigrateImages errored with %s", err)
+	}
+	if report.Copied() != 0 {
+		t.Errorf("Expected existing images to be skipped, but copied %d", report.Copied())
+	}
+}
+
+// listingNothing is a store whose ListAll finds no images
+type listingNothing struct {
+	GzrMetadataStore
+}
+
+func (store listingNothing) ListAll() (*ImageList, error) {
+	return &ImageList{}, nil
+}
+
+func TestMigrateImages_FailsVerification(t *testing.T) {
+	source, _, cleanupSource := newTestFileStorage(t)
+	defer cleanupSource()
+	destination, cleanupDestination := newTestBoltStorage(t)
+	defer cleanupDestination()
+
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+	storeInTransaction(t, destination, "repo/app:20170210", ImageMetadata{GitCommit: "bbb"})
+
+	report, err := MigrateImages(source, destination, false)
+	if errors.Cause(err) != ErrMigrationUnverified {
+		t.Errorf("Expected ErrMigrationUnverified for a mismatched history, but got %v", err)
+	}
+	if report == nil || len(report.Mismatches) != 1 {
+		t.Errorf("Expected repo/app:20170210 to mismatch, but report was %+v", report)
+	}
+
+	storeInTransaction(t, source, "repo/other:20170211", ImageMetadata{GitCommit: "ccc"})
+	report, err = MigrateImages(source, listingNothing{destination}, false)
+	if errors.Cause(err) != ErrMigrationUnverified {
+		t.Errorf("Expected ErrMigrationUnverified for missing images, but got %v", err)
+	}
+	if report == nil || report.DestinationCount != 0 || report.SourceCount != 2 {
+		t.Errorf("Expected 0 of 2 images in the destination, but report was %+v", report)
+	}
+}
+
+func TestMigrateImages_DryRunWritesNothing(t *testing.T) {
+	source, _, cleanupSource := newTestFileStorage(t)
+	defer cleanupSource()
+	destination, cleanupDestination := newTestBoltStorage(t)
+	defer cleanupDestination()
+
+	storeInTransaction(t, source, "repo/app:20170210", ImageMetadata{GitCommit: "aaa"})
+
+	report, err := MigrateImages(source, destination, true)
+	if err != nil {
+		t.Fatalf("MigrateImages errored with %s", err)
+	}
+	if report.Copied() != 1 {
+		t.Errorf("Expected dry run to report 1 image, but reported %d", report.Copied())
+	}
+	images, err := destination.ListAll()
+	if err != nil {
+		t.Fatalf("ListAll errored with %s", err)
+	}
+	if len(images.Images) != 0 {
+		t.Errorf("Expected dry run to write nothing, but found %d images", len(images.Images))
+	}
+}
+
+func TestMigrateImages_KeepsBuildNumbersAndStoreTimes(t *testing.T) {
+	source, _, cleanupSource := newTestFileStorage(t)
+	defer cleanupSource()
+	destination, cleanupDestination := newTestBoltStorage(t)
+	defer cleanupDestination()
+
+	builds := []*ImageBuild{
+		{Build: 1, StoredAt: "2017-02-10T00:00:00Z", Meta: ImageMetadata{GitCommit: "aaa"}},
+		{Build: 2, StoredAt: "2017-02-11T00:00:00Z", Meta: ImageMetadata{GitCommit: "bbb"}},
+	}
+	if err := source.StartTransaction(); err != nil {
+		t.Fatalf("Failed to start transaction: %s", err)
+	}
+	if err := source.Import("repo/app:20170210", builds); err != nil {
+		t.Fatalf("Import errored with %s", err)
+	}
+	if err := source.CommitTransaction(); err != nil {
+		t.Fatalf("Failed to commit transaction: %s", err)
+	}
+
+	report, err := MigrateImages(source, destination, false)
+	if err != nil {
+		t.Fatalf("MigrateImages errored with %s", err)
+	}
+	if len(report.Mismatches) != 0 {
+		t.Errorf("Expected no mismatches, but found %v", report.Mismatches)
+	}
+	history, err := destination.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if !sameBuilds(history.Builds, builds) {
+		t.Errorf("Expected builds to keep their numbers and store times, but found %+v and %+v", history.Builds[0], history.Builds[1])
+	}
+
+	storeInTransaction(t, destination, "repo/app:20170210", ImageMetadata{GitCommit: "ccc"})
+	history, err = destination.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if last := history.Builds[len(history.Builds)-1]; last.Build != 3 {
+		t.Errorf("Expected the next build to be numbered 3, but it was %d", last.Build)
+	}
+}
+
+// sameBuilds returns true if both histories have the same build numbers, store times and commits
+func sameBuilds(actual []*ImageBuild, expected []*ImageBuild) bool {
+	if len(actual) != len(expected) {
+		return false
+	}
+	for i := range actual {
+		if actual[i].Build != expected[i].Build || actual[i].StoredAt != expected[i].StoredAt || actual[i].Meta.GitCommit != expected[i].Meta.GitCommit {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChecksumBuilds_IncludesStoreTime(t *testing.T) {
+	original := []*ImageBuild{{Build: 1, StoredAt: "2017-02-10T00:00:00Z", Meta: ImageMetadata{GitCommit: "aaa"}}}
+	restamped := []*ImageBuild{{Build: 1, StoredAt: "2017-03-01T00:00:00Z", Meta: ImageMetadata{GitCommit: "aaa"}}}
+	if checksumBuilds(original) == checksumBuilds(restamped) {
+		t.Error("Expected builds stored at different times to have different checksums")
+	}
+}
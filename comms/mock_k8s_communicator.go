@@ -1,9 +1,17 @@
 package comms
 
+import "time"
+
 type MockK8sCommunicator struct {
-	OnGetDeployment    func(string) (*GzrDeployment, error)
-	OnListDeployments  func() (*GzrDeploymentList, error)
-	OnUpdateDeployment func(*DeploymentContainerInfo) (*GzrDeployment, error)
+	OnGetDeployment      func(string) (*GzrDeployment, error)
+	OnListDeployments    func() (*GzrDeploymentList, error)
+	OnUpdateDeployment   func(*DeploymentContainerInfo) (*GzrDeployment, error)
+	OnListRevisions      func(string) (*DeploymentRevisionList, error)
+	OnRollbackDeployment func(string, *DeploymentRevision) (*GzrDeployment, error)
+	OnWaitForRollout     func(string, time.Duration, RolloutProgressFunc) (*GzrDeployment, error)
+	OnListWorkloads      func(WorkloadKind) (*WorkloadList, error)
+	OnGetWorkload        func(WorkloadKind, string) (*Workload, error)
+	OnUpdateWorkload     func(*WorkloadContainerInfo) (*Workload, error)
 
 	namespace string
 }
@@ -20,6 +28,30 @@ func (mock *MockK8sCommunicator) UpdateDeployment(dci *DeploymentContainerInfo)
 	return mock.OnUpdateDeployment(dci)
 }
 
+func (mock *MockK8sCommunicator) ListRevisions(deploymentName string) (*DeploymentRevisionList, error) {
+	return mock.OnListRevisions(deploymentName)
+}
+
+func (mock *MockK8sCommunicator) RollbackDeployment(deploymentName string, revision *DeploymentRevision) (*GzrDeployment, error) {
+	return mock.OnRollbackDeployment(deploymentName, revision)
+}
+
+func (mock *MockK8sCommunicator) WaitForRollout(deploymentName string, timeout time.Duration, progress RolloutProgressFunc) (*GzrDeployment, error) {
+	return mock.OnWaitForRollout(deploymentName, timeout, progress)
+}
+
+func (mock *MockK8sCommunicator) ListWorkloads(kind WorkloadKind) (*WorkloadList, error) {
+	return mock.OnListWorkloads(kind)
+}
+
+func (mock *MockK8sCommunicator) GetWorkload(kind WorkloadKind, name string) (*Workload, error) {
+	return mock.OnGetWorkload(kind, name)
+}
+
+func (mock *MockK8sCommunicator) UpdateWorkload(wci *WorkloadContainerInfo) (*Workload, error) {
+	return mock.OnUpdateWorkload(wci)
+}
+
 func (mock *MockK8sCommunicator) GetNamespace() string {
 	if mock.namespace == "" {
 		return "default"
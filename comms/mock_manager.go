@@ -1,22 +1,34 @@
 package comms
 
 type MockManager struct {
-	OnBuild func(...string) error
-	OnPush  func(string) error
+	OnBuild   func(BuildOptions, ...string) error
+	OnPush    func(string) error
+	OnInspect func(string) (*RegistryInfo, error)
+	OnLabels  func(string) (map[string]string, error)
 }
 
 // NewDefaultMockManager returns an initialized MockManager with no-ops for all methods
 func NewDefaultMockManager() ImageManager {
 	return &MockManager{
-		OnBuild: func(_ ...string) error { return nil },
-		OnPush:  func(_ string) error { return nil },
+		OnBuild:   func(_ BuildOptions, _ ...string) error { return nil },
+		OnPush:    func(_ string) error { return nil },
+		OnInspect: func(_ string) (*RegistryInfo, error) { return &RegistryInfo{}, nil },
+		OnLabels:  func(_ string) (map[string]string, error) { return map[string]string{}, nil },
 	}
 }
 
-func (mock *MockManager) Build(args ...string) error {
-	return mock.OnBuild(args...)
+func (mock *MockManager) Build(opts BuildOptions, args ...string) error {
+	return mock.OnBuild(opts, args...)
 }
 
 func (mock *MockManager) Push(name string) error {
 	return mock.OnPush(name)
 }
+
+func (mock *MockManager) Inspect(name string) (*RegistryInfo, error) {
+	return mock.OnInspect(name)
+}
+
+func (mock *MockManager) Labels(name string) (map[string]string, error) {
+	return mock.OnLabels(name)
+}
@@ -0,0 +1,24 @@
+package comms
+
+type MockRegistry struct {
+	OnImageExists    func(string) (bool, error)
+	OnManifestDigest func(string) (string, error)
+	OnListTags       func(string) ([]string, error)
+	OnImageConfig    func(string) (*ImageConfig, error)
+}
+
+func (mock *MockRegistry) ImageExists(image string) (bool, error) {
+	return mock.OnImageExists(image)
+}
+
+func (mock *MockRegistry) ManifestDigest(image string) (string, error) {
+	return mock.OnManifestDigest(image)
+}
+
+func (mock *MockRegistry) ListTags(repository string) ([]string, error) {
+	return mock.OnListTags(repository)
+}
+
+func (mock *MockRegistry) ImageConfig(image string) (*ImageConfig, error) {
+	return mock.OnImageConfig(image)
+}
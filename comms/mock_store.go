@@ -1,22 +1,38 @@
 package comms
 
+import "context"
+
 type MockStore struct {
-	OnStore             func(string, ImageMetadata) error
-	OnList              func(string) (*ImageList, error)
-	OnCleanup           func()
-	OnDelete            func(string) (int, error)
-	OnGet               func(string) (*Image, error)
-	OnGetLatest         func(string) (*Image, error)
-	OnStartTransaction  func() error
-	OnCommitTransaction func() error
+	OnStore               func(string, ImageMetadata) error
+	OnImport              func(string, []*ImageBuild) error
+	OnList                func(string, ListOptions) (*ImageList, error)
+	OnListAll             func() (*ImageList, error)
+	OnCleanup             func()
+	OnDelete              func(string) (int, error)
+	OnGet                 func(string) (*Image, error)
+	OnGetLatest           func(string) (*Image, error)
+	OnStartTransaction    func() error
+	OnCommitTransaction   func() error
+	OnRollbackTransaction func() error
+	OnHistory             func(string) (*ImageHistory, error)
+	OnFind                func(ImageQuery) (*ImageList, error)
+	OnWatch               func(context.Context, string) (<-chan *ImageEvent, error)
 }
 
 func (mock *MockStore) Store(imageName string, meta ImageMetadata) error {
 	return mock.OnStore(imageName, meta)
 }
 
-func (mock *MockStore) List(imageName string) (*ImageList, error) {
-	return mock.OnList(imageName)
+func (mock *MockStore) Import(imageName string, builds []*ImageBuild) error {
+	return mock.OnImport(imageName, builds)
+}
+
+func (mock *MockStore) List(imageName string, opts ListOptions) (*ImageList, error) {
+	return mock.OnList(imageName, opts)
+}
+
+func (mock *MockStore) ListAll() (*ImageList, error) {
+	return mock.OnListAll()
 }
 
 func (mock *MockStore) Cleanup() {
@@ -42,3 +58,19 @@ func (mock *MockStore) StartTransaction() error {
 func (mock *MockStore) CommitTransaction() error {
 	return mock.OnCommitTransaction()
 }
+
+func (mock *MockStore) RollbackTransaction() error {
+	return mock.OnRollbackTransaction()
+}
+
+func (mock *MockStore) History(imageName string) (*ImageHistory, error) {
+	return mock.OnHistory(imageName)
+}
+
+func (mock *MockStore) Find(query ImageQuery) (*ImageList, error) {
+	return mock.OnFind(query)
+}
+
+func (mock *MockStore) Watch(ctx context.Context, prefix string) (<-chan *ImageEvent, error) {
+	return mock.OnWatch(ctx, prefix)
+}
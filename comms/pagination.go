@@ -0,0 +1,155 @@
+package comms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/bradfitz/slice"
+	"github.com/pkg/errors"
+)
+
+// ListSort is the order List returns images in
+type ListSort string
+
+const (
+	// SortByVersion orders images by NAME:VERSION, which is the order they are kept in
+	SortByVersion ListSort = "version"
+	// SortByCreatedAt orders images oldest first
+	SortByCreatedAt ListSort = "created-at"
+	// SortByCreatedAtDesc orders images newest first
+	SortByCreatedAtDesc ListSort = "-created-at"
+)
+
+// ListOptions narrows and orders the images returned by List. The zero value lists
+// every image in version order
+type ListOptions struct {
+	// Limit is the most images to return in one page, or every image when 0
+	Limit int
+	// Continue is the ImageList.Continue token of the previous page
+	Continue string
+	// Sort is the order of the images, SortByVersion when empty
+	Sort ListSort
+	// Labels only lists images that have every one of the labels
+	Labels map[string]string
+}
+
+// listCursor is the position after the last image of a page, encoded in continue tokens
+type listCursor struct {
+	Sort      ListSort `json:"sort"`
+	Name      string   `json:"name"`
+	CreatedAt string   `json:"created-at,omitempty"`
+}
+
+// ParseListSort returns the ListSort named by value
+func ParseListSort(value string) (ListSort, error) {
+	sort := ListSort(strings.ToLower(value))
+	switch sort {
+	case "":
+		return SortByVersion, nil
+	case SortByVersion, SortByCreatedAt, SortByCreatedAtDesc:
+		return sort, nil
+	default:
+		return "", errors.Errorf("Not a valid sort: %q, must be one of %s, %s or %s", value, SortByVersion, SortByCreatedAt, SortByCreatedAtDesc)
+	}
+}
+
+// sortOrder returns the order images are listed in
+func (opts ListOptions) sortOrder() ListSort {
+	if opts.Sort == "" {
+		return SortByVersion
+	}
+	return opts.Sort
+}
+
+// inStoreOrder returns true if a page can be read in the order images are kept,
+// without reading every image under the name first
+func (opts ListOptions) inStoreOrder() bool {
+	return opts.sortOrder() == SortByVersion && len(opts.Labels) == 0
+}
+
+// cursor decodes the continue token, or returns nil for the first page
+func (opts ListOptions) cursor() (*listCursor, error) {
+	if opts.Continue == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(opts.Continue)
+	if err != nil {
+		return nil, errors.New("Continue token is not valid")
+	}
+	cursor := &listCursor{}
+	err = json.Unmarshal(data, cursor)
+	if err != nil {
+		return nil, errors.New("Continue token is not valid")
+	}
+	if cursor.Sort != opts.sortOrder() {
+		return nil, errors.Errorf("Continue token is for sort %q, not %q", cursor.Sort, opts.sortOrder())
+	}
+	return cursor, nil
+}
+
+// startAfter returns the name to start reading a page after, or "" for the first page
+func (opts ListOptions) startAfter() (string, error) {
+	cursor, err := opts.cursor()
+	if err != nil || cursor == nil {
+		return "", err
+	}
+	return cursor.Name, nil
+}
+
+// encode returns the continue token for a cursor
+func (cursor *listCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// before returns true if an image at position a is listed before one at position b
+func (sort ListSort) before(a *listCursor, b *listCursor) bool {
+	switch sort {
+	case SortByCreatedAt:
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+	case SortByCreatedAtDesc:
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+	}
+	return a.Name < b.Name
+}
+
+// position returns the cursor pointing at image
+func (sort ListSort) position(image *Image) *listCursor {
+	cursor := &listCursor{Sort: sort, Name: image.Name}
+	if sort != SortByVersion {
+		cursor.CreatedAt = image.Meta.CreatedAt
+	}
+	return cursor
+}
+
+// pageImages filters, sorts and pages images read by a List, setting the continue
+// token when there are more images after the page
+func pageImages(images []*Image, opts ListOptions) (*ImageList, error) {
+	cursor, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+	order := opts.sortOrder()
+	list := (&ImageList{Images: images}).FilterByLabels(opts.Labels)
+	slice.Sort(list.Images, func(i, j int) bool {
+		return order.before(order.position(list.Images[i]), order.position(list.Images[j]))
+	})
+
+	page := &ImageList{}
+	for _, image := range list.Images {
+		if cursor != nil && !order.before(cursor, order.position(image)) {
+			continue
+		}
+		if opts.Limit > 0 && len(page.Images) == opts.Limit {
+			page.Continue = order.position(page.Images[len(page.Images)-1]).encode()
+			break
+		}
+		page.Images = append(page.Images, image)
+	}
+	return page, nil
+}
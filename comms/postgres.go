@@ -0,0 +1,647 @@
+package comms
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// postgresMigrations are applied in order on startup. Each entry is one schema
+// version; append new entries rather than editing old ones
+var postgresMigrations = []string{
+	`CREATE TABLE images (
+		id   SERIAL PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE versions (
+		id         SERIAL PRIMARY KEY,
+		image_id   INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+		version    TEXT NOT NULL,
+		build      INTEGER NOT NULL,
+		stored_at  TEXT NOT NULL,
+		git_commit TEXT NOT NULL,
+		git_origin TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		UNIQUE (image_id, version, build)
+	);
+	CREATE INDEX versions_created_at_idx ON versions (created_at);
+	CREATE TABLE tags (
+		version_id INTEGER NOT NULL REFERENCES versions (id) ON DELETE CASCADE,
+		position   INTEGER NOT NULL,
+		tag        TEXT NOT NULL,
+		PRIMARY KEY (version_id, position)
+	);
+	CREATE TABLE annotations (
+		version_id INTEGER NOT NULL REFERENCES versions (id) ON DELETE CASCADE,
+		position   INTEGER NOT NULL,
+		annotation TEXT NOT NULL,
+		PRIMARY KEY (version_id, position)
+	);`,
+	`CREATE INDEX versions_git_commit_idx ON versions (git_commit);
+	CREATE INDEX versions_git_origin_idx ON versions (git_origin);
+	CREATE INDEX tags_tag_idx ON tags (tag);`,
+	`ALTER TABLE versions
+		ADD COLUMN ci_build_url TEXT,
+		ADD COLUMN ci_job       TEXT,
+		ADD COLUMN ci_number    INTEGER;
+	CREATE TABLE labels (
+		version_id INTEGER NOT NULL REFERENCES versions (id) ON DELETE CASCADE,
+		key        TEXT NOT NULL,
+		value      TEXT NOT NULL,
+		PRIMARY KEY (version_id, key)
+	);
+	CREATE INDEX labels_key_value_idx ON labels (key, value);
+	CREATE TABLE issues (
+		version_id INTEGER NOT NULL REFERENCES versions (id) ON DELETE CASCADE,
+		position   INTEGER NOT NULL,
+		ticket     TEXT NOT NULL,
+		PRIMARY KEY (version_id, position)
+	);`,
+	`ALTER TABLE versions ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1;`,
+	`ALTER TABLE versions
+		ADD COLUMN registry_digest       TEXT,
+		ADD COLUMN registry_size         BIGINT,
+		ADD COLUMN registry_architecture TEXT,
+		ADD COLUMN registry_layers       INTEGER;
+	CREATE INDEX versions_registry_digest_idx ON versions (registry_digest);`,
+	`CREATE INDEX images_name_pattern_idx ON images (name text_pattern_ops);
+	CREATE INDEX versions_version_pattern_idx ON versions (image_id, version text_pattern_ops);`,
+}
+
+// postgresMigrationLock is the advisory lock held while migrating, so gzr processes starting
+// against the same database apply each migration once
+const postgresMigrationLock = 0x677a72
+
+// postgresStoreAttempts is how often Store picks a new build number when a concurrent
+// transaction commits the one it chose first
+const postgresStoreAttempts = 5
+
+// postgresUniqueViolation is the SQLSTATE of a unique constraint violation
+const postgresUniqueViolation = "23505"
+
+// postgresImageColumns selects everything needed by scanImage from versions v joined to images i
+const postgresImageColumns = `i.name, v.version, v.build, v.stored_at, v.git_commit, v.git_origin, v.created_at,
+	ARRAY(SELECT tag FROM tags WHERE version_id = v.id ORDER BY position),
+	ARRAY(SELECT annotation FROM annotations WHERE version_id = v.id ORDER BY position),
+	(SELECT json_object_agg(key, value) FROM labels WHERE version_id = v.id),
+	v.ci_build_url, v.ci_job, v.ci_number, v.schema_version,
+	v.registry_digest, v.registry_size, v.registry_architecture, v.registry_layers,
+	ARRAY(SELECT ticket FROM issues WHERE version_id = v.id ORDER BY position)`
+
+// PostgresStorage implements GzrMetadataStore on top of a relational schema in PostgreSQL
+type PostgresStorage struct {
+	db        *sql.DB
+	activeTxn *sql.Tx
+	// notifier sends events to Watch. Only changes made through this process are seen
+	notifier imageNotifier
+}
+
+// NewPostgresStorage connects to the configured database, applies any outstanding
+// migrations and returns a PostgresStorage using the connection. config holds the
+// datastore settings, normally the "datastore" block of the config file
+func NewPostgresStorage(config *viper.Viper) (GzrMetadataStore, error) {
+	url := config.GetString("url")
+	defer log.Debug("NewPostgresStorage")
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open connection to postgres database")
+	}
+	store := &PostgresStorage{db: db}
+	err = store.migrate()
+	if err != nil {
+		store.Cleanup()
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrate applies every migration newer than the recorded schema version, each in its own transaction
+func (store *PostgresStorage) migrate() error {
+	for {
+		done, err := store.migrateNext()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateNext applies the next outstanding migration while holding postgresMigrationLock,
+// returning true when the schema is already up to date
+func (store *PostgresStorage) migrateNext() (bool, error) {
+	txn, err := store.db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to start migration transaction")
+	}
+	// the lock is released when the transaction ends, so the schema version is read under it
+	_, err = txn.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock)
+	if err != nil {
+		txn.Rollback()
+		return false, errors.Wrap(err, "Failed to lock schema for migration")
+	}
+	_, err = txn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		txn.Rollback()
+		return false, errors.Wrap(err, "Failed to create schema_migrations table")
+	}
+	var current int
+	err = txn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		txn.Rollback()
+		return false, errors.Wrap(err, "Failed to read schema version")
+	}
+	if current >= len(postgresMigrations) {
+		return true, errors.Wrap(txn.Commit(), "Failed to commit schema version check")
+	}
+	_, err = txn.Exec(postgresMigrations[current])
+	if err == nil {
+		_, err = txn.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, current+1)
+	}
+	if err != nil {
+		txn.Rollback()
+		return false, errors.Wrapf(err, "Failed to apply migration %d", current+1)
+	}
+	err = txn.Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to commit migration %d", current+1)
+	}
+	return false, nil
+}
+
+// List returns a page of the newest build of every version whose NAME:VERSION begins with imageName.
+// The labels, order and page are applied in the query, continuing after the cursor in opts
+func (store *PostgresStorage) List(imageName string, opts ListOptions) (*ImageList, error) {
+	cursor, err := opts.cursor()
+	if err != nil {
+		return &ImageList{}, err
+	}
+	order := opts.sortOrder()
+
+	var args postgresArgs
+	conditions := []string{`v.id IN (SELECT DISTINCT ON (v.image_id, v.version) v.id
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE ` + strings.Join(keyPrefixConditions(imageName, &args), " AND ") + `
+		ORDER BY v.image_id, v.version, v.build DESC)`}
+	for key, value := range opts.Labels {
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (SELECT 1 FROM labels l
+			WHERE l.version_id = v.id AND l.key = %s AND l.value = %s)`, args.add(key), args.add(value)))
+	}
+	// keys and creation times are compared byte by byte, the same as pageImages does
+	const key = `(i.name || ':' || v.version) COLLATE "C"`
+	const createdAt = `v.created_at COLLATE "C"`
+	orderBy := key
+	switch order {
+	case SortByCreatedAt:
+		orderBy = createdAt + ", " + key
+	case SortByCreatedAtDesc:
+		orderBy = createdAt + " DESC, " + key
+	}
+	if cursor != nil {
+		switch order {
+		case SortByVersion:
+			conditions = append(conditions, key+" > "+args.add(cursor.Name))
+		case SortByCreatedAt, SortByCreatedAtDesc:
+			compare := ">"
+			if order == SortByCreatedAtDesc {
+				compare = "<"
+			}
+			after, name := args.add(cursor.CreatedAt), args.add(cursor.Name)
+			conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (v.created_at = %s AND %s > %s))",
+				createdAt, compare, after, after, key, name))
+		}
+	}
+	limit := ""
+	if opts.Limit > 0 {
+		// one more than the page shows whether there is a next page
+		limit = " LIMIT " + args.add(opts.Limit+1)
+	}
+
+	rows, err := store.db.Query(`SELECT `+postgresImageColumns+`
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+orderBy+limit, args...)
+	if err != nil {
+		return &ImageList{}, errors.Wrapf(err, "Failed to retrieve image list for %q from postgres", imageName)
+	}
+	defer rows.Close()
+	page := &ImageList{}
+	for rows.Next() {
+		image, _, err := scanImage(rows)
+		if err != nil {
+			return &ImageList{}, errors.Wrapf(err, "Failed to read image list for %q from postgres", imageName)
+		}
+		page.Images = append(page.Images, image)
+	}
+	if err = rows.Err(); err != nil {
+		return &ImageList{}, errors.Wrap(err, "Failed to read image list from postgres")
+	}
+	if opts.Limit > 0 && len(page.Images) > opts.Limit {
+		page.Images = page.Images[:opts.Limit]
+		page.Continue = order.position(page.Images[opts.Limit-1]).encode()
+	}
+	return page, nil
+}
+
+// ListAll returns the newest build of every version in the database
+func (store *PostgresStorage) ListAll() (*ImageList, error) {
+	return store.List("", ListOptions{})
+}
+
+// Store records meta as the next build of the image in the active transaction
+func (store *PostgresStorage) Store(imageName string, meta ImageMetadata) error {
+	key, err := createKey(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create key %q in postgres", imageName)
+	}
+	name, version, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+
+	imageID, err := store.storeImageName(name)
+	if err != nil {
+		return err
+	}
+
+	// a concurrent transaction can take the same build number, which the
+	// UNIQUE (image_id, version, build) constraint rejects once it commits, so the
+	// insert is retried from a savepoint with the number read again
+	for attempt := 1; ; attempt++ {
+		_, err = store.activeTxn.Exec(`SAVEPOINT store_build`)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store metadata for %q in postgres", key)
+		}
+		var seq int
+		err = store.activeTxn.QueryRow(`SELECT COALESCE(MAX(build), 0) + 1 FROM versions
+			WHERE image_id = $1 AND version = $2`, imageID, version).Scan(&seq)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get next build number for %q in postgres", key)
+		}
+		err = store.insertBuild(imageID, key, version, newImageBuild(seq, meta))
+		if err == nil {
+			break
+		}
+		if !isUniqueViolation(err) || attempt == postgresStoreAttempts {
+			return err
+		}
+		_, err = store.activeTxn.Exec(`ROLLBACK TO SAVEPOINT store_build`)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retry storing metadata for %q in postgres", key)
+		}
+	}
+	_, err = store.activeTxn.Exec(`RELEASE SAVEPOINT store_build`)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store metadata for %q in postgres", key)
+	}
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: meta})
+	return nil
+}
+
+// Import records builds as the history of imageName, keeping their build numbers and store times
+func (store *PostgresStorage) Import(imageName string, builds []*ImageBuild) error {
+	key, err := createKey(imageName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create key %q in postgres", imageName)
+	}
+	name, version, err := splitKey(key)
+	if err != nil {
+		return err
+	}
+	if len(builds) == 0 {
+		return nil
+	}
+	imageID, err := store.storeImageName(name)
+	if err != nil {
+		return err
+	}
+	for _, build := range builds {
+		err = store.insertBuild(imageID, key, version, build)
+		if err != nil {
+			return err
+		}
+	}
+	store.notifier.queue(ImageStored, &Image{Name: key, Meta: builds[len(builds)-1].Meta})
+	return nil
+}
+
+// storeImageName returns the id of the image name in the active transaction, adding it if it's new
+func (store *PostgresStorage) storeImageName(name string) (int, error) {
+	var imageID int
+	err := store.activeTxn.QueryRow(`INSERT INTO images (name) VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id`, name).Scan(&imageID)
+	return imageID, errors.Wrapf(err, "Failed to store image name %q in postgres", name)
+}
+
+// insertBuild adds build as a build of version of the image with imageID, stored under key,
+// in the active transaction
+func (store *PostgresStorage) insertBuild(imageID int, key string, version string, build *ImageBuild) error {
+	meta := build.Meta
+	var ciBuildURL, ciJob sql.NullString
+	var ciNumber sql.NullInt64
+	if meta.CI != nil {
+		ciBuildURL = sql.NullString{String: meta.CI.BuildURL, Valid: true}
+		ciJob = sql.NullString{String: meta.CI.Job, Valid: true}
+		ciNumber = sql.NullInt64{Int64: int64(meta.CI.Number), Valid: true}
+	}
+	var registryDigest, registryArchitecture sql.NullString
+	var registrySize, registryLayers sql.NullInt64
+	if meta.Registry != nil {
+		registryDigest = sql.NullString{String: meta.Registry.Digest, Valid: true}
+		registryArchitecture = sql.NullString{String: meta.Registry.Architecture, Valid: true}
+		registrySize = sql.NullInt64{Int64: meta.Registry.Size, Valid: true}
+		registryLayers = sql.NullInt64{Int64: int64(meta.Registry.Layers), Valid: true}
+	}
+
+	var versionID int
+	err := store.activeTxn.QueryRow(`INSERT INTO versions
+		(image_id, version, build, stored_at, git_commit, git_origin, created_at, ci_build_url, ci_job, ci_number, schema_version,
+		registry_digest, registry_size, registry_architecture, registry_layers)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
+		imageID, version, build.Build, build.StoredAt, meta.GitCommit, meta.GitOrigin, meta.CreatedAt,
+		ciBuildURL, ciJob, ciNumber, meta.SchemaVersion,
+		registryDigest, registrySize, registryArchitecture, registryLayers).Scan(&versionID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to store metadata for %q in postgres", key)
+	}
+
+	for i, tag := range meta.GitTag {
+		_, err = store.activeTxn.Exec(`INSERT INTO tags (version_id, position, tag) VALUES ($1, $2, $3)`, versionID, i, tag)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store tag %q for %q in postgres", tag, key)
+		}
+	}
+	for i, annotation := range meta.GitAnnotation {
+		_, err = store.activeTxn.Exec(`INSERT INTO annotations (version_id, position, annotation) VALUES ($1, $2, $3)`, versionID, i, annotation)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store annotation for %q in postgres", key)
+		}
+	}
+	for labelKey, value := range meta.Labels {
+		_, err = store.activeTxn.Exec(`INSERT INTO labels (version_id, key, value) VALUES ($1, $2, $3)`, versionID, labelKey, value)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store label %q for %q in postgres", labelKey, key)
+		}
+	}
+	for i, ticket := range meta.Issues {
+		_, err = store.activeTxn.Exec(`INSERT INTO issues (version_id, position, ticket) VALUES ($1, $2, $3)`, versionID, i, ticket)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store issue %q for %q in postgres", ticket, key)
+		}
+	}
+	return nil
+}
+
+// Cleanup closes the database connection
+func (store *PostgresStorage) Cleanup() {
+	store.db.Close()
+}
+
+// Delete deletes every build of every version whose NAME:VERSION begins with imageName,
+// returning the number of versions removed
+func (store *PostgresStorage) Delete(imageName string) (int, error) {
+	var args postgresArgs
+	rows, err := store.activeTxn.Query(`WITH deleted AS (
+			DELETE FROM versions v USING images i
+			WHERE v.image_id = i.id AND `+strings.Join(keyPrefixConditions(imageName, &args), " AND ")+`
+			RETURNING i.name, v.version
+		) SELECT DISTINCT name || ':' || version FROM deleted`, args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to delete images for %q from postgres", imageName)
+	}
+	defer rows.Close()
+	deleted := 0
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to read deleted images for %q from postgres", imageName)
+		}
+		store.notifier.queue(ImageDeleted, &Image{Name: key})
+		deleted += 1
+	}
+	return deleted, errors.Wrapf(rows.Err(), "Failed to delete images for %q from postgres", imageName)
+}
+
+// Get returns the newest build of a single NAME:VERSION, or nil if it isn't stored
+func (store *PostgresStorage) Get(imageName string) (*Image, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q in postgres", imageName)
+	}
+	name, version, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	row := store.db.QueryRow(`SELECT `+postgresImageColumns+`
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE i.name = $1 AND v.version = $2
+		ORDER BY v.build DESC LIMIT 1`, name, version)
+	image, _, err := scanImage(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get image %q from postgres", imageName)
+	}
+	return image, nil
+}
+
+// GetLatest returns the most recently created image whose NAME:VERSION begins with imageName
+func (store *PostgresStorage) GetLatest(imageName string) (*Image, error) {
+	var args postgresArgs
+	row := store.db.QueryRow(`SELECT `+postgresImageColumns+`
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE `+strings.Join(keyPrefixConditions(imageName, &args), " AND ")+`
+		ORDER BY v.created_at DESC, v.build DESC LIMIT 1`, args...)
+	image, _, err := scanImage(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Errorf("No images found for %q", imageName)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get latest image for %q from postgres", imageName)
+	}
+	return image, nil
+}
+
+// History returns every stored build for a single NAME:VERSION, oldest first
+func (store *PostgresStorage) History(imageName string) (*ImageHistory, error) {
+	key, err := createKey(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create key %q in postgres", imageName)
+	}
+	name, version, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.db.Query(`SELECT `+postgresImageColumns+`
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE i.name = $1 AND v.version = $2
+		ORDER BY v.build`, name, version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get build history for %q from postgres", imageName)
+	}
+	defer rows.Close()
+	history := &ImageHistory{Name: key}
+	for rows.Next() {
+		_, build, err := scanImage(rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read build history for %q from postgres", imageName)
+		}
+		history.Builds = append(history.Builds, build)
+	}
+	return history, errors.Wrap(rows.Err(), "Failed to read build history from postgres")
+}
+
+// Find returns the newest build of every version with a build matching query
+func (store *PostgresStorage) Find(query ImageQuery) (*ImageList, error) {
+	if query.IsEmpty() {
+		return nil, errors.New("Must provide a commit, tag, origin or digest to find images by")
+	}
+	rows, err := store.db.Query(`SELECT DISTINCT ON (i.name, v.version) `+postgresImageColumns+`
+		FROM versions v JOIN images i ON i.id = v.image_id
+		WHERE ($1 = '' OR (v.git_commit <> '' AND
+				(left(v.git_commit, length($1)) = $1 OR left($1, length(v.git_commit)) = v.git_commit)))
+			AND ($2 = '' OR EXISTS (SELECT 1 FROM tags t WHERE t.version_id = v.id AND t.tag = $2))
+			AND ($3 = '' OR v.git_origin = $3)
+			AND ($4 = '' OR v.registry_digest = $4)
+		ORDER BY i.name, v.version, v.build DESC`, query.GitCommit, query.GitTag, query.GitOrigin, query.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find images in postgres")
+	}
+	defer rows.Close()
+	var images []*Image
+	for rows.Next() {
+		image, _, err := scanImage(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read found images from postgres")
+		}
+		images = append(images, image)
+	}
+	return &ImageList{Images: images}, errors.Wrap(rows.Err(), "Failed to read found images from postgres")
+}
+
+// Watch returns the events for images whose name begins with prefix as transactions are
+// committed by this process. Changes made by other connections to the database aren't seen
+func (store *PostgresStorage) Watch(ctx context.Context, prefix string) (<-chan *ImageEvent, error) {
+	return store.notifier.watch(ctx, prefix), nil
+}
+
+// StartTransaction starts a new database transaction and adds it to the Storage
+func (store *PostgresStorage) StartTransaction() error {
+	txn, err := store.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create transaction")
+	}
+	store.activeTxn = txn
+	return nil
+}
+
+// CommitTransaction commits the active transaction and sends its events to watchers
+func (store *PostgresStorage) CommitTransaction() error {
+	err := store.activeTxn.Commit()
+	store.activeTxn = nil
+	if err != nil {
+		store.notifier.discard()
+		return errors.Wrap(err, "Failed to commit transaction to postgres")
+	}
+	store.notifier.publish()
+	return nil
+}
+
+// RollbackTransaction rolls back the active transaction
+func (store *PostgresStorage) RollbackTransaction() error {
+	if store.activeTxn == nil {
+		return nil
+	}
+	err := store.activeTxn.Rollback()
+	store.activeTxn = nil
+	store.notifier.discard()
+	return errors.Wrap(err, "Failed to roll back transaction in postgres")
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(...interface{}) error
+}
+
+// scanImage reads a row selected with postgresImageColumns into an Image and its ImageBuild
+func scanImage(row rowScanner) (*Image, *ImageBuild, error) {
+	var name, version string
+	var labels []byte
+	var ciBuildURL, ciJob sql.NullString
+	var ciNumber sql.NullInt64
+	var registryDigest, registryArchitecture sql.NullString
+	var registrySize, registryLayers sql.NullInt64
+	build := &ImageBuild{}
+	err := row.Scan(&name, &version, &build.Build, &build.StoredAt,
+		&build.Meta.GitCommit, &build.Meta.GitOrigin, &build.Meta.CreatedAt,
+		pq.Array(&build.Meta.GitTag), pq.Array(&build.Meta.GitAnnotation),
+		&labels, &ciBuildURL, &ciJob, &ciNumber, &build.Meta.SchemaVersion,
+		&registryDigest, &registrySize, &registryArchitecture, &registryLayers,
+		pq.Array(&build.Meta.Issues))
+	if err != nil {
+		return nil, nil, err
+	}
+	if labels != nil {
+		err = json.Unmarshal(labels, &build.Meta.Labels)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to read labels")
+		}
+	}
+	if ciBuildURL.Valid {
+		build.Meta.CI = &CIInfo{BuildURL: ciBuildURL.String, Job: ciJob.String, Number: int(ciNumber.Int64)}
+	}
+	if registryDigest.Valid {
+		build.Meta.Registry = &RegistryInfo{
+			Digest:       registryDigest.String,
+			Size:         registrySize.Int64,
+			Architecture: registryArchitecture.String,
+			Layers:       int(registryLayers.Int64),
+		}
+	}
+	if len(build.Meta.Issues) == 0 {
+		build.Meta.Issues = nil
+	}
+	build.Meta.Upgrade()
+	return &Image{Name: name + ":" + version, Meta: build.Meta}, build, nil
+}
+
+// likePrefix escapes LIKE wildcards in prefix and returns a pattern matching anything that begins with it
+func likePrefix(prefix string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return escaper.Replace(prefix) + "%"
+}
+
+// postgresArgs collects the arguments of a query built from several conditions
+type postgresArgs []interface{}
+
+// add appends value to the arguments and returns its placeholder
+func (args *postgresArgs) add(value interface{}) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// keyPrefixConditions returns the conditions on versions v joined to images i matching every
+// NAME:VERSION that begins with prefix. They compare the name and version columns rather
+// than the joined key, so the pattern indexes on them can be used
+func keyPrefixConditions(prefix string, args *postgresArgs) []string {
+	if sep := strings.Index(prefix, ":"); sep >= 0 {
+		return []string{
+			"i.name = " + args.add(prefix[:sep]),
+			"v.version LIKE " + args.add(likePrefix(prefix[sep+1:])),
+		}
+	}
+	return []string{"i.name LIKE " + args.add(likePrefix(prefix))}
+}
+
+// isUniqueViolation returns true if err was caused by a unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == postgresUniqueViolation
+}
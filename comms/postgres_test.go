@@ -0,0 +1,151 @@
+package comms
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// newTestPostgresStorage returns a PostgresStorage on the database at $GZR_TEST_POSTGRES_URL,
+// skipping the test when it isn't set. Every table is emptied first
+func newTestPostgresStorage(t *testing.T) GzrMetadataStore {
+	url := os.Getenv("GZR_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("GZR_TEST_POSTGRES_URL not set")
+	}
+	config := viper.New()
+	config.Set("url", url)
+	store, err := NewPostgresStorage(config)
+	if err != nil {
+		t.Fatalf("Failed to create postgres storage: %s", err)
+	}
+	_, err = store.(*PostgresStorage).db.Exec(`TRUNCATE images, versions, tags, annotations, labels, issues`)
+	if err != nil {
+		t.Fatalf("Failed to truncate tables: %s", err)
+	}
+	return store
+}
+
+func TestLikePrefix_EscapesWildcards(t *testing.T) {
+	if pattern := likePrefix(`repo/my_app%`); pattern != `repo/my\_app\%%` {
+		t.Errorf("Expected escaped pattern, but got %q", pattern)
+	}
+}
+
+func TestSplitKey_RequiresColon(t *testing.T) {
+	if _, _, err := splitKey("repo/app"); err == nil {
+		t.Error("Expected an error for a key without a version")
+	}
+	name, version, err := splitKey("repo/app:1")
+	if err != nil || name != "repo/app" || version != "1" {
+		t.Errorf("Expected repo/app and 1, but got %q, %q and %v", name, version, err)
+	}
+}
+
+func TestKeyPrefixConditions_UseNameAndVersionColumns(t *testing.T) {
+	var args postgresArgs
+	conditions := keyPrefixConditions("repo/app:2017_", &args)
+	if strings.Join(conditions, " AND ") != "i.name = $1 AND v.version LIKE $2" {
+		t.Errorf("Expected conditions on the name and version, but got %q", conditions)
+	}
+	if !reflect.DeepEqual([]interface{}(args), []interface{}{"repo/app", `2017\_%`}) {
+		t.Errorf("Expected the name and an escaped version pattern, but got %q", args)
+	}
+
+	args = nil
+	conditions = keyPrefixConditions("repo/ap", &args)
+	if strings.Join(conditions, " AND ") != "i.name LIKE $1" || args[0] != "repo/ap%" {
+		t.Errorf("Expected a name pattern, but got %q with %q", conditions, args)
+	}
+}
+
+func TestPostgresStorage_StoreAndGet(t *testing.T) {
+	store := newTestPostgresStorage(t)
+	defer store.Cleanup()
+
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "aaa", GitTag: []string{"v1"}, CreatedAt: "2017-02-10T00:00:00Z"})
+	storeInTransaction(t, store, "repo/app:20170210", ImageMetadata{GitCommit: "bbb", GitTag: []string{"v1", "v2"}, CreatedAt: "2017-02-10T01:00:00Z"})
+	storeInTransaction(t, store, "repo/app:20170211", ImageMetadata{GitCommit: "ccc", CreatedAt: "2017-02-11T00:00:00Z"})
+
+	image, err := store.Get("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.GitCommit != "bbb" || len(image.Meta.GitTag) != 2 {
+		t.Errorf("Expected newest build with 2 tags, but found %+v", image.Meta)
+	}
+
+	history, err := store.History("repo/app:20170210")
+	if err != nil {
+		t.Fatalf("History errored with %s", err)
+	}
+	if len(history.Builds) != 2 {
+		t.Errorf("Expected 2 builds, but found %d", len(history.Builds))
+	}
+
+	images, err := store.List("repo/app", ListOptions{})
+	if err != nil {
+		t.Fatalf("List errored with %s", err)
+	}
+	if len(images.Images) != 2 {
+		t.Errorf("Expected 2 versions, but found %d", len(images.Images))
+	}
+
+	latest, err := store.GetLatest("repo/app")
+	if err != nil {
+		t.Fatalf("GetLatest errored with %s", err)
+	}
+	if latest.Name != "repo/app:20170211" {
+		t.Errorf("Expected latest to be %q, but found %q", "repo/app:20170211", latest.Name)
+	}
+}
+
+func TestPostgresStorage_List_PagesInQuery(t *testing.T) {
+	store := newTestPostgresStorage(t)
+	defer store.Cleanup()
+
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{CreatedAt: "2017-01-03T00:00:00Z", Labels: map[string]string{"team": "a"}})
+	storeInTransaction(t, store, "repo/app:10", ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z", Labels: map[string]string{"team": "a"}})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{CreatedAt: "2017-01-02T00:00:00Z", Labels: map[string]string{"team": "b"}})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{CreatedAt: "2017-01-04T00:00:00Z", Labels: map[string]string{"team": "a"}})
+	storeInTransaction(t, store, "repo/application:1", ImageMetadata{CreatedAt: "2017-01-05T00:00:00Z"})
+
+	cases := []struct {
+		prefix   string
+		opts     ListOptions
+		expected []string
+	}{
+		{"repo/app:", ListOptions{}, []string{"repo/app:1", "repo/app:10", "repo/app:2"}},
+		{"repo/app", ListOptions{}, []string{"repo/app:1", "repo/app:10", "repo/app:2", "repo/application:1"}},
+		{"repo/app:1", ListOptions{}, []string{"repo/app:1", "repo/app:10"}},
+		{"repo/app:", ListOptions{Sort: SortByCreatedAt}, []string{"repo/app:10", "repo/app:1", "repo/app:2"}},
+		{"repo/app", ListOptions{Sort: SortByCreatedAtDesc}, []string{"repo/application:1", "repo/app:2", "repo/app:1", "repo/app:10"}},
+		{"repo/app", ListOptions{Labels: map[string]string{"team": "a"}}, []string{"repo/app:1", "repo/app:10", "repo/app:2"}},
+	}
+	for _, c := range cases {
+		for _, limit := range []int{0, 1, 2} {
+			opts := c.opts
+			opts.Limit = limit
+			var names []string
+			for pages := 0; pages <= len(c.expected); pages++ {
+				page, err := store.List(c.prefix, opts)
+				if err != nil {
+					t.Fatalf("List errored with %s", err)
+				}
+				for _, image := range page.Images {
+					names = append(names, image.Name)
+				}
+				if page.Continue == "" {
+					break
+				}
+				opts.Continue = page.Continue
+			}
+			if !reflect.DeepEqual(names, c.expected) {
+				t.Errorf("Expected %q with %+v to list %q, but got %q", c.prefix, opts, c.expected, names)
+			}
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package comms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// dockerHubRegistry is the registry host of images that don't name one
+	dockerHubRegistry = "registry-1.docker.io"
+	// registryTimeout bounds every request made to a registry or its token service
+	registryTimeout = 30 * time.Second
+)
+
+// manifestMediaTypes are the manifest formats accepted from a registry, so it doesn't
+// fall back to converting images to the deprecated schema 1 manifest
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// challengeParam matches the key="value" parameters of a WWW-Authenticate challenge
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// ImageRegistry looks up images in a Docker registry
+type ImageRegistry interface {
+	// ImageExists returns true if the registry has a manifest for NAME:TAG or NAME@DIGEST
+	ImageExists(string) (bool, error)
+	// ManifestDigest returns the digest of the manifest of NAME:TAG or NAME@DIGEST
+	ManifestDigest(string) (string, error)
+	// ListTags returns every tag of a repository
+	ListTags(string) ([]string, error)
+	// ImageConfig returns the registry data, labels and creation time of NAME:TAG or NAME@DIGEST
+	ImageConfig(string) (*ImageConfig, error)
+}
+
+// ImageConfig is what a registry knows about a pushed image from its manifest and config blob
+type ImageConfig struct {
+	// Registry is the image's manifest digest, compressed size, architecture and layer count
+	Registry *RegistryInfo
+	// Labels are the labels the image was built with
+	Labels map[string]string
+	// Created is the time the image was built, as recorded in its config
+	Created string
+}
+
+// registryManifest is the part of an image manifest, or of a manifest list, that gzr reads
+type registryManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+		Size   int64  `json:"size"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// registryImageConfig is the part of an image config blob that gzr reads
+type registryImageConfig struct {
+	Architecture string `json:"architecture"`
+	Created      string `json:"created"`
+	Config       struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// RegistryClient implements ImageRegistry with the Docker Registry HTTP API v2
+type RegistryClient struct {
+	// Username and Password are sent to registries and token services that ask for credentials
+	Username string
+	Password string
+	// Insecure talks to registries over plain http instead of https
+	Insecure bool
+	client   *http.Client
+	// authorizations holds the Authorization header last accepted for each repository, so
+	// repeated requests aren't challenged again
+	authorizations map[string]string
+	lock           sync.Mutex
+}
+
+// imageReference is an image name split into the parts the registry API addresses
+type imageReference struct {
+	// Registry is the host[:port] of the registry
+	Registry string
+	// Repository is the name of the image in the registry
+	Repository string
+	// Reference is the tag or digest of the image
+	Reference string
+}
+
+// NewRegistryClient returns a RegistryClient using the credentials under "registry"
+// in the config file
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		Username: viper.GetString("registry.username"),
+		Password: viper.GetString("registry.password"),
+		Insecure: viper.GetBool("registry.insecure"),
+		client:   &http.Client{Timeout: registryTimeout},
+	}
+}
+
+// parseImageReference splits an image name such as registry.example.com:5000/team/app:1,
+// team/app@sha256:... or app into its registry, repository and tag or digest. Images
+// without a registry host are on Docker Hub, and images without a tag are "latest"
+func parseImageReference(image string) (*imageReference, error) {
+	ref := &imageReference{Registry: dockerHubRegistry, Reference: "latest"}
+	name := image
+	if at := strings.Index(name, "@"); at >= 0 {
+		name, ref.Reference = name[:at], name[at+1:]
+	} else if sep := strings.LastIndex(name, ":"); sep > strings.LastIndex(name, "/") {
+		name, ref.Reference = name[:sep], name[sep+1:]
+	}
+	if slash := strings.Index(name, "/"); slash >= 0 {
+		host := name[:slash]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, name = host, name[slash+1:]
+		}
+	}
+	if ref.Registry == "docker.io" {
+		ref.Registry = dockerHubRegistry
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || ref.Reference == "" {
+		return nil, errors.Errorf("%q is not a valid image name", image)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// ImageExists returns true if the registry has a manifest for the image
+func (c *RegistryClient) ImageExists(image string) (bool, error) {
+	_, err := c.ManifestDigest(image)
+	if errors.Cause(err) == ErrImageNotInRegistry {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ManifestDigest returns the digest of the image's manifest from a HEAD request, or
+// ErrImageNotInRegistry when the registry doesn't have it
+func (c *RegistryClient) ManifestDigest(image string) (string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.fetch("HEAD", ref, "manifests/"+ref.Reference, image)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("Docker-Content-Digest"), nil
+}
+
+// ImageConfig reads the image's manifest and config blob. For a multi-platform manifest
+// list, the linux/amd64 image is read, or the first one when there isn't one
+func (c *RegistryClient) ImageConfig(image string) (*ImageConfig, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &registryManifest{}
+	digest, err := c.fetchJSON(ref, "manifests/"+ref.Reference, image, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) > 0 {
+		platform := manifest.Manifests[0].Digest
+		for _, entry := range manifest.Manifests {
+			if entry.Platform.OS == "linux" && entry.Platform.Architecture == "amd64" {
+				platform = entry.Digest
+				break
+			}
+		}
+		manifest = &registryManifest{}
+		_, err = c.fetchJSON(ref, "manifests/"+platform, image, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return nil, errors.Errorf("Manifest of %q has no config blob", image)
+	}
+
+	config := &registryImageConfig{}
+	_, err = c.fetchJSON(ref, "blobs/"+manifest.Config.Digest, image, config)
+	if err != nil {
+		return nil, err
+	}
+	info := &RegistryInfo{
+		Digest:       digest,
+		Size:         manifest.Config.Size,
+		Architecture: config.Architecture,
+		Layers:       len(manifest.Layers),
+	}
+	for _, layer := range manifest.Layers {
+		info.Size += layer.Size
+	}
+	return &ImageConfig{Registry: info, Labels: config.Config.Labels, Created: config.Created}, nil
+}
+
+// ListTags returns every tag of a repository, following the registry's pages
+func (c *RegistryClient) ListTags(repository string) ([]string, error) {
+	ref, err := parseImageReference(repository)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	next := c.url(ref, fmt.Sprintf("/v2/%s/tags/list", ref.Repository))
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create tag list request for %q", repository)
+		}
+		res, err := c.do(req, ref)
+		if err != nil {
+			return nil, err
+		}
+		page := struct {
+			Tags []string `json:"tags"`
+		}{}
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			return nil, errors.Wrapf(ErrImageNotInRegistry, "%q", repository)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, errors.Errorf("Registry %s responded %s for the tags of %q", ref.Registry, res.Status, repository)
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode the tags of %q", repository)
+		}
+		tags = append(tags, page.Tags...)
+		next, err = nextPage(req.URL, res.Header.Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// url returns the URL of path on the image's registry
+func (c *RegistryClient) url(ref *imageReference, path string) string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, ref.Registry, path)
+}
+
+// fetch sends a request for a manifest or blob of the image's repository, returning
+// ErrImageNotInRegistry when the registry doesn't have it
+func (c *RegistryClient) fetch(method string, ref *imageReference, path string, image string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(ref, fmt.Sprintf("/v2/%s/%s", ref.Repository, path)), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create request for %q", image)
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	res, err := c.do(req, ref)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errors.Wrapf(ErrImageNotInRegistry, "%q", image)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("Registry %s responded %s for %s of %q", ref.Registry, res.Status, path, image)
+	}
+	return res, nil
+}
+
+// fetchJSON decodes a manifest or blob of the image's repository into v, returning
+// the digest the registry sent for it
+func (c *RegistryClient) fetchJSON(ref *imageReference, path string, image string, v interface{}) (string, error) {
+	res, err := c.fetch("GET", ref, path, image)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to decode %s of %q", path, image)
+	}
+	return res.Header.Get("Docker-Content-Digest"), nil
+}
+
+// httpClient returns the client requests are sent with
+func (c *RegistryClient) httpClient() *http.Client {
+	if c.client == nil {
+		return http.DefaultClient
+	}
+	return c.client
+}
+
+// do sends a request to the registry. When the registry challenges it for credentials,
+// the request is sent again with basic auth or a bearer token pulling the image's repository
+func (c *RegistryClient) do(req *http.Request, ref *imageReference) (*http.Response, error) {
+	repository := ref.Registry + "/" + ref.Repository
+	c.lock.Lock()
+	if authorization := c.authorizations[repository]; authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	c.lock.Unlock()
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to reach registry %s", ref.Registry)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	res.Body.Close()
+
+	authorization, err := c.authorize(res.Header.Get("WWW-Authenticate"), ref)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	res, err = c.httpClient().Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to reach registry %s", ref.Registry)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return nil, errors.Errorf("Registry %s refused the credentials for %q", ref.Registry, ref.Repository)
+	}
+	c.lock.Lock()
+	if c.authorizations == nil {
+		c.authorizations = make(map[string]string)
+	}
+	c.authorizations[repository] = authorization
+	c.lock.Unlock()
+	return res, nil
+}
+
+// authorize answers a WWW-Authenticate challenge with the value of an Authorization header
+func (c *RegistryClient) authorize(challenge string, ref *imageReference) (string, error) {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	switch scheme {
+	case "basic":
+		if c.Username == "" {
+			return "", errors.Errorf("Registry %s requires registry.username and registry.password in the config file", ref.Registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)), nil
+	case "bearer":
+		token, err := c.token(params, ref)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", errors.Errorf("Registry %s asked for unsupported authentication %q", ref.Registry, challenge)
+	}
+}
+
+// token requests a bearer token from the token service named in a challenge's realm
+func (c *RegistryClient) token(params map[string]string, ref *imageReference) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", errors.Errorf("Registry %s sent a token challenge without a valid realm", ref.Registry)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+	}
+	query := realm.Query()
+	query.Set("scope", scope)
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create token request")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	log.WithFields(log.Fields{"realm": realm.Host, "scope": scope}).Debug("Requesting registry token")
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to reach token service %s", realm.Host)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Token service %s responded %s for %q", realm.Host, res.Status, scope)
+	}
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to decode token from %s", realm.Host)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.Errorf("Token service %s did not return a token", realm.Host)
+}
+
+// nextPage returns the URL in a Link header with rel="next", resolved against the
+// current page, or "" when it is the last page
+func nextPage(current *url.URL, link string) (string, error) {
+	if !strings.Contains(link, `rel="next"`) {
+		return "", nil
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return "", errors.Errorf("Registry sent a malformed Link header: %q", link)
+	}
+	next, err := current.Parse(link[start+1 : end])
+	if err != nil {
+		return "", errors.Wrapf(err, "Registry sent a malformed Link header: %q", link)
+	}
+	return next.String(), nil
+}
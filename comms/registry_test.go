@@ -0,0 +1,211 @@
+package comms
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const testManifestDigest = "sha256:4d9f4e7ab1b1bf4d5f0e9ba1c2a3f0d6a87e5a49ed5b9b4a6a7c8d9e0f1a2b3c"
+
+// newTestRegistry returns a stand-in registry holding team/app:1 and team/app:2, which
+// challenges requests without a bearer token from its own token service
+func newTestRegistry(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "gzr" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+			t.Errorf("Expected pull scope for team/app, but found %q", r.URL.Query().Get("scope"))
+		}
+		fmt.Fprint(w, `{"token": "abc"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:team/app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/1", "/v2/team/app/manifests/" + testManifestDigest:
+			w.Header().Set("Docker-Content-Digest", testManifestDigest)
+		case "/v2/team/app/manifests/multi":
+			w.Header().Set("Docker-Content-Digest", "sha256:1111")
+			fmt.Fprint(w, `{"manifests": [
+				{"digest": "sha256:2222", "platform": {"architecture": "arm64", "os": "linux"}},
+				{"digest": "sha256:3333", "platform": {"architecture": "amd64", "os": "linux"}}
+			]}`)
+		case "/v2/team/app/manifests/sha256:3333":
+			w.Header().Set("Docker-Content-Digest", "sha256:3333")
+			fmt.Fprint(w, `{"config": {"digest": "sha256:cccc", "size": 100}, "layers": [{"size": 1000}, {"size": 2000}]}`)
+		case "/v2/team/app/blobs/sha256:cccc":
+			fmt.Fprint(w, `{"architecture": "amd64", "created": "2017-02-10T17:11:56.386791234Z",
+				"config": {"Labels": {"org.opencontainers.image.revision": "aaa"}}}`)
+		case "/v2/team/app/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/team/app/tags/list?last=1&n=1>; rel="next"`)
+				fmt.Fprint(w, `{"name": "team/app", "tags": ["1"]}`)
+				return
+			}
+			fmt.Fprint(w, `{"name": "team/app", "tags": ["2"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+// testRegistryHost returns the host[:port] images in the stand-in registry are named with
+func testRegistryHost(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestParseImageReference(t *testing.T) {
+	cases := []struct {
+		image    string
+		expected imageReference
+	}{
+		{"nginx", imageReference{dockerHubRegistry, "library/nginx", "latest"}},
+		{"team/app:1", imageReference{dockerHubRegistry, "team/app", "1"}},
+		{"docker.io/team/app:1", imageReference{dockerHubRegistry, "team/app", "1"}},
+		{"localhost/app", imageReference{"localhost", "app", "latest"}},
+		{"registry.example.com:5000/team/app:1", imageReference{"registry.example.com:5000", "team/app", "1"}},
+		{"registry.example.com:5000/team/app", imageReference{"registry.example.com:5000", "team/app", "latest"}},
+		{"team/app@sha256:aaaa", imageReference{dockerHubRegistry, "team/app", "sha256:aaaa"}},
+	}
+	for _, c := range cases {
+		ref, err := parseImageReference(c.image)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", c.image, err)
+			continue
+		}
+		if *ref != c.expected {
+			t.Errorf("Expected %+v for %q, but found %+v", c.expected, c.image, *ref)
+		}
+	}
+
+	if _, err := parseImageReference("app:"); err == nil {
+		t.Error("Expected an image with an empty tag to be rejected")
+	}
+}
+
+func TestRegistryClient_ManifestDigest(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	client := &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+
+	digest, err := client.ManifestDigest(testRegistryHost(server) + "/team/app:1")
+	if err != nil {
+		t.Fatalf("ManifestDigest errored with %s", err)
+	}
+	if digest != testManifestDigest {
+		t.Errorf("Expected digest %q, but found %q", testManifestDigest, digest)
+	}
+
+	_, err = client.ManifestDigest(testRegistryHost(server) + "/team/app:3")
+	if errors.Cause(err) != ErrImageNotInRegistry {
+		t.Errorf("Expected ErrImageNotInRegistry for a missing tag, but got %v", err)
+	}
+}
+
+func TestRegistryClient_ImageExists(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	client := &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+
+	exists, err := client.ImageExists(testRegistryHost(server) + "/team/app@" + testManifestDigest)
+	if err != nil || !exists {
+		t.Errorf("Expected image pinned by digest to exist, but got %v, %v", exists, err)
+	}
+	exists, err = client.ImageExists(testRegistryHost(server) + "/team/app:3")
+	if err != nil || exists {
+		t.Errorf("Expected missing image not to exist, but got %v, %v", exists, err)
+	}
+
+	client = &RegistryClient{Username: "gzr", Password: "wrong", Insecure: true}
+	_, err = client.ImageExists(testRegistryHost(server) + "/team/app:1")
+	if err == nil {
+		t.Error("Expected refused credentials to be an error, not a missing image")
+	}
+}
+
+func TestRegistryClient_ListTags(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	client := &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+
+	tags, err := client.ListTags(testRegistryHost(server) + "/team/app")
+	if err != nil {
+		t.Fatalf("ListTags errored with %s", err)
+	}
+	if strings.Join(tags, ",") != "1,2" {
+		t.Errorf("Expected tags from both pages, but found %v", tags)
+	}
+}
+
+func TestRegistryClient_BasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "gzr" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer server.Close()
+	client := &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+
+	exists, err := client.ImageExists(testRegistryHost(server) + "/team/app:1")
+	if err != nil || !exists {
+		t.Errorf("Expected image behind basic auth to exist, but got %v, %v", exists, err)
+	}
+}
+
+// TestRegistryClient_LocalRegistry runs against a registry container at $GZR_TEST_REGISTRY,
+// e.g. localhost:5000 from `docker run -p 5000:5000 registry:2`, with $GZR_TEST_REGISTRY_IMAGE
+// pushed to it
+func TestRegistryClient_LocalRegistry(t *testing.T) {
+	host := os.Getenv("GZR_TEST_REGISTRY")
+	image := os.Getenv("GZR_TEST_REGISTRY_IMAGE")
+	if host == "" || image == "" {
+		t.Skip("GZR_TEST_REGISTRY and GZR_TEST_REGISTRY_IMAGE not set")
+	}
+	client := &RegistryClient{Insecure: true}
+
+	exists, err := client.ImageExists(host + "/" + image)
+	if err != nil || !exists {
+		t.Errorf("Expected %s to exist in %s, but got %v, %v", image, host, exists, err)
+	}
+	exists, err = client.ImageExists(host + "/gzr-missing-image:missing")
+	if err != nil || exists {
+		t.Errorf("Expected missing image not to exist in %s, but got %v, %v", host, exists, err)
+	}
+}
+
+func TestRegistryClient_ImageConfig(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	client := &RegistryClient{Username: "gzr", Password: "secret", Insecure: true}
+
+	config, err := client.ImageConfig(testRegistryHost(server) + "/team/app:multi")
+	if err != nil {
+		t.Fatalf("ImageConfig errored with %s", err)
+	}
+	expected := RegistryInfo{Digest: "sha256:1111", Size: 3100, Architecture: "amd64", Layers: 2}
+	if *config.Registry != expected {
+		t.Errorf("Expected registry info %+v, but found %+v", expected, *config.Registry)
+	}
+	if config.Labels[OCIRevisionLabel] != "aaa" || config.Created != "2017-02-10T17:11:56.386791234Z" {
+		t.Errorf("Expected labels and creation time from the config blob, but found %+v", config)
+	}
+}
@@ -0,0 +1,149 @@
+package comms
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/slice"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy describes which stored images to keep. An image is kept when any
+// enabled rule matches it; images referenced by live Deployments are always kept
+type RetentionPolicy struct {
+	// KeepLast keeps the newest N versions of every image name. Disabled when 0
+	KeepLast int
+	// KeepDays keeps every image created within the last N days. Disabled when 0
+	KeepDays int
+	// KeepTagged keeps every image built from a commit with a git tag
+	KeepTagged bool
+}
+
+// RetentionDecision is the outcome of a RetentionPolicy for a single image
+type RetentionDecision struct {
+	// Image is the image the decision is about
+	Image *Image
+	// Keep is true when the image must not be collected
+	Keep bool
+	// Reason explains why the image is kept or collected
+	Reason string
+}
+
+// Enabled returns true if the policy has any rule that can keep an image
+func (policy *RetentionPolicy) Enabled() bool {
+	return policy.KeepLast > 0 || policy.KeepDays > 0 || policy.KeepTagged
+}
+
+// Evaluate decides for every image whether it is kept. deployed holds the references of images
+// used by live workloads, which match an image by its NAME:VERSION or by its NAME@DIGEST, and
+// now is the time KeepDays counts back from
+func (policy *RetentionPolicy) Evaluate(images []*Image, deployed map[string]bool, now time.Time) []*RetentionDecision {
+	byName := make(map[string][]*Image)
+	var names []string
+	for _, image := range images {
+		// keys that aren't NAME:VERSION are kept to themselves
+		name, _, err := splitKey(image.Name)
+		if err != nil {
+			name = image.Name
+		}
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], image)
+	}
+
+	var decisions []*RetentionDecision
+	cutoff := now.AddDate(0, 0, -policy.KeepDays)
+	for _, name := range names {
+		versions := byName[name]
+		slice.Sort(versions, func(i, j int) bool {
+			return versions[j].Meta.CreatedAt < versions[i].Meta.CreatedAt
+		})
+		for index, image := range versions {
+			decision := &RetentionDecision{Image: image, Keep: true}
+			createdAt, parseErr := time.Parse(time.RFC3339, image.Meta.CreatedAt)
+			switch {
+			case isDeployed(image, deployed):
+				decision.Reason = "currently deployed"
+			case policy.KeepTagged && len(image.Meta.GitTag) > 0:
+				decision.Reason = "tagged"
+			case policy.KeepLast > 0 && index < policy.KeepLast:
+				decision.Reason = fmt.Sprintf("one of the last %d versions", policy.KeepLast)
+			case policy.KeepDays > 0 && parseErr != nil:
+				decision.Reason = fmt.Sprintf("created-at %q can't be compared", image.Meta.CreatedAt)
+			case policy.KeepDays > 0 && createdAt.After(cutoff):
+				decision.Reason = fmt.Sprintf("newer than %d days", policy.KeepDays)
+			default:
+				decision.Keep = false
+				decision.Reason = "matched no retention rule"
+			}
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions
+}
+
+// isDeployed returns true if deployed references image by its NAME:VERSION or by the
+// registry digest it was pushed with
+func isDeployed(image *Image, deployed map[string]bool) bool {
+	if deployed[image.Name] {
+		return true
+	}
+	digest := image.DigestReference()
+	return digest != "" && deployed[digest]
+}
+
+// CollectGarbage evaluates policy against every image in store and deletes the ones that
+// aren't kept in a single transaction, unless dryRun is set. Since Delete works on name
+// prefixes, an image is left in place if deleting it would also remove a kept image.
+// On etcd the deletions are made in a single Txn, so none of them are made if it fails,
+// and collecting many images at once may need etcd's --max-txn-ops raised.
+// It returns every decision made and the number of images deleted
+func CollectGarbage(store GzrMetadataStore, policy *RetentionPolicy, deployed map[string]bool, dryRun bool) ([]*RetentionDecision, int, error) {
+	if !policy.Enabled() {
+		return nil, 0, errors.New("No retention rules are configured")
+	}
+	images, err := store.ListAll()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to list images")
+	}
+	decisions := policy.Evaluate(images.Images, deployed, time.Now())
+
+	kept := make(map[string]bool)
+	for _, decision := range decisions {
+		if decision.Keep {
+			kept[decision.Image.Name] = true
+		}
+	}
+	for _, decision := range decisions {
+		if other := deletesOther(decision.Image.Name, kept); !decision.Keep && other != "" {
+			decision.Keep = true
+			decision.Reason = fmt.Sprintf("deleting it would also delete %q", other)
+		}
+	}
+	if dryRun {
+		return decisions, 0, nil
+	}
+
+	err = store.StartTransaction()
+	if err != nil {
+		return decisions, 0, errors.Wrap(err, "Failed to start transaction")
+	}
+	deleted := 0
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		count, err := store.Delete(decision.Image.Name)
+		if err != nil {
+			store.RollbackTransaction()
+			return decisions, 0, errors.Wrapf(err, "Failed to delete %q", decision.Image.Name)
+		}
+		deleted += count
+	}
+	err = store.CommitTransaction()
+	if err != nil {
+		return decisions, 0, errors.Wrap(err, "Failed to commit transaction")
+	}
+	return decisions, deleted, nil
+}
@@ -0,0 +1,89 @@
+package comms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy_Evaluate(t *testing.T) {
+	now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	images := []*Image{
+		{Name: "repo/app:1", Meta: ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z"}},
+		{Name: "repo/app:2", Meta: ImageMetadata{CreatedAt: "2017-01-02T00:00:00Z", GitTag: []string{"v1.0.0"}}},
+		{Name: "repo/app:3", Meta: ImageMetadata{CreatedAt: "2017-01-03T00:00:00Z"}},
+		{Name: "repo/app:4", Meta: ImageMetadata{CreatedAt: "2017-02-27T00:00:00Z"}},
+		{Name: "repo/app:5", Meta: ImageMetadata{CreatedAt: "2017-02-28T00:00:00Z"}},
+		{Name: "repo/other:1", Meta: ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z"}},
+	}
+	policy := &RetentionPolicy{KeepLast: 1, KeepDays: 7, KeepTagged: true}
+	deployed := map[string]bool{"repo/app:1": true}
+
+	expected := map[string]bool{
+		"repo/app:1":   true,  // deployed
+		"repo/app:2":   true,  // tagged
+		"repo/app:3":   false, // old and untagged
+		"repo/app:4":   true,  // newer than 7 days
+		"repo/app:5":   true,  // last version
+		"repo/other:1": true,  // last version of its name
+	}
+	decisions := policy.Evaluate(images, deployed, now)
+	if len(decisions) != len(images) {
+		t.Fatalf("Expected %d decisions, but got %d", len(images), len(decisions))
+	}
+	for _, decision := range decisions {
+		if decision.Keep != expected[decision.Image.Name] {
+			t.Errorf("Expected keep=%t for %q, but got keep=%t (%s)", expected[decision.Image.Name], decision.Image.Name, decision.Keep, decision.Reason)
+		}
+	}
+}
+
+func TestRetentionPolicy_Evaluate_KeyWithoutVersion(t *testing.T) {
+	images := []*Image{{Name: "repo/app", Meta: ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z"}}}
+	decisions := (&RetentionPolicy{KeepLast: 1}).Evaluate(images, nil, time.Now())
+	if len(decisions) != 1 || !decisions[0].Keep {
+		t.Errorf("Expected the image to be kept as the last of its name, but got %+v", decisions)
+	}
+}
+
+func TestRetentionPolicy_Evaluate_DeployedByDigest(t *testing.T) {
+	images := []*Image{
+		{Name: "repo/app:1", Meta: ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z", Registry: &RegistryInfo{Digest: "sha256:abc"}}},
+		{Name: "repo/app:2", Meta: ImageMetadata{CreatedAt: "2017-01-02T00:00:00Z"}},
+		{Name: "repo/app:3", Meta: ImageMetadata{CreatedAt: "2017-01-03T00:00:00Z"}},
+	}
+	deployed := map[string]bool{"repo/app@sha256:abc": true}
+	decisions := (&RetentionPolicy{KeepLast: 1}).Evaluate(images, deployed, time.Now())
+	for _, decision := range decisions {
+		expected := decision.Image.Name != "repo/app:2"
+		if decision.Keep != expected {
+			t.Errorf("Expected keep=%t for %q, but got keep=%t (%s)", expected, decision.Image.Name, decision.Keep, decision.Reason)
+		}
+	}
+}
+
+func TestCollectGarbage_KeepsPrefixedImages(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:1", ImageMetadata{CreatedAt: "2017-01-01T00:00:00Z"})
+	storeInTransaction(t, store, "repo/app:10", ImageMetadata{CreatedAt: "2017-01-10T00:00:00Z"})
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{CreatedAt: "2017-01-02T00:00:00Z"})
+
+	policy := &RetentionPolicy{KeepLast: 1}
+	_, deleted, err := CollectGarbage(store, policy, nil, false)
+	if err != nil {
+		t.Fatalf("CollectGarbage errored with %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected only repo/app:2 to be deleted, but deleted %d", deleted)
+	}
+	if image, _ := store.Get("repo/app:10"); image == nil {
+		t.Error("Expected repo/app:10 to be kept")
+	}
+}
+
+func TestCollectGarbage_RequiresRules(t *testing.T) {
+	_, _, err := CollectGarbage(&MockStore{}, &RetentionPolicy{}, nil, true)
+	if err == nil {
+		t.Error("Expected CollectGarbage to refuse to run without retention rules")
+	}
+}
@@ -0,0 +1,254 @@
+package comms
+
+import (
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	ErrRevisionNotFound  = e.New("Requested revision couldn't be found in the deployment's history")
+	ErrRevisionIsCurrent = e.New("Requested revision is the one the deployment already runs")
+)
+
+// revisionAnnotation is the annotation k8s numbers a Deployment and its ReplicaSets' revisions with
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// DeploymentRevision is one revision of a Deployment's Pod template, kept by k8s in the ReplicaSet it
+// created for the revision
+type DeploymentRevision struct {
+	Revision   int64  `json:"revision"`
+	ReplicaSet string `json:"replica_set"`
+	// CreatedAt is when the revision's ReplicaSet was created
+	CreatedAt time.Time `json:"created_at"`
+	// Current is true for the revision the Deployment runs
+	Current    bool                `json:"current"`
+	Containers []RevisionContainer `json:"containers"`
+
+	// template is the revision's Pod template, restored by a rollback
+	template corev1.PodTemplateSpec
+}
+
+// RevisionContainer is a container in a revision's Pod template
+type RevisionContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Meta is the metadata stored for the image, or nil if the store has none
+	Meta *ImageMetadata `json:"metadata,omitempty"`
+}
+
+// DeploymentRevisionList is a Deployment's revision history, oldest revision first
+type DeploymentRevisionList struct {
+	Deployment string                `json:"deployment"`
+	Revisions  []*DeploymentRevision `json:"revisions"`
+}
+
+// Rollback describes a Deployment rolled back from one revision to another
+type Rollback struct {
+	Deployment string              `json:"deployment"`
+	From       *DeploymentRevision `json:"from"`
+	To         *DeploymentRevision `json:"to"`
+}
+
+// ListRevisions returns the revision history of the named Deployment, read from the ReplicaSets it owns
+func (k *K8sConnection) ListRevisions(deploymentName string) (*DeploymentRevisionList, error) {
+	gd, err := k.GetDeployment(deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(gd.Spec.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the selector of deployment %q", deploymentName)
+	}
+	opts := metav1.ListOptions{LabelSelector: selector.String()}
+	namespace := k.GetNamespace()
+
+	var replicaSets []metav1.Object
+	var templates []corev1.PodTemplateSpec
+	if k.served[appsV1GroupVersion] {
+		list, err := k.clientset.AppsV1().ReplicaSets(namespace).List(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list replica sets of deployment %q", deploymentName)
+		}
+		for i := range list.Items {
+			replicaSets = append(replicaSets, &list.Items[i])
+			templates = append(templates, list.Items[i].Spec.Template)
+		}
+	} else {
+		list, err := k.clientset.ExtensionsV1beta1().ReplicaSets(namespace).List(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list replica sets of deployment %q", deploymentName)
+		}
+		for i := range list.Items {
+			replicaSets = append(replicaSets, &list.Items[i])
+			templates = append(templates, list.Items[i].Spec.Template)
+		}
+	}
+
+	current := revisionNumber(&gd.ObjectMeta)
+	revisions := &DeploymentRevisionList{Deployment: deploymentName}
+	for i, replicaSet := range replicaSets {
+		owner := metav1.GetControllerOf(replicaSet)
+		if owner == nil || owner.UID != gd.ObjectMeta.UID {
+			continue
+		}
+		revision := &DeploymentRevision{
+			Revision:   revisionNumber(replicaSet),
+			ReplicaSet: replicaSet.GetName(),
+			CreatedAt:  replicaSet.GetCreationTimestamp().Time,
+			template:   templates[i],
+		}
+		revision.Current = revision.Revision == current
+		for _, container := range templates[i].Spec.Containers {
+			revision.Containers = append(revision.Containers, RevisionContainer{Name: container.Name, Image: container.Image})
+		}
+		revisions.Revisions = append(revisions.Revisions, revision)
+	}
+	sort.Slice(revisions.Revisions, func(i, j int) bool {
+		return revisions.Revisions[i].Revision < revisions.Revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+// RollbackDeployment restores the named Deployment's Pod template to the one it had at target,
+// a revision returned by ListRevisions. Rolling back to the current revision is refused. Like
+// kubectl rollout undo, only the template is replaced, with a JSON patch
+func (k *K8sConnection) RollbackDeployment(deploymentName string, target *DeploymentRevision) (*GzrDeployment, error) {
+	if target.Current {
+		return nil, errors.Wrapf(ErrRevisionIsCurrent, "revision %d of deployment %q", target.Revision, deploymentName)
+	}
+	template := target.template
+	// the ReplicaSet's hash label isn't part of the Deployment's template
+	template.Labels = map[string]string{}
+	for key, value := range target.template.Labels {
+		if key != "pod-template-hash" {
+			template.Labels[key] = value
+		}
+	}
+
+	object, err := k.getObject(KindDeployment, deploymentName)
+	if apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(ErrDeploymentNotFound, "%q", deploymentName)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get deployment %q in namespace %q", deploymentName, k.GetNamespace())
+	}
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "replace", "path": "/spec/template", "value": template},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create patch for deployment %q", deploymentName)
+	}
+	object, err = k.patchObject(object, types.JSONPatchType, patch)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to roll back deployment %q to revision %d", deploymentName, target.Revision)
+	}
+	return newGzrDeployment(object)
+}
+
+// revisionNumber returns the revision k8s annotated the object with, or 0 if it has none
+func revisionNumber(object metav1.Object) int64 {
+	revision, err := strconv.ParseInt(object.GetAnnotations()[revisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// Find returns the revision with the given number, or nil if the history doesn't have it
+func (rl *DeploymentRevisionList) Find(revision int64) *DeploymentRevision {
+	for _, r := range rl.Revisions {
+		if r.Revision == revision {
+			return r
+		}
+	}
+	return nil
+}
+
+// Current returns the revision the Deployment runs, or nil if it isn't in the history
+func (rl *DeploymentRevisionList) Current() *DeploymentRevision {
+	for _, r := range rl.Revisions {
+		if r.Current {
+			return r
+		}
+	}
+	return nil
+}
+
+// Previous returns the newest revision the Deployment doesn't run, or nil if there is none
+func (rl *DeploymentRevisionList) Previous() *DeploymentRevision {
+	for i := len(rl.Revisions) - 1; i >= 0; i-- {
+		if !rl.Revisions[i].Current {
+			return rl.Revisions[i]
+		}
+	}
+	return nil
+}
+
+// String returns the revision number and the images it ran
+func (r *DeploymentRevision) String() string {
+	description := fmt.Sprintf("revision %d", r.Revision)
+	for _, container := range r.Containers {
+		description += fmt.Sprintf(" %s", container.Image)
+		if container.Meta != nil && container.Meta.GitCommit != "" {
+			description += fmt.Sprintf(" (commit %s)", container.Meta.GitCommit)
+		}
+	}
+	return description
+}
+
+// SerializeForCLI writes every revision in the history to the io.Writer, oldest first
+func (rl *DeploymentRevisionList) SerializeForCLI(wr io.Writer) error {
+	return errors.Wrapf(revisionsCLITemplate.Execute(wr, rl), "Failed to serialize history of deployment %q", rl.Deployment)
+}
+
+// revisionsCLITemplate is the template used for displaying a DeploymentRevisionList in the CLI
+var revisionsCLITemplate = template.Must(template.New("Revisions CLI").Parse(`Deployment: {{.Deployment}}
+{{range .Revisions}}-------------------------
+Revision: {{.Revision}}{{if .Current}} (current){{end}}
+  - created:     {{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}
+  - replica set: {{.ReplicaSet}}
+  - containers: {{range .Containers}}
+    --name:   {{.Name}}
+    --image:  {{.Image}}{{with .Meta}}
+    --commit: {{.GitCommit}}{{if .GitTag}}
+    --tags:   {{range $i, $tag := .GitTag}}{{if $i}}, {{end}}{{$tag}}{{end}}{{end}}{{if .GitOrigin}}
+    --origin: {{.GitOrigin}}{{end}}{{else}}
+    --commit: unknown, image isn't in the metadata store{{end}}
+{{end}}
+{{end}}`))
+
+// SerializeForWire returns a JSON representation of the DeploymentRevisionList
+func (rl *DeploymentRevisionList) SerializeForWire() ([]byte, error) {
+	data, err := json.Marshal(rl)
+	return data, errors.Wrap(err, "Failed to convert deployment history to json")
+}
+
+// SerializeForCLI writes the revisions the Deployment was rolled back from and to
+func (rb *Rollback) SerializeForCLI(wr io.Writer) error {
+	return errors.Wrap(rollbackCLITemplate.Execute(wr, rb), "Failed to serialize rollback")
+}
+
+// rollbackCLITemplate is the template used for displaying a Rollback in the CLI
+var rollbackCLITemplate = template.Must(template.New("Rollback CLI").Parse(`Rolled back deployment {{.Deployment}}
+  - from: {{if .From}}{{.From}}{{else}}unknown revision{{end}}
+  - to:   {{.To}}
+`))
+
+// SerializeForWire returns a JSON representation of the Rollback
+func (rb *Rollback) SerializeForWire() ([]byte, error) {
+	data, err := json.Marshal(rb)
+	return data, errors.Wrap(err, "Failed to convert rollback to json")
+}
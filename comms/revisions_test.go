@@ -0,0 +1,209 @@
+package comms
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestRevisions returns a Deployment "web" at revision 3 and the ReplicaSets of revisions 1 to 3,
+// running images repo/app:1 to repo/app:3, plus a ReplicaSet another Deployment owns
+func newTestRevisions() []runtime.Object {
+	controller := true
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "web-uid", Annotations: map[string]string{revisionAnnotation: "3"}},
+		Spec:       appsv1.DeploymentSpec{Selector: selector, Template: testPodTemplate()},
+	}
+	deployment.Spec.Template.Spec.Containers[0].Image = "repo/app:3"
+	objects := []runtime.Object{deployment}
+	for _, revision := range []string{"1", "2", "3", "other"} {
+		owner := metav1.OwnerReference{Name: "web", UID: "web-uid", Controller: &controller}
+		if revision == "other" {
+			owner.UID = "other-uid"
+		}
+		template := testPodTemplate()
+		template.Labels = map[string]string{"app": "web", "pod-template-hash": "hash" + revision}
+		template.Spec.Containers[0].Image = "repo/app:" + revision
+		objects = append(objects, &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-" + revision,
+				Namespace:       "default",
+				Labels:          template.Labels,
+				Annotations:     map[string]string{revisionAnnotation: revision},
+				OwnerReferences: []metav1.OwnerReference{owner},
+			},
+			Spec: appsv1.ReplicaSetSpec{Selector: selector, Template: template},
+		})
+	}
+	return objects
+}
+
+func TestK8sConnection_ListRevisions(t *testing.T) {
+	k := newTestK8sConnection(t, []string{"apps/v1"}, newTestRevisions()...)
+
+	revisions, err := k.ListRevisions("web")
+	if err != nil {
+		t.Fatalf("Expected the revisions of web, but got %s", err)
+	}
+	if len(revisions.Revisions) != 3 {
+		t.Fatalf("Expected the 3 revisions web owns, but got %v", revisions.Revisions)
+	}
+	for i, revision := range revisions.Revisions {
+		if revision.Revision != int64(i+1) || revision.Containers[0].Image != "repo/app:"+revision.ReplicaSet[4:] {
+			t.Errorf("Expected revision %d in order with its image, but got %v", i+1, revision)
+		}
+	}
+	if revisions.Current().Revision != 3 || revisions.Previous().Revision != 2 {
+		t.Errorf("Expected revision 3 to be current and 2 previous, but got %v and %v", revisions.Current(), revisions.Previous())
+	}
+}
+
+func TestK8sConnection_RollbackDeployment(t *testing.T) {
+	k := newTestK8sConnection(t, []string{"apps/v1"}, newTestRevisions()...)
+	revisions, err := k.ListRevisions("web")
+	if err != nil {
+		t.Fatalf("Expected the revisions of web, but got %s", err)
+	}
+
+	gd, err := k.RollbackDeployment("web", revisions.Find(1))
+	if err != nil {
+		t.Fatalf("Expected web to roll back, but got %s", err)
+	}
+	template := gd.Spec.Template
+	if template.Spec.Containers[0].Image != "repo/app:1" {
+		t.Errorf("Expected revision 1's image repo/app:1, but got %v", template.Spec.Containers)
+	}
+	if _, ok := template.Labels["pod-template-hash"]; ok || template.Labels["app"] != "web" {
+		t.Errorf("Expected the template labels without the ReplicaSet hash, but got %v", template.Labels)
+	}
+
+	listed := 0
+	for _, action := range k.clientset.(*fake.Clientset).Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "replicasets" {
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("Expected the ReplicaSets to be listed once, but they were listed %d times", listed)
+	}
+
+	_, err = k.RollbackDeployment("web", revisions.Find(3))
+	if errors.Cause(err) != ErrRevisionIsCurrent {
+		t.Errorf("Expected ErrRevisionIsCurrent, but got %v", err)
+	}
+}
+
+func TestDeployer_Revisions(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{GitCommit: "bbb"})
+	deployer := NewDeployer(&MockK8sCommunicator{
+		OnListRevisions: func(name string) (*DeploymentRevisionList, error) {
+			return &DeploymentRevisionList{Deployment: name, Revisions: []*DeploymentRevision{
+				{Revision: 1, Containers: []RevisionContainer{{Name: "app", Image: "nginx"}, {Name: "proxy", Image: "registry:5000/proxy:1"}}},
+				{Revision: 2, Current: true, Containers: []RevisionContainer{{Name: "app", Image: "repo/app:2"}, {Name: "proxy", Image: "registry:5000/proxy"}}},
+			}}, nil
+		},
+	}, store)
+
+	revisions, err := deployer.Revisions("web")
+	if err != nil {
+		t.Fatalf("Expected the revisions of web, but got %s", err)
+	}
+	for _, revision := range revisions.Revisions {
+		for _, container := range revision.Containers {
+			if stored := container.Image == "repo/app:2"; stored != (container.Meta != nil) {
+				t.Errorf("Expected metadata only for the stored repo/app:2, but %q has %+v", container.Image, container.Meta)
+			}
+		}
+	}
+}
+
+func TestDeployer_Rollback(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:2", ImageMetadata{GitCommit: "bbb"})
+	var rolledBackTo int64
+	deployer := NewDeployer(&MockK8sCommunicator{
+		OnListRevisions: func(name string) (*DeploymentRevisionList, error) {
+			return &DeploymentRevisionList{Deployment: name, Revisions: []*DeploymentRevision{
+				{Revision: 2, Containers: []RevisionContainer{{Name: "app", Image: "repo/app:2"}}},
+				{Revision: 3, Current: true, Containers: []RevisionContainer{{Name: "app", Image: "repo/app:3"}}},
+			}}, nil
+		},
+		OnRollbackDeployment: func(name string, revision *DeploymentRevision) (*GzrDeployment, error) {
+			rolledBackTo = revision.Revision
+			return &GzrDeployment{}, nil
+		},
+	}, store)
+
+	rollback, err := deployer.Rollback("web", 0)
+	if err != nil {
+		t.Fatalf("Expected web to roll back, but got %s", err)
+	}
+	if rolledBackTo != 2 || rollback.From.Revision != 3 || rollback.To.Revision != 2 {
+		t.Errorf("Expected a rollback from revision 3 to 2, but rolled back to %d with %+v", rolledBackTo, rollback)
+	}
+	if meta := rollback.To.Containers[0].Meta; meta == nil || meta.GitCommit != "bbb" {
+		t.Errorf("Expected revision 2 to have the stored commit bbb, but got %+v", meta)
+	}
+	if rollback.From.Containers[0].Meta != nil {
+		t.Errorf("Expected no metadata for the unstored repo/app:3, but got %+v", rollback.From.Containers[0].Meta)
+	}
+
+	_, err = deployer.Rollback("web", 1)
+	if errors.Cause(err) != ErrRevisionNotFound {
+		t.Errorf("Expected ErrRevisionNotFound, but got %v", err)
+	}
+
+	rolledBackTo = 0
+	_, err = deployer.Rollback("web", 3)
+	if errors.Cause(err) != ErrRevisionIsCurrent || rolledBackTo != 0 {
+		t.Errorf("Expected ErrRevisionIsCurrent without a rollback, but got %v and rolled back to %d", err, rolledBackTo)
+	}
+
+	deployer.imageStore = &MockStore{OnGet: func(string) (*Image, error) { return nil, errors.New("store is down") }}
+	rollback, err = deployer.Rollback("web", 2)
+	if err != nil || rolledBackTo != 2 {
+		t.Fatalf("Expected web to roll back while the store is down, but got %v and rolled back to %d", err, rolledBackTo)
+	}
+	if rollback.To.Containers[0].Meta != nil {
+		t.Errorf("Expected no metadata while the store is down, but got %+v", rollback.To.Containers[0].Meta)
+	}
+}
+
+func TestDeploymentRevisionList_SerializeForCLI(t *testing.T) {
+	revisions := &DeploymentRevisionList{Deployment: "web", Revisions: []*DeploymentRevision{
+		{Revision: 1, Containers: []RevisionContainer{{Name: "app", Image: "repo/app:1"}}},
+		{Revision: 2, Current: true, Containers: []RevisionContainer{{Name: "app", Image: "repo/app:2", Meta: &ImageMetadata{
+			GitCommit: "bbb",
+			GitTag:    []string{"v1.1.0", "stable"},
+			GitOrigin: "git@github.com:org/app.git",
+		}}}},
+	}}
+	var out bytes.Buffer
+	err := revisions.SerializeForCLI(&out)
+	if err != nil {
+		t.Fatalf("Expected the history to serialize, but got %s", err)
+	}
+	for _, expected := range []string{
+		"Revision: 1\n",
+		"commit: unknown",
+		"Revision: 2 (current)",
+		"commit: bbb",
+		"tags:   v1.1.0, stable",
+		"origin: git@github.com:org/app.git",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in %q", expected, out.String())
+		}
+	}
+}
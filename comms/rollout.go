@@ -0,0 +1,108 @@
+package comms
+
+import (
+	e "errors"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrProgressDeadlineExceeded = e.New("Deployment exceeded its progress deadline")
+	ErrRolloutTimeout           = e.New("Timed out waiting for the deployment to roll out")
+)
+
+// DefaultRolloutTimeout is how long to wait for a Deployment to roll out when no timeout is given
+const DefaultRolloutTimeout = 5 * time.Minute
+
+// progressDeadlineExceeded is the reason k8s gives the Progressing condition of a Deployment
+// whose rollout made no progress within its progressDeadlineSeconds
+const progressDeadlineExceeded = "ProgressDeadlineExceeded"
+
+// rolloutPollInterval is how often WaitForRollout checks the Deployment's status
+var rolloutPollInterval = 2 * time.Second
+
+// RolloutStatus describes how far a Deployment's rollout has progressed
+type RolloutStatus struct {
+	// Generation is the Deployment spec's generation, bumped by every update
+	Generation int64 `json:"generation"`
+	// ObservedGeneration is the generation the Deployment controller has acted on
+	ObservedGeneration int64 `json:"observed_generation"`
+	// Replicas is the number of Pods the Deployment wants
+	Replicas int32 `json:"replicas"`
+	// UpdatedReplicas is the number of Pods running the current Pod template
+	UpdatedReplicas int32 `json:"updated_replicas"`
+	// AvailableReplicas is the number of Pods ready for at least minReadySeconds
+	AvailableReplicas int32 `json:"available_replicas"`
+	// Message describes what the rollout is waiting for
+	Message string `json:"message"`
+	// Done is true once every Pod runs the current template and is available
+	Done bool `json:"done"`
+}
+
+// RolloutProgressFunc is called with a Deployment's status whenever its rollout progresses
+type RolloutProgressFunc func(RolloutStatus)
+
+// NewRolloutStatus returns the status of the Deployment's rollout, the same way kubectl rollout status
+// judges it. It returns ErrProgressDeadlineExceeded if k8s has given up on the rollout
+func NewRolloutStatus(gd *GzrDeployment) (RolloutStatus, error) {
+	status := RolloutStatus{
+		Generation:         gd.ObjectMeta.Generation,
+		ObservedGeneration: gd.Status.ObservedGeneration,
+		UpdatedReplicas:    gd.Status.UpdatedReplicas,
+		AvailableReplicas:  gd.Status.AvailableReplicas,
+	}
+	if gd.Spec.Replicas != nil {
+		status.Replicas = *gd.Spec.Replicas
+	}
+	name := gd.ObjectMeta.Name
+	if status.ObservedGeneration < status.Generation {
+		status.Message = fmt.Sprintf("Waiting for deployment %q spec update to be observed", name)
+		return status, nil
+	}
+	for _, condition := range gd.Status.Conditions {
+		if condition.Type == "Progressing" && condition.Reason == progressDeadlineExceeded {
+			status.Message = condition.Message
+			return status, errors.Wrapf(ErrProgressDeadlineExceeded, "%q", name)
+		}
+	}
+	switch {
+	case status.UpdatedReplicas < status.Replicas:
+		status.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated", name, status.UpdatedReplicas, status.Replicas)
+	case gd.Status.Replicas > status.UpdatedReplicas:
+		status.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination", name, gd.Status.Replicas-status.UpdatedReplicas)
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		status.Message = fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available", name, status.AvailableReplicas, status.UpdatedReplicas)
+	default:
+		status.Message = fmt.Sprintf("Deployment %q successfully rolled out", name)
+		status.Done = true
+	}
+	return status, nil
+}
+
+// WaitForRollout checks the Deployment's status until its rollout finishes, k8s reports that it
+// exceeded its progress deadline, or timeout passes. progress, if not nil, is called every time
+// the status message changes
+func (k *K8sConnection) WaitForRollout(deploymentName string, timeout time.Duration, progress RolloutProgressFunc) (*GzrDeployment, error) {
+	deadline := time.Now().Add(timeout)
+	var reported string
+	for {
+		gd, err := k.GetDeployment(deploymentName)
+		if err != nil {
+			return nil, err
+		}
+		status, err := NewRolloutStatus(gd)
+		if progress != nil && status.Message != reported {
+			reported = status.Message
+			progress(status)
+		}
+		if err != nil || status.Done {
+			return gd, err
+		}
+		if time.Now().After(deadline) {
+			return gd, errors.Wrapf(ErrRolloutTimeout, "%q after %s: %s", deploymentName, timeout, status.Message)
+		}
+		time.Sleep(rolloutPollInterval)
+	}
+}
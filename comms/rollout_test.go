@@ -0,0 +1,81 @@
+package comms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewRolloutStatus(t *testing.T) {
+	replicas := int32(3)
+	gd := &GzrDeployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Generation: 2},
+		Spec:       GzrDeploymentSpec{Replicas: &replicas},
+		Status:     GzrDeploymentStatus{ObservedGeneration: 1},
+	}
+	for _, step := range []struct {
+		status GzrDeploymentStatus
+		done   bool
+	}{
+		{GzrDeploymentStatus{ObservedGeneration: 1, Replicas: 3, UpdatedReplicas: 0, AvailableReplicas: 3}, false},
+		{GzrDeploymentStatus{ObservedGeneration: 2, Replicas: 4, UpdatedReplicas: 1, AvailableReplicas: 3}, false},
+		{GzrDeploymentStatus{ObservedGeneration: 2, Replicas: 4, UpdatedReplicas: 3, AvailableReplicas: 3}, false},
+		{GzrDeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, AvailableReplicas: 2}, false},
+		{GzrDeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, AvailableReplicas: 3}, true},
+	} {
+		gd.Status = step.status
+		status, err := NewRolloutStatus(gd)
+		if err != nil {
+			t.Fatalf("Expected no error for %+v, but got %s", step.status, err)
+		}
+		if status.Done != step.done || status.Message == "" {
+			t.Errorf("Expected done to be %v for %+v, but got %+v", step.done, step.status, status)
+		}
+	}
+
+	gd.Status.Conditions = []GzrDeploymentCondition{{Type: "Progressing", Status: corev1.ConditionFalse, Reason: progressDeadlineExceeded}}
+	_, err := NewRolloutStatus(gd)
+	if errors.Cause(err) != ErrProgressDeadlineExceeded {
+		t.Errorf("Expected ErrProgressDeadlineExceeded, but got %v", err)
+	}
+}
+
+func TestK8sConnection_WaitForRollout(t *testing.T) {
+	defer func(interval time.Duration) { rolloutPollInterval = interval }(rolloutPollInterval)
+	rolloutPollInterval = time.Millisecond
+	replicas := int32(1)
+	done := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "done", Namespace: "default", Generation: 1},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+	}
+	stuck := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "stuck", Namespace: "default", Generation: 2},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, AvailableReplicas: 1},
+	}
+	k := newTestK8sConnection(t, []string{"apps/v1"}, done, stuck)
+
+	var reported []RolloutStatus
+	_, err := k.WaitForRollout("done", time.Second, func(status RolloutStatus) { reported = append(reported, status) })
+	if err != nil {
+		t.Errorf("Expected the rolled out deployment to finish, but got %s", err)
+	}
+	if len(reported) != 1 || !reported[0].Done {
+		t.Errorf("Expected one finished status to be reported, but got %+v", reported)
+	}
+
+	reported = nil
+	_, err = k.WaitForRollout("stuck", 10*time.Millisecond, func(status RolloutStatus) { reported = append(reported, status) })
+	if errors.Cause(err) != ErrRolloutTimeout {
+		t.Errorf("Expected ErrRolloutTimeout, but got %v", err)
+	}
+	if len(reported) != 1 {
+		t.Errorf("Expected an unchanged status to be reported once, but got %+v", reported)
+	}
+}
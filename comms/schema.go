@@ -0,0 +1,208 @@
+package comms
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// CurrentSchemaVersion is the schema version of metadata documents written by gzr
+const CurrentSchemaVersion = 2
+
+// legacyCreatedAtLayouts are the ISO 8601 forms schema version 1 accepts for created-at,
+// which allowed leaving out the time zone
+var legacyCreatedAtLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+}
+
+// createdAtExamples shows a valid created-at for every metadata document version
+var createdAtExamples = map[int]string{
+	1: "2017-02-10T17:11:56.386791",
+	2: "2017-02-10T17:11:56Z",
+}
+
+// metadataSchemas holds the JSON Schema of every metadata document version
+var metadataSchemas = map[int]string{
+	1: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "gzr image metadata, schema version 1",
+  "description": "Documents without a schema-version are version 1",
+  "type": "object",
+  "properties": {
+    "schema-version": {"enum": [1]},
+    "git-commit": {"type": "string"},
+    "git-tag": {"type": ["array", "null"], "items": {"type": "string"}},
+    "git-annotation": {"type": ["array", "null"], "items": {"type": "string"}},
+    "git-origin": {"type": "string"},
+    "created-at": {
+      "type": "string",
+      "pattern": "^\\d{4}-\\d{2}-\\d{2}T\\d{2}:\\d{2}:\\d{2}(\\.\\d+)?(Z|[+-]\\d{2}:\\d{2})?$"
+    },
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+    "ci": {
+      "type": "object",
+      "properties": {
+        "build-url": {"type": "string"},
+        "job": {"type": "string"},
+        "number": {"type": "integer"}
+      },
+      "additionalProperties": false
+    },
+    "issues": {"type": "array", "items": {"type": "string"}}
+  },
+  "additionalProperties": false
+}`,
+	2: `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "gzr image metadata, schema version 2",
+  "description": "created-at must be RFC 3339 with a time zone",
+  "type": "object",
+  "required": ["schema-version", "git-commit", "created-at"],
+  "properties": {
+    "schema-version": {"enum": [2]},
+    "git-commit": {"type": "string", "minLength": 1},
+    "git-tag": {"type": ["array", "null"], "items": {"type": "string"}},
+    "git-annotation": {"type": ["array", "null"], "items": {"type": "string"}},
+    "git-origin": {"type": "string"},
+    "created-at": {
+      "type": "string",
+      "pattern": "^\\d{4}-\\d{2}-\\d{2}T\\d{2}:\\d{2}:\\d{2}(\\.\\d+)?(Z|[+-]\\d{2}:\\d{2})$"
+    },
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+    "ci": {
+      "type": "object",
+      "required": ["build-url"],
+      "properties": {
+        "build-url": {"type": "string", "minLength": 1},
+        "job": {"type": "string"},
+        "number": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    },
+    "issues": {"type": "array", "items": {"type": "string", "minLength": 1}},
+    "registry": {
+      "type": "object",
+      "required": ["digest"],
+      "properties": {
+        "digest": {"type": "string", "pattern": "^[a-z0-9]+:[a-f0-9]+$"},
+        "size": {"type": "integer", "minimum": 0},
+        "architecture": {"type": "string"},
+        "layers": {"type": "integer", "minimum": 0}
+      },
+      "additionalProperties": false
+    }
+  },
+  "additionalProperties": false
+}`,
+}
+
+// metadataUpgrades holds, at index i, the step that upgrades metadata from schema version i+1 to i+2
+var metadataUpgrades = []func(*ImageMetadata){
+	upgradeMetadataV1,
+}
+
+// MetadataSchema returns the JSON Schema of a metadata document version
+func MetadataSchema(version int) (string, error) {
+	schema, ok := metadataSchemas[version]
+	if !ok {
+		return "", errors.Errorf("Unsupported schema-version %d, must be between 1 and %d", version, CurrentSchemaVersion)
+	}
+	return schema, nil
+}
+
+// ValidateMetadata checks a raw metadata document against the schema of the version it
+// declares and returns that version. Every problem found is reported on its own line
+// along with the field it was found in
+func ValidateMetadata(document []byte) (int, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(document, &fields)
+	if err != nil {
+		return 0, errors.Wrap(err, "Metadata is not a JSON object")
+	}
+	version := 1
+	if declared, ok := fields["schema-version"]; ok {
+		number, isNumber := declared.(float64)
+		if !isNumber || number != float64(int(number)) {
+			return 0, errors.Errorf("schema-version: must be an integer, got %v", declared)
+		}
+		version = int(number)
+	}
+	schema, err := MetadataSchema(version)
+	if err != nil {
+		return 0, errors.Wrap(err, "schema-version")
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), gojsonschema.NewGoLoader(fields))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to validate against schema version %d", version)
+	}
+	var problems []string
+	for _, resultErr := range result.Errors() {
+		description := resultErr.Description()
+		if resultErr.Field() == "created-at" && resultErr.Type() == "pattern" {
+			description = fmt.Sprintf("%q is not a valid time, expected a form like %q", resultErr.Value(), createdAtExamples[version])
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", resultErr.Field(), description))
+	}
+	// The schema pattern can't tell that a month or hour is out of range
+	if createdAt, ok := fields["created-at"].(string); ok && result.Valid() {
+		if _, parseErr := parseCreatedAt(createdAt); parseErr != nil {
+			problems = append(problems, fmt.Sprintf("created-at: %q is not a valid time", createdAt))
+		}
+	}
+	if len(problems) > 0 {
+		return version, errors.Errorf("Metadata doesn't match schema version %d:\n  %s", version, strings.Join(problems, "\n  "))
+	}
+	return version, nil
+}
+
+// Upgrade brings metadata of an older schema version up to CurrentSchemaVersion.
+// Metadata without a schema version is version 1, and newer versions are left alone
+func (meta *ImageMetadata) Upgrade() {
+	if meta.SchemaVersion < 1 {
+		meta.SchemaVersion = 1
+	}
+	for meta.SchemaVersion < CurrentSchemaVersion {
+		metadataUpgrades[meta.SchemaVersion-1](meta)
+		meta.SchemaVersion += 1
+	}
+}
+
+// UnmarshalJSON decodes metadata and upgrades it to CurrentSchemaVersion, so
+// documents written by older versions of gzr read the same as new ones
+func (meta *ImageMetadata) UnmarshalJSON(data []byte) error {
+	type document ImageMetadata
+	err := json.Unmarshal(data, (*document)(meta))
+	if err != nil {
+		return err
+	}
+	meta.Upgrade()
+	return nil
+}
+
+// upgradeMetadataV1 rewrites created-at as RFC 3339, treating times without a zone as UTC.
+// Times that can't be parsed are left as they are
+func upgradeMetadataV1(meta *ImageMetadata) {
+	createdAt, err := parseCreatedAt(meta.CreatedAt)
+	if err == nil {
+		meta.CreatedAt = createdAt.Format(time.RFC3339Nano)
+	}
+}
+
+// parseCreatedAt parses any created-at accepted by a metadata schema version
+func parseCreatedAt(value string) (time.Time, error) {
+	var err error
+	for _, layout := range legacyCreatedAtLayouts {
+		var parsed time.Time
+		parsed, err = time.Parse(layout, value)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,81 @@
+package comms
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateMeta_ExampleDocuments(t *testing.T) {
+	for _, name := range []string{"image.example.json", "image.example.v0.json", "image.example.v1.1.json"} {
+		file, err := os.Open(filepath.Join("..", name))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %s", name, err)
+		}
+		meta, err := CreateMeta(file)
+		file.Close()
+		if err != nil {
+			t.Errorf("Expected %s to be valid, but got %s", name, err)
+			continue
+		}
+		if meta.SchemaVersion != CurrentSchemaVersion {
+			t.Errorf("Expected %s to be upgraded to schema version %d, but found %d", name, CurrentSchemaVersion, meta.SchemaVersion)
+		}
+	}
+}
+
+func TestCreateMeta_UpgradesLegacyCreatedAt(t *testing.T) {
+	meta, err := CreateMeta(bytes.NewBufferString(`{"git-commit": "abc", "created-at": "2017-02-10T17:11:56.386791"}`))
+	if err != nil {
+		t.Fatalf("CreateMeta errored with %s", err)
+	}
+	if meta.CreatedAt != "2017-02-10T17:11:56.386791Z" {
+		t.Errorf("Expected created-at to be upgraded to RFC 3339, but found %q", meta.CreatedAt)
+	}
+}
+
+func TestCreateMeta_ReportsFieldErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"schema-version": 2, "git-commit": "abc", "created-at": "2017-02-10T17:11:56"}`:                        "created-at",
+		`{"schema-version": 2, "git-commit": "abc", "created-at": "2017-13-10T17:11:56Z"}`:                       "created-at",
+		`{"schema-version": 2, "created-at": "2017-02-10T17:11:56Z"}`:                                            "git-commit",
+		`{"git-commit": "abc", "git-tag": [1]}`:                                                                  "git-tag.0",
+		`{"git-commit": "abc", "git-comit": "abc"}`:                                                              "git-comit",
+		`{"schema-version": 3, "git-commit": "abc"}`:                                                             "schema-version",
+		`{"schema-version": 2, "git-commit": "abc", "created-at": "2017-02-10T17:11:56Z", "ci": {"job": "app"}}`: "build-url",
+	}
+	for document, field := range cases {
+		_, err := CreateMeta(bytes.NewBufferString(document))
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", document)
+			continue
+		}
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected error for %s to mention %q, but got %s", document, field, err)
+		}
+	}
+}
+
+func TestFileStorage_Get_UpgradesStoredDocument(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	legacy := `{"name": "repo/app:1", "builds": [{"build": 1, "stored-at": "2017-02-10T17:11:56Z",
+		"metadata": {"git-commit": "abc", "created-at": "2017-02-10T17:11:56"}}]}`
+	os.MkdirAll(filepath.Join(dir, "repo", "app"), 0755)
+	err := ioutil.WriteFile(filepath.Join(dir, "repo", "app", "1.json"), []byte(legacy), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy document: %s", err)
+	}
+
+	image, err := store.Get("repo/app:1")
+	if err != nil {
+		t.Fatalf("Get errored with %s", err)
+	}
+	if image.Meta.SchemaVersion != CurrentSchemaVersion || image.Meta.CreatedAt != "2017-02-10T17:11:56Z" {
+		t.Errorf("Expected an upgraded document, but found %+v", image.Meta)
+	}
+}
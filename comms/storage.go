@@ -1,12 +1,15 @@
 package comms
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -16,8 +19,14 @@ import (
 type GzrMetadataStore interface {
 	// Store stores image metadata with a name
 	Store(string, ImageMetadata) error
-	// List lists all of the images under a name
-	List(string) (*ImageList, error)
+	// Import records builds copied from another store as the history of a NAME:VERSION that
+	// isn't stored, keeping their build numbers and store times. The last build becomes the
+	// image's current metadata
+	Import(string, []*ImageBuild) error
+	// List lists a page of the images under a name
+	List(string, ListOptions) (*ImageList, error)
+	// ListAll lists every image in the store
+	ListAll() (*ImageList, error)
 	// Cleanup allows the storage backend to clean up any connections, etc
 	Cleanup()
 	// Delete deletes all images under a nmae, returns number of deleted entries
@@ -30,6 +39,29 @@ type GzrMetadataStore interface {
 	StartTransaction() error
 	// CommitTransaction commits the active transaction
 	CommitTransaction() error
+	// RollbackTransaction discards every operation in the active transaction
+	RollbackTransaction() error
+	// History gets every stored build of a single image with a version, oldest first
+	History(string) (*ImageHistory, error)
+	// Find gets every image, across all names, with a build matching the query
+	Find(ImageQuery) (*ImageList, error)
+	// Watch streams the store and delete events for images whose name begins with a prefix
+	// until the context is done, when the returned channel is closed
+	Watch(context.Context, string) (<-chan *ImageEvent, error)
+}
+
+// ImageQuery describes the images to Find. Empty fields match anything, so
+// an image must match every field that is set
+type ImageQuery struct {
+	// GitCommit matches commits where either the query or the stored hash is a prefix
+	// of the other, so short and full hashes find each other
+	GitCommit string
+	// GitTag matches any one of the image's tags exactly
+	GitTag string
+	// GitOrigin matches the image's origin exactly
+	GitOrigin string
+	// Digest matches the image's registry manifest digest exactly
+	Digest string
 }
 
 // StorageTransaction is an interface to manage transactions around storage
@@ -49,6 +81,8 @@ type Image struct {
 
 // ImageMetadata is a struct containing necessary metadata about a particular image
 type ImageMetadata struct {
+	// SchemaVersion is the version of the document's schema, see MetadataSchema
+	SchemaVersion int `json:"schema-version,omitempty"`
 	// GitCommit is the commit related to the built image
 	GitCommit string `json:"git-commit"`
 	// GitTag is the tag related to the built image if it exists
@@ -59,11 +93,63 @@ type ImageMetadata struct {
 	GitOrigin string `json:"git-origin"`
 	// CreatedAt is the time the metadata was stored, with day granularity
 	CreatedAt string `json:"created-at"`
+	// Labels are free-form key/value pairs describing the image
+	Labels map[string]string `json:"labels,omitempty"`
+	// CI describes the CI build that produced the image, if there was one
+	CI *CIInfo `json:"ci,omitempty"`
+	// Issues are the IDs of issue tracker tickets related to the image
+	Issues []string `json:"issues,omitempty"`
+	// Registry describes the image as pushed to its registry, if gzr pushed it
+	Registry *RegistryInfo `json:"registry,omitempty"`
+}
+
+// RegistryInfo describes an image as pushed to its registry. Images with the same
+// Digest are the same artifact, whatever they are tagged as
+type RegistryInfo struct {
+	// Digest is the manifest digest of the pushed image, as sha256:HEX
+	Digest string `json:"digest"`
+	// Size is the size of the image in bytes
+	Size int64 `json:"size"`
+	// Architecture is the CPU architecture the image was built for
+	Architecture string `json:"architecture"`
+	// Layers is the number of layers in the image
+	Layers int `json:"layers"`
+}
+
+// CIInfo describes the CI build that produced an image
+type CIInfo struct {
+	// BuildURL is a link to the build in the CI system
+	BuildURL string `json:"build-url"`
+	// Job is the name of the CI job
+	Job string `json:"job"`
+	// Number is the build number within the job
+	Number int `json:"number"`
 }
 
 // ImageList is a collection of Images
 type ImageList struct {
 	Images []*Image `json:"images"`
+	// Continue is set when there are more images, and lists the next page when passed to List in ListOptions
+	Continue string `json:"continue,omitempty"`
+}
+
+// ImageBuild is a single build of an image recorded in the store. Every Store call
+// for a NAME:VERSION appends a new ImageBuild rather than replacing the last one
+type ImageBuild struct {
+	// Build is the sequence number of the build within its NAME:VERSION, starting at 1
+	Build int `json:"build"`
+	// StoredAt is the time the build was recorded in the store
+	StoredAt string `json:"stored-at"`
+	// Meta is the metadata stored with the build
+	Meta ImageMetadata `json:"metadata"`
+}
+
+// ImageHistory is the build history of a single NAME:VERSION
+type ImageHistory struct {
+	// Name is the image's full name
+	Name string `json:"name"`
+	// Builds are the stored builds, oldest first
+	Builds []*ImageBuild `json:"builds"`
 }
 
 // SerializeForCLI takes an io.Writer and writes templatized data to it representing an ImageList
@@ -80,11 +166,71 @@ func (l *ImageList) cliTemplate() *template.Template {
   -- git-annotation: [{{ range $index, $element := .Meta.GitAnnotation}}{{if $index}}, {{end}}{{$element}}{{end}}]
   -- git-origin: {{.Meta.GitOrigin}}
   -- created-at: {{.Meta.CreatedAt}}
+{{- if .Meta.Labels}}
+  -- labels: [{{ range $key, $value := .Meta.Labels}}{{$key}}={{$value}} {{end}}]
+{{- end}}
+{{- with .Meta.CI}}
+  -- ci: {{.Job}} #{{.Number}} {{.BuildURL}}
+{{- end}}
+{{- if .Meta.Issues}}
+  -- issues: [{{ range $index, $element := .Meta.Issues}}{{if $index}}, {{end}}{{$element}}{{end}}]
+{{- end}}
+{{- with .Meta.Registry}}
+  -- digest: {{.Digest}} ({{.Architecture}}, {{.Layers}} layers, {{.Size}} bytes)
+{{- end}}
 {{end}}
-`)
+{{- if .Continue}}More images, continue with --continue {{.Continue}}
+{{end}}`)
 	return t
 }
 
+// FilterByLabels returns the images in the list that have every one of labels
+func (l *ImageList) FilterByLabels(labels map[string]string) *ImageList {
+	filtered := &ImageList{}
+	for _, image := range l.Images {
+		if image.Meta.HasLabels(labels) {
+			filtered.Images = append(filtered.Images, image)
+		}
+	}
+	return filtered
+}
+
+// HasLabels returns true if the metadata has every key in labels set to the same value
+func (meta ImageMetadata) HasLabels(labels map[string]string) bool {
+	for key, value := range labels {
+		if actual, ok := meta.Labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabelSelectors turns KEY=VALUE strings into a map of labels
+func ParseLabelSelectors(selectors []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, selector := range selectors {
+		pair := strings.SplitN(selector, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, errors.Errorf("Label selector %q must be formatted as KEY=VALUE", selector)
+		}
+		labels[pair[0]] = pair[1]
+	}
+	return labels, nil
+}
+
+// DigestReference returns the NAME@DIGEST reference that pins the image to the exact
+// artifact that was pushed, or "" if its digest isn't known
+func (image *Image) DigestReference() string {
+	if image.Meta.Registry == nil || image.Meta.Registry.Digest == "" {
+		return ""
+	}
+	name, _, err := splitKey(image.Name)
+	if err != nil {
+		return ""
+	}
+	return name + "@" + image.Meta.Registry.Digest
+}
+
 // SerializeForWire returns a JSON representation of the ImageList
 func (imageList *ImageList) SerializeForWire() ([]byte, error) {
 	data, err := json.Marshal(imageList)
@@ -108,8 +254,41 @@ func (l *Image) cliTemplate() *template.Template {
 	return t
 }
 
+// SerializeForCLI takes an io.Writer and writes templatized data to it representing an ImageHistory
+func (h *ImageHistory) SerializeForCLI(wr io.Writer) error {
+	return h.cliTemplate().Execute(wr, h)
+}
+
+func (h *ImageHistory) cliTemplate() *template.Template {
+	t := template.New("ImageHistory")
+	t, _ = t.Parse(`History for {{.Name}} {{range .Builds}}
+- build: {{.Build}}
+  -- stored-at: {{.StoredAt}}
+  -- git-commit: {{.Meta.GitCommit}}
+  -- git-tag: [{{ range $index, $element := .Meta.GitTag}}{{if $index}}, {{end}}{{$element}}{{end}}]
+  -- created-at: {{.Meta.CreatedAt}}
+{{end}}
+`)
+	return t
+}
+
+// SerializeForWire returns a JSON representation of the ImageHistory
+func (h *ImageHistory) SerializeForWire() ([]byte, error) {
+	data, err := json.Marshal(h)
+	return data, errors.Wrap(err, "Failed to transform image history to JSON")
+}
+
+// newImageBuild returns an ImageBuild with the given sequence number, stamped with the current time
+func newImageBuild(build int, meta ImageMetadata) *ImageBuild {
+	return &ImageBuild{
+		Build:    build,
+		StoredAt: time.Now().Format(time.RFC3339),
+		Meta:     meta,
+	}
+}
+
 // CreateMeta takes a ReadWriter and returns an instance of ImageMetadata
-// after parsing
+// after validating it against its schema version and upgrading it to the current one
 func CreateMeta(reader io.ReadWriter) (ImageMetadata, error) {
 	var meta ImageMetadata
 	b, err := ioutil.ReadAll(reader)
@@ -117,6 +296,10 @@ func CreateMeta(reader io.ReadWriter) (ImageMetadata, error) {
 		return ImageMetadata{}, errors.Wrapf(err, "Could not read metadata file")
 	}
 
+	_, err = ValidateMetadata(b)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
 	err = json.Unmarshal(b, &meta)
 	if err != nil {
 		return ImageMetadata{}, errors.Wrapf(err, "Could not read metadata file: \nCheck the data types in your image metadata JSON.")
@@ -124,6 +307,122 @@ func CreateMeta(reader io.ReadWriter) (ImageMetadata, error) {
 	return meta, nil
 }
 
+// IsEmpty returns true if the query has no fields set
+func (query ImageQuery) IsEmpty() bool {
+	return query.GitCommit == "" && query.GitTag == "" && query.GitOrigin == "" && query.Digest == ""
+}
+
+// Matches returns true if meta matches every field set in the query
+func (query ImageQuery) Matches(meta ImageMetadata) bool {
+	if query.GitCommit != "" && !commitMatches(meta.GitCommit, query.GitCommit) {
+		return false
+	}
+	if query.GitOrigin != "" && meta.GitOrigin != query.GitOrigin {
+		return false
+	}
+	if query.Digest != "" && (meta.Registry == nil || meta.Registry.Digest != query.Digest) {
+		return false
+	}
+	if query.GitTag != "" {
+		for _, tag := range meta.GitTag {
+			if tag == query.GitTag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// commitMatches returns true if either hash is a prefix of the other
+func commitMatches(stored string, query string) bool {
+	return stored != "" && (strings.HasPrefix(stored, query) || strings.HasPrefix(query, stored))
+}
+
+// shortHashLength is the length of the hashes recorded by gzr build, which is
+// the longest commit prefix every stored hash can be found by
+const shortHashLength = 7
+
+// indexScanPrefix returns the index key prefix to scan for the most selective field
+// of the query. Every entry that can match is under it, but some under it may not match
+func indexScanPrefix(query ImageQuery) string {
+	switch {
+	case query.Digest != "":
+		return "digest/" + url.QueryEscape(query.Digest) + "/"
+	case query.GitCommit != "":
+		commit := query.GitCommit
+		if len(commit) > shortHashLength {
+			commit = commit[:shortHashLength]
+		}
+		return "commit/" + url.QueryEscape(commit)
+	case query.GitTag != "":
+		return "tag/" + url.QueryEscape(query.GitTag) + "/"
+	default:
+		return "origin/" + url.QueryEscape(query.GitOrigin) + "/"
+	}
+}
+
+// indexKeys returns the secondary index keys for meta stored under the NAME:VERSION key,
+// formatted as FIELD/ESCAPED_VALUE/KEY
+func indexKeys(key string, meta ImageMetadata) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(field string, value string) {
+		indexKey := fmt.Sprintf("%s/%s/%s", field, url.QueryEscape(value), key)
+		if value != "" && !seen[indexKey] {
+			seen[indexKey] = true
+			keys = append(keys, indexKey)
+		}
+	}
+	add("commit", meta.GitCommit)
+	for _, tag := range meta.GitTag {
+		add("tag", tag)
+	}
+	add("origin", meta.GitOrigin)
+	if meta.Registry != nil {
+		add("digest", meta.Registry.Digest)
+	}
+	return keys
+}
+
+// indexedKey returns the NAME:VERSION key an index key points at
+func indexedKey(indexKey string) string {
+	parts := strings.SplitN(indexKey, "/", 3)
+	return parts[len(parts)-1]
+}
+
+// findInHistory returns the image built by the newest build matching query, or nil if none match
+func findInHistory(history *ImageHistory, query ImageQuery) *Image {
+	for i := len(history.Builds) - 1; i >= 0; i-- {
+		if query.Matches(history.Builds[i].Meta) {
+			return &Image{Name: history.Name, Meta: history.Builds[i].Meta}
+		}
+	}
+	return nil
+}
+
+// findIndexed resolves the NAME:VERSION keys found in an index against the store's
+// histories, keeping only the images that really match. Stored images without a
+// history are checked against their current metadata
+func findIndexed(store GzrMetadataStore, keys []string, query ImageQuery) (*ImageList, error) {
+	seen := make(map[string]bool)
+	var images []*Image
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		builds, err := storedBuilds(store, &Image{Name: key})
+		if err != nil {
+			return nil, err
+		}
+		if image := findInHistory(&ImageHistory{Name: key, Builds: builds}, query); image != nil {
+			images = append(images, image)
+		}
+	}
+	return &ImageList{Images: images}, nil
+}
+
 // createKey creates the key used to tag data in stores
 func createKey(imageName string) (string, error) {
 	splitName := strings.Split(imageName, ":")
@@ -131,6 +430,30 @@ func createKey(imageName string) (string, error) {
 		return "", errors.New("IMAGE_NAME must be formatted as NAME:VERSION and must contain only the seperating colon")
 	}
 	name := fmt.Sprintf("%s:%s", splitName[0], splitName[1])
-	fmt.Println(name)
 	return name, nil
 }
+
+// splitKey splits a NAME:VERSION key into its name and version
+func splitKey(key string) (string, string, error) {
+	sep := strings.LastIndex(key, ":")
+	if sep < 0 {
+		return "", "", errors.Errorf("Key %q must be formatted as NAME:VERSION", key)
+	}
+	return key[:sep], key[sep+1:], nil
+}
+
+// deletesOther returns a name from names, other than name itself, that a prefix-based
+// Delete of name would also remove, or "" if there isn't one
+func deletesOther(name string, names map[string]bool) string {
+	for other := range names {
+		if other != name && strings.HasPrefix(other, name) {
+			return other
+		}
+	}
+	return ""
+}
+
+// buildKey zero-pads a build sequence number so keys sort in build order
+func buildKey(seq uint64) string {
+	return fmt.Sprintf("%010d", seq)
+}
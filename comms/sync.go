@@ -0,0 +1,89 @@
+package comms
+
+import (
+	"github.com/pkg/errors"
+)
+
+// SyncedImage is an image SyncRegistry created metadata for
+type SyncedImage struct {
+	// Name is the stored NAME:VERSION of the image
+	Name string
+	// Missing are the metadata fields that couldn't be inferred from the image
+	Missing []string
+}
+
+// SyncFailure is an image SyncRegistry couldn't create metadata for
+type SyncFailure struct {
+	// Name is the NAME:VERSION of the image
+	Name string
+	// Err is why the image couldn't be read or stored
+	Err error
+}
+
+// SyncReport is the outcome of SyncRegistry
+type SyncReport struct {
+	// Imported are the images metadata was created for
+	Imported []*SyncedImage
+	// Existing are the names of images that already had metadata
+	Existing []string
+	// Failed are the images that couldn't be read from the registry or stored
+	Failed []*SyncFailure
+}
+
+// SyncRegistry creates metadata in store for every tag of repository in registry that
+// isn't stored yet, inferring it from the OCI labels of the image. Every image is stored
+// in its own transaction, so images that can't be read are reported without stopping
+// the sync. With dryRun set nothing is stored
+func SyncRegistry(store GzrMetadataStore, registry ImageRegistry, repository string, dryRun bool) (*SyncReport, error) {
+	tags, err := registry.ListTags(repository)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list tags of %q", repository)
+	}
+	stored, err := store.List(repository, ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list stored images for %q", repository)
+	}
+	existing := make(map[string]bool)
+	for _, image := range stored.Images {
+		existing[image.Name] = true
+	}
+
+	report := &SyncReport{}
+	for _, tag := range tags {
+		name := repository + ":" + tag
+		if existing[name] {
+			report.Existing = append(report.Existing, name)
+			continue
+		}
+		config, err := registry.ImageConfig(name)
+		if err != nil {
+			report.Failed = append(report.Failed, &SyncFailure{Name: name, Err: err})
+			continue
+		}
+		meta, missing := MetadataFromLabels(config.Labels, config.Created)
+		meta.Registry = config.Registry
+		if !dryRun {
+			err = storeSynced(store, name, meta)
+			if err != nil {
+				report.Failed = append(report.Failed, &SyncFailure{Name: name, Err: err})
+				continue
+			}
+		}
+		report.Imported = append(report.Imported, &SyncedImage{Name: name, Missing: missing})
+	}
+	return report, nil
+}
+
+// storeSynced stores the metadata of a single image in its own transaction
+func storeSynced(store GzrMetadataStore, name string, meta ImageMetadata) error {
+	err := store.StartTransaction()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to start transaction for %q", name)
+	}
+	err = store.Store(name, meta)
+	if err != nil {
+		store.RollbackTransaction()
+		return errors.Wrapf(err, "Failed to store %q", name)
+	}
+	return errors.Wrapf(store.CommitTransaction(), "Failed to commit %q", name)
+}
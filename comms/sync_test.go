@@ -0,0 +1,94 @@
+package comms
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testRegistryImages are the images in the registry used by the sync tests
+var testRegistryImages = map[string]*ImageConfig{
+	"repo/app:1": {
+		Registry: &RegistryInfo{Digest: "sha256:1111"},
+		Labels: map[string]string{
+			OCIRevisionLabel: "aaa",
+			OCISourceLabel:   "https://github.com/bypasslane/app",
+			OCICreatedLabel:  "2017-02-10T17:11:56Z",
+		},
+	},
+	"repo/app:2": {
+		Registry: &RegistryInfo{Digest: "sha256:2222"},
+		Created:  "2017-02-11T10:00:00.5Z",
+	},
+	"repo/app:3": {
+		Registry: &RegistryInfo{Digest: "sha256:3333"},
+	},
+}
+
+func newTestSyncRegistry() *MockRegistry {
+	return &MockRegistry{
+		OnListTags: func(repository string) ([]string, error) {
+			return []string{"1", "2", "3", "4"}, nil
+		},
+		OnImageConfig: func(image string) (*ImageConfig, error) {
+			config, ok := testRegistryImages[image]
+			if !ok {
+				return nil, errors.New("manifest unknown")
+			}
+			return config, nil
+		},
+	}
+}
+
+func TestSyncRegistry(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+	storeInTransaction(t, store, "repo/app:3", ImageMetadata{GitCommit: "ccc"})
+
+	report, err := SyncRegistry(store, newTestSyncRegistry(), "repo/app", false)
+	if err != nil {
+		t.Fatalf("SyncRegistry errored with %s", err)
+	}
+	expected := []*SyncedImage{
+		{Name: "repo/app:1"},
+		{Name: "repo/app:2", Missing: []string{"git-commit", "git-origin"}},
+	}
+	if !reflect.DeepEqual(report.Imported, expected) {
+		t.Errorf("Expected imported %+v, but found %+v", expected, report.Imported)
+	}
+	if !reflect.DeepEqual(report.Existing, []string{"repo/app:3"}) {
+		t.Errorf("Expected repo/app:3 to already exist, but found %v", report.Existing)
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Name != "repo/app:4" {
+		t.Errorf("Expected repo/app:4 to fail, but found %+v", report.Failed)
+	}
+
+	image, err := store.Get("repo/app:1")
+	if err != nil || image == nil {
+		t.Fatalf("Expected repo/app:1 to be stored, but got %v, %v", image, err)
+	}
+	if image.Meta.GitCommit != "aaa" || image.Meta.CreatedAt != "2017-02-10T17:11:56Z" || image.DigestReference() != "repo/app@sha256:1111" {
+		t.Errorf("Expected metadata inferred from labels, but found %+v", image.Meta)
+	}
+	image, err = store.Get("repo/app:2")
+	if err != nil || image == nil || image.Meta.CreatedAt != "2017-02-11T10:00:00.5Z" {
+		t.Errorf("Expected repo/app:2 created at the image's creation time, but got %v, %v", image, err)
+	}
+}
+
+func TestSyncRegistry_DryRun(t *testing.T) {
+	store, cleanup := newTestBoltStorage(t)
+	defer cleanup()
+
+	report, err := SyncRegistry(store, newTestSyncRegistry(), "repo/app", true)
+	if err != nil {
+		t.Fatalf("SyncRegistry errored with %s", err)
+	}
+	if len(report.Imported) != 3 {
+		t.Errorf("Expected 3 images to be imported, but found %+v", report.Imported)
+	}
+	images, err := store.List("repo/app", ListOptions{})
+	if err != nil || len(images.Images) != 0 {
+		t.Errorf("Expected a dry run not to store anything, but found %v, %v", images, err)
+	}
+}
@@ -0,0 +1,142 @@
+package comms
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// DefaultTagTemplate is the tag given to images when "tag_templates" isn't configured
+const DefaultTagTemplate = "{{.Date}}.{{.ShortHash}}"
+
+// maxTagLength is the longest tag Docker accepts
+const maxTagLength = 128
+
+// invalidTagChars matches the characters Docker doesn't allow in a tag
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// semverTag matches git tags that are semantic versions, with or without a leading "v"
+var semverTag = regexp.MustCompile(`^v?(\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?)$`)
+
+// TagFields are the values available to the templates in "tag_templates"
+type TagFields struct {
+	// RepoName is the name of the git repository, which is also the image name
+	RepoName string
+	// Branch is the current git branch
+	Branch string
+	// ShortHash and Hash are the abbreviated and full hash of the current commit
+	ShortHash string
+	Hash      string
+	// Date is the build date as YYYYMMDD
+	Date string
+	// GitTag is the first git tag of the current commit, or "" if it has none
+	GitTag string
+	// SemVer is the first git tag of the current commit that is a semantic version,
+	// without its leading "v", or "" if there isn't one
+	SemVer string
+	// BuildNumber is the CI build number, or "" outside of CI
+	BuildNumber string
+}
+
+// NewTagFields collects the TagFields of the git repo in the current working directory
+// and the CI build running in it
+func NewTagFields(now time.Time) (TagFields, error) {
+	fields := TagFields{
+		Date:        now.Format("20060102"),
+		BuildNumber: os.Getenv("BUILD_NUMBER"),
+	}
+	gm := NewLocalGitManager()
+	var err error
+	fields.ShortHash, err = gm.CommitHash()
+	if err != nil {
+		return fields, errors.Wrap(err, "Failed to retrive git commit hash")
+	}
+	fields.Hash, err = gm.FullCommitHash()
+	if err != nil {
+		return fields, errors.Wrap(err, "Failed to retrive full git commit hash")
+	}
+	fields.RepoName, err = gm.RepoName()
+	if err != nil {
+		return fields, errors.Wrap(err, "Failed to retrive repository name from git")
+	}
+	fields.Branch, err = gm.Branch()
+	if err != nil {
+		return fields, errors.Wrap(err, "Failed to retrive git branch")
+	}
+	tags, _, err := gm.Tags()
+	if err != nil {
+		return fields, errors.Wrap(err, "Failed to get tags")
+	}
+	if len(tags) > 0 {
+		fields.GitTag = tags[0]
+	}
+	for _, tag := range tags {
+		if match := semverTag.FindStringSubmatch(tag); match != nil {
+			fields.SemVer = match[1]
+			break
+		}
+	}
+	return fields, nil
+}
+
+// RenderTags executes every tag template with fields. Characters Docker doesn't allow
+// in a tag are replaced with "-", and templates that render nothing, such as
+// "{{.GitTag}}" on a commit without a tag, are skipped along with repeated tags
+func RenderTags(templates []string, fields TagFields) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, text := range templates {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse tag template %q", text)
+		}
+		var rendered bytes.Buffer
+		err = tmpl.Execute(&rendered, fields)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to render tag template %q", text)
+		}
+		tag := strings.TrimLeft(invalidTagChars.ReplaceAllString(strings.TrimSpace(rendered.String()), "-"), ".-")
+		if len(tag) > maxTagLength {
+			tag = tag[:maxTagLength]
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("Tag templates rendered no tags")
+	}
+	return tags, nil
+}
+
+// GetDockerTags renders the configured "tag_templates", DefaultTagTemplate when there are
+// none, for the current git repo and returns the full repository/$REPO:TAG name of each.
+// The first name is the image's primary name
+func GetDockerTags() ([]string, error) {
+	templates := viper.GetStringSlice("tag_templates")
+	if len(templates) == 0 {
+		templates = []string{DefaultTagTemplate}
+	}
+	fields, err := NewTagFields(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	tags, err := RenderTags(templates, fields)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = fmt.Sprintf("%s/%s:%s", viper.GetString("repository"), fields.RepoName, tag)
+	}
+	return names, nil
+}
@@ -0,0 +1,59 @@
+package comms
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderTags(t *testing.T) {
+	fields := TagFields{
+		RepoName:    "gzr",
+		Branch:      "feature/tag-templates",
+		ShortHash:   "3b70356",
+		Hash:        "3b703566512e427a424e5c4348bc1c56abbf07fe",
+		Date:        "20170210",
+		GitTag:      "v1.2.0",
+		SemVer:      "1.2.0",
+		BuildNumber: "42",
+	}
+	templates := []string{DefaultTagTemplate, "{{.Branch}}-latest", "{{.SemVer}}", "{{.GitTag}}", "{{.Date}}.{{.ShortHash}}", "b{{.BuildNumber}}"}
+	tags, err := RenderTags(templates, fields)
+	if err != nil {
+		t.Fatalf("RenderTags errored with %s", err)
+	}
+	expected := []string{"20170210.3b70356", "feature-tag-templates-latest", "1.2.0", "v1.2.0", "b42"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected %v, but found %v", expected, tags)
+	}
+}
+
+func TestRenderTags_SkipsEmpty(t *testing.T) {
+	tags, err := RenderTags([]string{DefaultTagTemplate, "{{.GitTag}}"}, TagFields{Date: "20170210", ShortHash: "3b70356"})
+	if err != nil {
+		t.Fatalf("RenderTags errored with %s", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"20170210.3b70356"}) {
+		t.Errorf("Expected the empty git tag to be skipped, but found %v", tags)
+	}
+
+	_, err = RenderTags([]string{"{{.GitTag}}"}, TagFields{})
+	if err == nil {
+		t.Error("Expected an error when no template renders a tag")
+	}
+	_, err = RenderTags([]string{"{{.Missing}}"}, TagFields{})
+	if err == nil {
+		t.Error("Expected an error for a template using an unknown field")
+	}
+}
+
+func TestSemverTag(t *testing.T) {
+	for tag, expected := range map[string]string{"v1.2.3": "1.2.3", "1.2.3-rc.1": "1.2.3-rc.1", "release-1": "", "v1.2": ""} {
+		version := ""
+		if match := semverTag.FindStringSubmatch(tag); match != nil {
+			version = match[1]
+		}
+		if version != expected {
+			t.Errorf("Expected semver %q for tag %q, but found %q", expected, tag, version)
+		}
+	}
+}
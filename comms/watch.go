@@ -0,0 +1,94 @@
+package comms
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// watchBuffer is how many events a watcher can fall behind by before events are dropped
+const watchBuffer = 64
+
+// ImageEventType is what happened to an image in an ImageEvent
+type ImageEventType string
+
+const (
+	// ImageStored is sent when a build of an image is stored
+	ImageStored ImageEventType = "store"
+	// ImageDeleted is sent when an image is deleted
+	ImageDeleted ImageEventType = "delete"
+)
+
+// ImageEvent is a change to an image sent to the watchers of a GzrMetadataStore
+type ImageEvent struct {
+	// Type is what happened to the image
+	Type ImageEventType `json:"type"`
+	// Image is the stored image. Only its name is set for deletes
+	Image *Image `json:"image"`
+}
+
+// imageNotifier fans events out to in-process watchers, for stores without a native
+// way to watch for changes. The zero value is ready to use
+type imageNotifier struct {
+	mu       sync.Mutex
+	watchers map[chan *ImageEvent]string
+	// pending are the events of the active transaction, sent once it is committed
+	pending []*ImageEvent
+}
+
+// watch returns a channel of the events for images whose name begins with prefix,
+// which is closed once ctx is done
+func (notifier *imageNotifier) watch(ctx context.Context, prefix string) <-chan *ImageEvent {
+	events := make(chan *ImageEvent, watchBuffer)
+	notifier.mu.Lock()
+	if notifier.watchers == nil {
+		notifier.watchers = make(map[chan *ImageEvent]string)
+	}
+	notifier.watchers[events] = prefix
+	notifier.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		notifier.mu.Lock()
+		delete(notifier.watchers, events)
+		close(events)
+		notifier.mu.Unlock()
+	}()
+	return events
+}
+
+// queue holds an event until the active transaction is committed
+func (notifier *imageNotifier) queue(eventType ImageEventType, image *Image) {
+	notifier.mu.Lock()
+	notifier.pending = append(notifier.pending, &ImageEvent{Type: eventType, Image: image})
+	notifier.mu.Unlock()
+}
+
+// publish sends every queued event to the watchers interested in it. Events are
+// dropped for watchers that have fallen too far behind rather than blocking the store
+func (notifier *imageNotifier) publish() {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	for _, event := range notifier.pending {
+		for events, prefix := range notifier.watchers {
+			if !strings.HasPrefix(event.Image.Name, prefix) {
+				continue
+			}
+			select {
+			case events <- event:
+			default:
+				log.WithField("image", event.Image.Name).Warn("Dropped image event for slow watcher")
+			}
+		}
+	}
+	notifier.pending = nil
+}
+
+// discard drops the queued events of a rolled back transaction
+func (notifier *imageNotifier) discard() {
+	notifier.mu.Lock()
+	notifier.pending = nil
+	notifier.mu.Unlock()
+}
@@ -0,0 +1,237 @@
+package comms
+
+import (
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	batchv2alpha1 "k8s.io/api/batch/v2alpha1"
+	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var (
+	ErrWorkloadNotFound    = e.New("Requested workload couldn't be found")
+	ErrAmbiguousWorkload   = e.New("More than one kind of workload has the requested name, specify its kind")
+	ErrUnsupportedWorkload = e.New("Workload kind must be one of deployment, statefulset, daemonset or cronjob")
+)
+
+// WorkloadKind is a kind of k8s resource that runs Pods from a template gzr can update
+type WorkloadKind string
+
+const (
+	KindDeployment  WorkloadKind = "deployment"
+	KindStatefulSet WorkloadKind = "statefulset"
+	KindDaemonSet   WorkloadKind = "daemonset"
+	KindCronJob     WorkloadKind = "cronjob"
+)
+
+// WorkloadKinds is every kind of workload gzr manages, in the order they're listed
+var WorkloadKinds = []WorkloadKind{KindDeployment, KindStatefulSet, KindDaemonSet, KindCronJob}
+
+// ParseWorkloadKind returns the WorkloadKind named by value, which is case insensitive
+// and may be plural, so "Deployments" and "deployment" are the same kind
+func ParseWorkloadKind(value string) (WorkloadKind, error) {
+	name := strings.TrimSuffix(strings.ToLower(value), "s")
+	for _, kind := range WorkloadKinds {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+	return "", errors.Wrapf(ErrUnsupportedWorkload, "%q", value)
+}
+
+// WorkloadContainer is a container in a workload's Pod template
+type WorkloadContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// Workload is a Deployment, StatefulSet, DaemonSet or CronJob reduced to what gzr manages:
+// the containers of the Pod template it runs
+type Workload struct {
+	Kind      WorkloadKind `json:"kind"`
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace"`
+	// Replicas is the desired number of Pods, only set for Deployments and StatefulSets
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Schedule is the cron schedule, only set for CronJobs
+	Schedule   string              `json:"schedule,omitempty"`
+	Containers []WorkloadContainer `json:"containers"`
+}
+
+// WorkloadList is a collection of Workloads
+type WorkloadList struct {
+	Workloads []*Workload `json:"workloads"`
+}
+
+// WorkloadContainerInfo holds information about a workload sufficient for updating a Pod's container by name
+type WorkloadContainerInfo struct {
+	// Kind is the kind of the workload, or empty if only one kind has a workload called Name
+	Kind WorkloadKind
+	// Name is the name of the workload
+	Name string
+	// ContainerName is the name of a Pod's container in the workload's Pod template
+	ContainerName string
+	// Image is the name of the image (current or intended) for the container identified by ContainerName
+	Image string
+}
+
+// ListWorkloads returns the workloads of the given kind in the namespace, or of every kind if kind
+// is empty. Listing every kind skips kinds the cluster doesn't serve, such as alpha CronJobs
+func (k *K8sConnection) ListWorkloads(kind WorkloadKind) (*WorkloadList, error) {
+	kinds := WorkloadKinds
+	if kind != "" {
+		kinds = []WorkloadKind{kind}
+	}
+	list := &WorkloadList{}
+	for _, listKind := range kinds {
+		objects, err := k.listObjects(listKind)
+		if kind == "" && apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list %ss in namespace %q", listKind, k.GetNamespace())
+		}
+		for _, object := range objects {
+			list.Workloads = append(list.Workloads, newWorkload(listKind, object))
+		}
+	}
+	return list, nil
+}
+
+// GetWorkload returns the workload of the given kind and name. If kind is empty every kind
+// is searched, and the name must belong to exactly one of them
+func (k *K8sConnection) GetWorkload(kind WorkloadKind, name string) (*Workload, error) {
+	if kind != "" {
+		object, err := k.getObject(kind, name)
+		if apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(ErrWorkloadNotFound, "%s %q", kind, name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to get %s %q in namespace %q", kind, name, k.GetNamespace())
+		}
+		return newWorkload(kind, object), nil
+	}
+	var found *Workload
+	for _, kind := range WorkloadKinds {
+		workload, err := k.GetWorkload(kind, name)
+		if errors.Cause(err) == ErrWorkloadNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			return nil, errors.Wrapf(ErrAmbiguousWorkload, "%q is a %s and a %s", name, found.Kind, workload.Kind)
+		}
+		found = workload
+	}
+	if found == nil {
+		return nil, errors.Wrapf(ErrWorkloadNotFound, "%q", name)
+	}
+	return found, nil
+}
+
+// UpdateWorkload updates a container in the workload's Pod template to the image described by
+// wci after checking that the image exists in the registry. Use a Deployer to also check that
+// it exists in the metadata store
+func (k *K8sConnection) UpdateWorkload(wci *WorkloadContainerInfo) (*Workload, error) {
+	if wci.Kind == "" {
+		workload, err := k.GetWorkload("", wci.Name)
+		if err != nil {
+			return nil, err
+		}
+		resolved := *wci
+		resolved.Kind = workload.Kind
+		wci = &resolved
+	}
+	object, err := k.updateContainerImage(wci)
+	if err != nil {
+		return nil, err
+	}
+	return newWorkload(wci.Kind, object), nil
+}
+
+// newWorkload returns a Workload of the given kind for an object returned by getObject or listObjects
+func newWorkload(kind WorkloadKind, object runtime.Object) *Workload {
+	workload := &Workload{Kind: kind}
+	if meta, ok := object.(metav1.Object); ok {
+		workload.Name = meta.GetName()
+		workload.Namespace = meta.GetNamespace()
+	}
+	switch o := object.(type) {
+	case *appsv1.Deployment:
+		workload.Replicas = o.Spec.Replicas
+	case *v1beta1.Deployment:
+		workload.Replicas = o.Spec.Replicas
+	case *appsv1.StatefulSet:
+		workload.Replicas = o.Spec.Replicas
+	case *appsv1beta1.StatefulSet:
+		workload.Replicas = o.Spec.Replicas
+	case *batchV1CronJob:
+		workload.Schedule = o.Spec.Schedule
+	case *batchv1beta1.CronJob:
+		workload.Schedule = o.Spec.Schedule
+	case *batchv2alpha1.CronJob:
+		workload.Schedule = o.Spec.Schedule
+	}
+	for _, container := range podSpec(object).Containers {
+		workload.Containers = append(workload.Containers, WorkloadContainer{Name: container.Name, Image: container.Image})
+	}
+	return workload
+}
+
+// String returns the workload as KIND/NAME
+func (w *Workload) String() string {
+	return fmt.Sprintf("%s/%s", w.Kind, w.Name)
+}
+
+// SerializeForCLI takes an io.Writer and writes templatized data to it representing a Workload
+func (w *Workload) SerializeForCLI(wr io.Writer) error {
+	return errors.Wrapf(workloadCLITemplate.Execute(wr, w), "Failed to serialize %s", w)
+}
+
+// workloadCLITemplate is the template used for displaying a Workload in the CLI
+var workloadCLITemplate = template.Must(template.New("Workload CLI").Parse(`-------------------------
+{{.Kind}}: {{.Name}}{{if .Replicas}}
+  - replicas: {{.Replicas}}{{end}}{{if .Schedule}}
+  - schedule: {{.Schedule}}{{end}}
+  - containers: {{range .Containers}}
+    --name:  {{.Name}}
+    --image: {{.Image}}
+{{end}}
+`))
+
+// SerializeForWire returns a JSON representation of the Workload
+func (w *Workload) SerializeForWire() ([]byte, error) {
+	data, err := json.Marshal(w)
+	return data, errors.Wrap(err, "Failed to convert workload to json")
+}
+
+// SerializeForCLI writes every Workload in the list to the io.Writer
+func (wl *WorkloadList) SerializeForCLI(wr io.Writer) error {
+	for _, workload := range wl.Workloads {
+		err := workload.SerializeForCLI(wr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SerializeForWire returns a JSON representation of the WorkloadList
+func (wl *WorkloadList) SerializeForWire() ([]byte, error) {
+	data, err := json.Marshal(wl)
+	return data, errors.Wrap(err, "Failed to convert workload list to json")
+}
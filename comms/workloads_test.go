@@ -0,0 +1,172 @@
+package comms
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	batchv2alpha1 "k8s.io/api/batch/v2alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestParseWorkloadKind(t *testing.T) {
+	for value, expected := range map[string]WorkloadKind{
+		"deployment":   KindDeployment,
+		"StatefulSets": KindStatefulSet,
+		"daemonsets":   KindDaemonSet,
+		"CronJob":      KindCronJob,
+	} {
+		kind, err := ParseWorkloadKind(value)
+		if err != nil || kind != expected {
+			t.Errorf("Expected %q to parse as %q, but got %q and %v", value, expected, kind, err)
+		}
+	}
+	_, err := ParseWorkloadKind("replicaset")
+	if errors.Cause(err) != ErrUnsupportedWorkload {
+		t.Errorf("Expected ErrUnsupportedWorkload for replicaset, but got %v", err)
+	}
+}
+
+func TestNewWorkload_CronJob(t *testing.T) {
+	cronJob := &batchv2alpha1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "jobs"},
+	}
+	cronJob.Spec.Schedule = "0 3 * * *"
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers = []corev1.Container{{Name: "report", Image: "repo/report:1"}}
+
+	workload := newWorkload(KindCronJob, cronJob)
+	if workload.Kind != KindCronJob || workload.Name != "nightly" || workload.Namespace != "jobs" || workload.Schedule != "0 3 * * *" {
+		t.Errorf("Expected the CronJob's kind, name, namespace and schedule, but got %+v", workload)
+	}
+	if len(workload.Containers) != 1 || workload.Containers[0].Image != "repo/report:1" {
+		t.Errorf("Expected the CronJob's job template containers, but got %v", workload.Containers)
+	}
+
+	var out bytes.Buffer
+	err := workload.SerializeForCLI(&out)
+	if err != nil {
+		t.Fatalf("Expected the workload to serialize, but got %s", err)
+	}
+	if !strings.Contains(out.String(), "cronjob: nightly") || !strings.Contains(out.String(), "schedule: 0 3 * * *") {
+		t.Errorf("Expected the kind, name and schedule in %q", out.String())
+	}
+}
+
+func TestK8sConnection_setContainerImage(t *testing.T) {
+	k := &K8sConnection{registry: &MockRegistry{
+		OnImageExists: func(image string) (bool, error) { return image == "repo/app:2", nil },
+	}}
+	spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "sidecar", Image: "proxy:1"}, {Name: "app", Image: "repo/app:1"}}}
+
+	err := k.setContainerImage(spec, &WorkloadContainerInfo{ContainerName: "app", Image: "repo/app:2"})
+	if err != nil {
+		t.Fatalf("Expected the container image to be set, but got %s", err)
+	}
+	if spec.Containers[1].Image != "repo/app:2" || spec.Containers[0].Image != "proxy:1" {
+		t.Errorf("Expected only the app container to be updated, but got %v", spec.Containers)
+	}
+
+	err = k.setContainerImage(spec, &WorkloadContainerInfo{ContainerName: "app", Image: "repo/app:3"})
+	if errors.Cause(err) != ErrImageNotInRegistry {
+		t.Errorf("Expected ErrImageNotInRegistry, but got %v", err)
+	}
+	err = k.setContainerImage(spec, &WorkloadContainerInfo{ContainerName: "worker", Image: "repo/app:2"})
+	if errors.Cause(err) != ErrContainerNotFound {
+		t.Errorf("Expected ErrContainerNotFound, but got %v", err)
+	}
+}
+
+func TestServedGroupVersions_BatchV1CronJobs(t *testing.T) {
+	for resource, expected := range map[string]bool{"jobs": false, "cronjobs": true} {
+		discovery := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+		discovery.Resources = []*metav1.APIResourceList{
+			{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: resource}}},
+		}
+		served, err := servedGroupVersions(discovery)
+		if err != nil {
+			t.Fatalf("Failed to discover fake group versions: %s", err)
+		}
+		if served[batchV1CronJobs] != expected {
+			t.Errorf("Expected batch/v1 with %s to serve CronJobs: %t", resource, expected)
+		}
+	}
+}
+
+func TestK8sConnection_BatchV1CronJobs(t *testing.T) {
+	// timeZone is newer than the batch/v1beta1 type batch/v1 CronJobs are read into
+	stored := []byte(`{"apiVersion":"batch/v1","kind":"CronJob","metadata":{"name":"nightly","namespace":"jobs"},
+		"spec":{"schedule":"0 3 * * *","timeZone":"Europe/Berlin",
+		"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"report","image":"repo/report:1"}]}}}}}}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/apis/batch/v1/namespaces/jobs/cronjobs":
+			w.Write([]byte(`{"apiVersion":"batch/v1","kind":"CronJobList","items":[` + string(stored) + `]}`))
+		case r.Method == "GET" && r.URL.Path == "/apis/batch/v1/namespaces/jobs/cronjobs/nightly":
+			w.Write(stored)
+		case r.Method == "PATCH" && r.URL.Path == "/apis/batch/v1/namespaces/jobs/cronjobs/nightly":
+			patch, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get("Content-Type") != string(types.StrategicMergePatchType) {
+				t.Errorf("Expected a strategic merge patch, but got %q", r.Header.Get("Content-Type"))
+			}
+			stored, _ = strategicpatch.StrategicMergePatch(stored, patch, batchv1beta1.CronJob{})
+			w.Write(stored)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create clientset: %s", err)
+	}
+	k := &K8sConnection{
+		clientset: clientset,
+		namespace: "jobs",
+		served:    map[string]bool{batchV1GroupVersion: true, batchV1CronJobs: true, batchV1beta1GroupVersion: true},
+		registry:  &MockRegistry{OnImageExists: func(string) (bool, error) { return true, nil }},
+	}
+
+	list, err := k.ListWorkloads(KindCronJob)
+	if err != nil {
+		t.Fatalf("Expected batch/v1 CronJobs to list, but got %s", err)
+	}
+	if len(list.Workloads) != 1 || list.Workloads[0].Name != "nightly" || list.Workloads[0].Schedule != "0 3 * * *" {
+		t.Errorf("Expected the nightly CronJob, but got %+v", list.Workloads)
+	}
+
+	workload, err := k.UpdateWorkload(&WorkloadContainerInfo{Kind: KindCronJob, Name: "nightly", ContainerName: "report", Image: "repo/report:2"})
+	if err != nil {
+		t.Fatalf("Expected the CronJob to update, but got %s", err)
+	}
+	if workload.Containers[0].Image != "repo/report:2" {
+		t.Errorf("Expected the updated CronJob to run repo/report:2, but got %v", workload.Containers)
+	}
+	var patched map[string]interface{}
+	err = json.Unmarshal(stored, &patched)
+	if err != nil || patched["apiVersion"] != "batch/v1" || !strings.Contains(string(stored), "repo/report:2") {
+		t.Errorf("Expected a batch/v1 CronJob running repo/report:2 to be stored, but got %s", stored)
+	}
+	if !strings.Contains(string(stored), `"timeZone":"Europe/Berlin"`) {
+		t.Errorf("Expected the CronJob's time zone to be kept, but got %s", stored)
+	}
+
+	_, err = k.GetWorkload(KindCronJob, "weekly")
+	if errors.Cause(err) != ErrWorkloadNotFound {
+		t.Errorf("Expected ErrWorkloadNotFound, but got %v", err)
+	}
+}
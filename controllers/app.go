@@ -26,9 +26,18 @@ func App(k8sConn comms.K8sCommunicator, imageStore comms.GzrMetadataStore, boxed
 	router.HandleFunc("/", homeHandler).Methods("GET")
 	router.HandleFunc("/deployments", listDeploymentsHandler(k8sConn)).Methods("GET")
 	router.HandleFunc("/deployments/{name}", getDeploymentHandler(k8sConn)).Methods("GET")
-	router.HandleFunc("/deployments/{name}", updateDeploymentHandler(k8sConn)).Methods("PUT")
+	router.HandleFunc("/deployments/{name}", updateDeploymentHandler(k8sConn, comms.NewDeployer(k8sConn, imageStore))).Methods("PUT")
+	router.HandleFunc("/deployments/{name}/history", deploymentHistoryHandler(comms.NewDeployer(k8sConn, imageStore))).Methods("GET")
+	router.HandleFunc("/deployments/{name}/rollback", rollbackDeploymentHandler(comms.NewDeployer(k8sConn, imageStore))).Methods("POST")
 
+	router.HandleFunc("/workloads", listWorkloadsHandler(k8sConn)).Methods("GET")
+	router.HandleFunc("/workloads/{kind}", listWorkloadsHandler(k8sConn)).Methods("GET")
+	router.HandleFunc("/workloads/{kind}/{name}", getWorkloadHandler(k8sConn)).Methods("GET")
+	router.HandleFunc("/workloads/{kind}/{name}", updateWorkloadHandler(comms.NewDeployer(k8sConn, imageStore))).Methods("PUT")
+
+	router.HandleFunc("/images", findImagesHandler(imageStore)).Methods("GET")
 	router.HandleFunc("/images/{name}", getImagesHandler(imageStore)).Methods("GET")
+	router.HandleFunc("/images/{name}/events", watchImagesHandler(imageStore)).Methods("GET")
 	router.HandleFunc("/images/{name}/{version}", getImageHandler(imageStore)).Methods("GET")
 
 	//middleware setup (basically same as classic but uses our logrus for logging)
@@ -2,7 +2,9 @@ package controllers
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -16,6 +18,12 @@ import (
 type UpdateDeploymentUserType struct {
 	ContainerName string `json:"container_name"`
 	Image         string `json:"image"`
+	// Force deploys the image even if it isn't in the metadata store
+	Force bool `json:"force"`
+	// Wait holds the response until the Deployment has rolled out
+	Wait bool `json:"wait"`
+	// Timeout is how long to wait, as a duration such as "90s". It defaults to comms.DefaultRolloutTimeout
+	Timeout string `json:"timeout"`
 }
 
 // listDeploymentsHandler lists deployments in the Kubernetes instance
@@ -84,7 +92,7 @@ func getDeploymentHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
 }
 
 // updateDeploymentHandler updates a specific container on a single Deployment to a given image
-func updateDeploymentHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
+func updateDeploymentHandler(k8sConn comms.K8sCommunicator, deployer *comms.Deployer) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		var deployment *comms.GzrDeployment
@@ -115,7 +123,18 @@ func updateDeploymentHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
 			return
 		}
 
-		deployment, err = k8sConn.UpdateDeployment(userData.convertToDeploymentContainerInfo(k8sConn.GetNamespace(), name))
+		timeout := comms.DefaultRolloutTimeout
+		if userData.Timeout != "" {
+			timeout, err = time.ParseDuration(userData.Timeout)
+			if err != nil {
+				logErrorFields(err).Warn("Error parsing timeout")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		deployment, err = deployer.UpdateDeployment(userData.convertToDeploymentContainerInfo(k8sConn.GetNamespace(), name), userData.Force)
 
 		// TODO: more fine-grained error reporting
 		if errors.Cause(err) == comms.ErrContainerNotFound {
@@ -125,6 +144,45 @@ func updateDeploymentHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
 			return
 		}
 
+		if errors.Cause(err) == comms.ErrImageNotInStore {
+			logErrorFields(err).Warnf("Image %q not found in the metadata store", userData.Image)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if errors.Cause(err) == comms.ErrImageNotInRegistry {
+			logErrorFields(err).Warnf("Image %q not found in the registry", userData.Image)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err != nil {
+			logErrorFields(err).Error("Error updating deployment")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if userData.Wait {
+			deployment, err = k8sConn.WaitForRollout(name, timeout, nil)
+		}
+
+		if errors.Cause(err) == comms.ErrRolloutTimeout {
+			logErrorFields(err).Warnf("Timed out waiting for deployment %q to roll out", name)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err != nil {
+			logErrorFields(err).Error("Error waiting for deployment to roll out")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
 		jsonData, err := deployment.SerializeForWire()
 
 		// TODO: more fine-grained error reporting
@@ -139,6 +197,94 @@ func updateDeploymentHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
 	})
 }
 
+// deploymentHistoryHandler lists a single Deployment's revisions with the metadata stored for their images
+func deploymentHistoryHandler(deployer *comms.Deployer) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		revisions, err := deployer.Revisions(name)
+
+		if errors.Cause(err) == comms.ErrDeploymentNotFound {
+			logErrorFields(err).Warnf("Deployment not found for %q", name)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err != nil {
+			logErrorFields(err).Error("Error getting deployment history")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		jsonData, err := revisions.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing for wire")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
+// RollbackDeploymentUserType represents the optional payload of a rollback request
+type RollbackDeploymentUserType struct {
+	// Revision is the revision to roll back to, or 0 for the revision before the current one
+	Revision int64 `json:"revision"`
+}
+
+// rollbackDeploymentHandler rolls a single Deployment back to a previous revision
+func rollbackDeploymentHandler(deployer *comms.Deployer) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		userData := &RollbackDeploymentUserType{}
+		err := json.NewDecoder(r.Body).Decode(userData)
+		if err != nil && err != io.EOF {
+			logErrorFields(err).Warn("Error decoding JSON")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		rollback, err := deployer.Rollback(name, userData.Revision)
+
+		if errors.Cause(err) == comms.ErrDeploymentNotFound || errors.Cause(err) == comms.ErrRevisionNotFound {
+			logErrorFields(err).Warnf("Unable to roll back deployment %q", name)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if errors.Cause(err) == comms.ErrRevisionIsCurrent {
+			logErrorFields(err).Warnf("Unable to roll back deployment %q", name)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err != nil {
+			logErrorFields(err).Error("Error rolling back deployment")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		jsonData, err := rollback.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing for wire")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
 // convertToDeploymentContainerInfo creates a DeploymentContainerInfo struct
 func (updateData *UpdateDeploymentUserType) convertToDeploymentContainerInfo(namespace string, deploymentName string) *comms.DeploymentContainerInfo {
 	return &comms.DeploymentContainerInfo{
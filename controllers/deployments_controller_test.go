@@ -1,10 +1,12 @@
 package controllers
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/bypasslane/boxedRice"
 	"github.com/bypasslane/gzr/comms"
@@ -101,7 +103,9 @@ func TestUpdateDeploymentAndCountainerFound(t *testing.T) {
 		OnGetDeployment:    populatedGetDeployment,
 		OnUpdateDeployment: successfulUpdateDeployment,
 	}
-	mockImageStore := &comms.MockStore{}
+	mockImageStore := &comms.MockStore{
+		OnGet: storedGet,
+	}
 	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
 
 	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
@@ -143,7 +147,55 @@ func TestUpdateContainerNotFound(t *testing.T) {
 		OnGetDeployment:    populatedGetDeployment,
 		OnUpdateDeployment: failUpdateDeploymentNoContainer,
 	}
-	mockImageStore := &comms.MockStore{}
+	mockImageStore := &comms.MockStore{
+		OnGet: storedGet,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := updateDeployment(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %v, but received %v", http.StatusNotFound, res.Status)
+	}
+}
+
+func TestUpdateImageNotInRegistry(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnGetDeployment:    populatedGetDeployment,
+		OnUpdateDeployment: failUpdateDeploymentNoImage,
+	}
+	mockImageStore := &comms.MockStore{
+		OnGet: storedGet,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := updateDeployment(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %v, but received %v", http.StatusNotFound, res.Status)
+	}
+}
+
+func TestUpdateImageNotInStore(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnGetDeployment:    populatedGetDeployment,
+		OnUpdateDeployment: successfulUpdateDeployment,
+	}
+	mockImageStore := &comms.MockStore{
+		OnGet: emptyGet,
+	}
 	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
 
 	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
@@ -154,6 +206,145 @@ func TestUpdateContainerNotFound(t *testing.T) {
 		log.Fatalln(err)
 	}
 
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected %v, but received %v", http.StatusConflict, res.Status)
+	}
+}
+
+func TestForceUpdateImageNotInStore(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnGetDeployment:    populatedGetDeployment,
+		OnUpdateDeployment: successfulUpdateDeployment,
+	}
+	mockImageStore := &comms.MockStore{
+		OnGet: emptyGet,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := forceUpdateDeployment(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+}
+
+func TestUpdateDeploymentWait(t *testing.T) {
+	for _, rollout := range []struct {
+		onWait   func(string, time.Duration, comms.RolloutProgressFunc) (*comms.GzrDeployment, error)
+		expected int
+	}{
+		{rolledOutWait, http.StatusOK},
+		{deadlineExceededWait, http.StatusInternalServerError},
+		{timedOutWait, http.StatusGatewayTimeout},
+	} {
+		mockK8sConn := &comms.MockK8sCommunicator{
+			OnGetDeployment:    populatedGetDeployment,
+			OnUpdateDeployment: successfulUpdateDeployment,
+			OnWaitForRollout:   rollout.onWait,
+		}
+		mockImageStore := &comms.MockStore{
+			OnGet: storedGet,
+		}
+		mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+		server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+		res, err := waitUpdateDeployment(server)
+		server.Close()
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if res.StatusCode != rollout.expected {
+			t.Errorf("Expected %v, but received %v", rollout.expected, res.Status)
+		}
+	}
+}
+
+func TestRollbackDeployment(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnListRevisions:      populatedListRevisions,
+		OnRollbackDeployment: successfulRollbackDeployment,
+	}
+	mockImageStore := &comms.MockStore{
+		OnGet: storedGet,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+
+	for payload, expected := range map[string]int{
+		"":                  http.StatusOK,
+		`{"revision": 1}`:   http.StatusOK,
+		`{"revision": 2}`:   http.StatusConflict,
+		`{"revision": 5}`:   http.StatusNotFound,
+		`{"revision": "x"}`: http.StatusBadRequest,
+	} {
+		res, err := rollbackDeployment(server, payload)
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if res.StatusCode != expected {
+			t.Errorf("Expected %v for %q, but received %v", expected, payload, res.Status)
+		}
+	}
+}
+
+func TestDeploymentHistory(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnListRevisions: populatedListRevisions,
+	}
+	mockImageStore := &comms.MockStore{
+		OnGet: storedGet,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := getDeploymentHistory(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+
+	history := &comms.DeploymentRevisionList{}
+	err = json.NewDecoder(res.Body).Decode(history)
+	if err != nil {
+		t.Fatalf("Expected a JSON history, but got %s", err)
+	}
+	if len(history.Revisions) != 2 || history.Revisions[1].Containers[0].Meta == nil {
+		t.Errorf("Expected 2 revisions with stored metadata, but got %+v", history.Revisions)
+	}
+}
+
+func TestDeploymentHistoryNotFound(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnListRevisions: emptyListRevisions,
+	}
+	mockImageStore := &comms.MockStore{}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := getDeploymentHistory(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	if res.StatusCode != http.StatusNotFound {
 		t.Errorf("Expected %v, but received %v", http.StatusNotFound, res.Status)
 	}
@@ -1,14 +1,18 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"net/http"
 	"net/url"
+	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bypasslane/gzr/comms"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
 func getImagesHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
@@ -22,7 +26,15 @@ func getImagesHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
 			return
 		}
 
-		images, err := imageStore.List(name)
+		opts, err := listOptions(r.URL.Query())
+		if err != nil {
+			logErrorFields(err).Warn("Invalid list query parameters")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		images, err := imageStore.List(name, opts)
 		if err != nil {
 			logErrorFields(err).Warnf("Error retrieving images for %q", name)
 			w.WriteHeader(http.StatusBadRequest)
@@ -47,6 +59,125 @@ func getImagesHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
 	})
 }
 
+// listOptions reads the label, limit, sort and continue query parameters of an image listing
+func listOptions(params url.Values) (comms.ListOptions, error) {
+	opts := comms.ListOptions{Continue: params.Get("continue")}
+	labels, err := comms.ParseLabelSelectors(params["label"])
+	if err != nil {
+		return opts, err
+	}
+	opts.Labels = labels
+	opts.Sort, err = comms.ParseListSort(params.Get("sort"))
+	if err != nil {
+		return opts, err
+	}
+	if limit := params.Get("limit"); limit != "" {
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil || opts.Limit < 0 {
+			return opts, errors.Errorf("limit must be a positive number, got %q", limit)
+		}
+	}
+	return opts, nil
+}
+
+// eventsKeepAlive is how often an idle event stream sends a comment to keep proxies from closing it
+const eventsKeepAlive = 30 * time.Second
+
+// watchImagesHandler streams store and delete events for the images under a name as
+// Server-Sent Events until the client disconnects
+func watchImagesHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := url.QueryUnescape(mux.Vars(r)["name"])
+		if err != nil {
+			logErrorFields(err).Warn("name parameter in unexpected format")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Error("Response writer doesn't support streaming events")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		events, err := imageStore.Watch(r.Context(), name+":")
+		if err != nil {
+			logErrorFields(err).Warnf("Error watching images for %q", name)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					logErrorFields(err).Error("Error serializing image event")
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// findImagesHandler finds images across all names by the commit, tag, origin and digest query parameters
+func findImagesHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		query := comms.ImageQuery{
+			GitCommit: params.Get("commit"),
+			GitTag:    params.Get("tag"),
+			GitOrigin: params.Get("origin"),
+			Digest:    params.Get("digest"),
+		}
+		if query.IsEmpty() {
+			log.Warn("commit, tag, origin or digest query parameter required for this path")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("commit, tag, origin or digest query parameter required for this path"))
+			return
+		}
+
+		images, err := imageStore.Find(query)
+		if err != nil {
+			logErrorFields(err).Warnf("Error finding images for %+v", query)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if len(images.Images) == 0 {
+			log.Warnf("Images not found for %+v", query)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		jsonData, err := images.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing images")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
 func getImageHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		name := mux.Vars(r)["name"]
@@ -67,7 +198,7 @@ func getImageHandler(imageStore comms.GzrMetadataStore) http.HandlerFunc {
 		searchString := fmt.Sprintf("%s:%s", name, version)
 		image, err := imageStore.Get(searchString)
 		if err != nil {
-			logErrorFields(err).Warn("image store failed to retrieve value for %q", searchString)
+			logErrorFields(err).Warnf("image store failed to retrieve value for %q", searchString)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 			return
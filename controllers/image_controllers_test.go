@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bypasslane/gzr/comms"
+)
+
+func TestFindImagesFound(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnFind: populatedFind,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := findImages(server, "?commit=3b70356")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+}
+
+func TestFindImagesNotFound(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnFind: emptyFind,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := findImages(server, "?tag=v1.0.0")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %v, but received %v", http.StatusNotFound, res.Status)
+	}
+}
+
+func TestFindImagesNoQuery(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := findImages(server, "")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %v, but received %v", http.StatusBadRequest, res.Status)
+	}
+}
+
+func TestGetImagesFilteredByLabel(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnList: labeledList,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := getImages(server, "?label=team=web")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+	var images comms.ImageList
+	json.NewDecoder(res.Body).Decode(&images)
+	if len(images.Images) != 1 || images.Images[0].Name != "app:2" {
+		t.Errorf("Expected only %q, but received %d images", "app:2", len(images.Images))
+	}
+}
+
+func TestGetImagesBadLabel(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnList: labeledList,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := getImages(server, "?label=team")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %v, but received %v", http.StatusBadRequest, res.Status)
+	}
+}
+
+func TestWatchImagesStreamsEvents(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnWatch: storedEvent,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := watchImages(server)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected %v, but received %v", "text/event-stream", contentType)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if !strings.HasPrefix(string(body), "event: store\ndata: {") {
+		t.Errorf("Expected a store event, but received %q", body)
+	}
+}
+
+func TestGetImagesBadSort(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{}
+	mockImageStore := &comms.MockStore{
+		OnList: labeledList,
+	}
+	mockBoxedRiceConfig := &mockStaticFileBoxConfig{}
+
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, mockBoxedRiceConfig))
+	defer server.Close()
+	res, err := getImages(server, "?sort=name&limit=10")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %v, but received %v", http.StatusBadRequest, res.Status)
+	}
+}
@@ -1,9 +1,11 @@
 package controllers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
 	"github.com/bypasslane/gzr/comms"
 )
@@ -36,6 +38,86 @@ func failUpdateDeploymentNoContainer(dci *comms.DeploymentContainerInfo) (*comms
 	return &comms.GzrDeployment{}, comms.ErrContainerNotFound
 }
 
+func failUpdateDeploymentNoImage(dci *comms.DeploymentContainerInfo) (*comms.GzrDeployment, error) {
+	return nil, comms.ErrImageNotInRegistry
+}
+
+func populatedListWorkloads(kind comms.WorkloadKind) (*comms.WorkloadList, error) {
+	return &comms.WorkloadList{Workloads: []*comms.Workload{{Kind: comms.KindStatefulSet, Name: "name"}}}, nil
+}
+
+func populatedGetWorkload(kind comms.WorkloadKind, name string) (*comms.Workload, error) {
+	return &comms.Workload{Kind: kind, Name: name}, nil
+}
+
+func emptyGetWorkload(kind comms.WorkloadKind, name string) (*comms.Workload, error) {
+	return nil, comms.ErrWorkloadNotFound
+}
+
+func successfulUpdateWorkload(wci *comms.WorkloadContainerInfo) (*comms.Workload, error) {
+	return &comms.Workload{Kind: wci.Kind, Name: wci.Name}, nil
+}
+
+func rolledOutWait(deploymentName string, timeout time.Duration, progress comms.RolloutProgressFunc) (*comms.GzrDeployment, error) {
+	return &comms.GzrDeployment{}, nil
+}
+
+func deadlineExceededWait(deploymentName string, timeout time.Duration, progress comms.RolloutProgressFunc) (*comms.GzrDeployment, error) {
+	return &comms.GzrDeployment{}, comms.ErrProgressDeadlineExceeded
+}
+
+func timedOutWait(deploymentName string, timeout time.Duration, progress comms.RolloutProgressFunc) (*comms.GzrDeployment, error) {
+	return &comms.GzrDeployment{}, comms.ErrRolloutTimeout
+}
+
+func populatedListRevisions(deploymentName string) (*comms.DeploymentRevisionList, error) {
+	return &comms.DeploymentRevisionList{Deployment: deploymentName, Revisions: []*comms.DeploymentRevision{
+		{Revision: 1, Containers: []comms.RevisionContainer{{Name: "foobaricus", Image: "foobar:1.2.2"}}},
+		{Revision: 2, Current: true, Containers: []comms.RevisionContainer{{Name: "foobaricus", Image: "foobar:1.2.3"}}},
+	}}, nil
+}
+
+func emptyListRevisions(deploymentName string) (*comms.DeploymentRevisionList, error) {
+	return nil, comms.ErrDeploymentNotFound
+}
+
+func successfulRollbackDeployment(deploymentName string, revision *comms.DeploymentRevision) (*comms.GzrDeployment, error) {
+	return &comms.GzrDeployment{}, nil
+}
+
+func storedGet(imageName string) (*comms.Image, error) {
+	return &comms.Image{Name: imageName}, nil
+}
+
+func emptyGet(imageName string) (*comms.Image, error) {
+	return nil, nil
+}
+
+func populatedFind(query comms.ImageQuery) (*comms.ImageList, error) {
+	return &comms.ImageList{Images: []*comms.Image{{Name: "repo/app:1", Meta: comms.ImageMetadata{GitCommit: query.GitCommit}}}}, nil
+}
+
+func emptyFind(query comms.ImageQuery) (*comms.ImageList, error) {
+	return &comms.ImageList{}, nil
+}
+
+// storedEvent streams a single store event for the watched prefix, then ends the stream
+func storedEvent(ctx context.Context, prefix string) (<-chan *comms.ImageEvent, error) {
+	events := make(chan *comms.ImageEvent, 1)
+	events <- &comms.ImageEvent{Type: comms.ImageStored, Image: &comms.Image{Name: prefix + "1"}}
+	close(events)
+	return events, nil
+}
+
+// labeledList filters two labeled images by the options' labels, like a store would
+func labeledList(name string, opts comms.ListOptions) (*comms.ImageList, error) {
+	images := &comms.ImageList{Images: []*comms.Image{
+		{Name: name + ":1", Meta: comms.ImageMetadata{Labels: map[string]string{"team": "platform"}}},
+		{Name: name + ":2", Meta: comms.ImageMetadata{Labels: map[string]string{"team": "web"}}},
+	}}
+	return images.FilterByLabels(opts.Labels), nil
+}
+
 // Sends an HTTP request to provided server:
 // GET /deployments
 func getDeploymentsList(server *httptest.Server) (*http.Response, error) {
@@ -61,3 +143,82 @@ func updateDeployment(server *httptest.Server) (*http.Response, error) {
 	req, _ := http.NewRequest("PUT", server.URL+"/deployments/name", reader)
 	return client.Do(req)
 }
+
+// Sends an HTTP request to provided server:
+// PUT /deployments/{name} with force set
+func forceUpdateDeployment(server *httptest.Server) (*http.Response, error) {
+	client := new(http.Client)
+	payloadSource := `{"container_name": "foobaricus", "image": "foobar:1.2.3", "force": true}`
+	reader := strings.NewReader(payloadSource)
+	req, _ := http.NewRequest("PUT", server.URL+"/deployments/name", reader)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// PUT /deployments/{name} waiting for the rollout
+func waitUpdateDeployment(server *httptest.Server) (*http.Response, error) {
+	client := new(http.Client)
+	payloadSource := `{"container_name": "foobaricus", "image": "foobar:1.2.3", "wait": true, "timeout": "1m"}`
+	reader := strings.NewReader(payloadSource)
+	req, _ := http.NewRequest("PUT", server.URL+"/deployments/name", reader)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// GET /deployments/{name}/history
+func getDeploymentHistory(server *httptest.Server) (*http.Response, error) {
+	client := new(http.Client)
+	req, _ := http.NewRequest("GET", server.URL+"/deployments/name/history", nil)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// POST /deployments/{name}/rollback with the given payload
+func rollbackDeployment(server *httptest.Server, payloadSource string) (*http.Response, error) {
+	client := new(http.Client)
+	reader := strings.NewReader(payloadSource)
+	req, _ := http.NewRequest("POST", server.URL+"/deployments/name/rollback", reader)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// GET /workloads{path}
+func getWorkloads(server *httptest.Server, path string) (*http.Response, error) {
+	client := new(http.Client)
+	req, _ := http.NewRequest("GET", server.URL+"/workloads"+path, nil)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// PUT /workloads/{kind}/{name}
+func updateWorkload(server *httptest.Server, kind string) (*http.Response, error) {
+	client := new(http.Client)
+	payloadSource := `{"container_name": "foobaricus", "image": "foobar:1.2.3"}`
+	reader := strings.NewReader(payloadSource)
+	req, _ := http.NewRequest("PUT", server.URL+"/workloads/"+kind+"/name", reader)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// GET /images?{query}
+func findImages(server *httptest.Server, query string) (*http.Response, error) {
+	client := new(http.Client)
+	req, _ := http.NewRequest("GET", server.URL+"/images"+query, nil)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// GET /images/{name}/events
+func watchImages(server *httptest.Server) (*http.Response, error) {
+	client := new(http.Client)
+	req, _ := http.NewRequest("GET", server.URL+"/images/app/events", nil)
+	return client.Do(req)
+}
+
+// Sends an HTTP request to provided server:
+// GET /images/{name}?{query}
+func getImages(server *httptest.Server, query string) (*http.Response, error) {
+	client := new(http.Client)
+	req, _ := http.NewRequest("GET", server.URL+"/images/app"+query, nil)
+	return client.Do(req)
+}
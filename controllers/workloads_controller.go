@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bypasslane/gzr/comms"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// listWorkloadsHandler lists workloads in the Kubernetes instance, of every kind unless the path
+// or the kind query parameter names one
+func listWorkloadsHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := mux.Vars(r)["kind"]
+		if value == "" {
+			value = r.URL.Query().Get("kind")
+		}
+		var kind comms.WorkloadKind
+		if value != "" {
+			var err error
+			kind, err = comms.ParseWorkloadKind(value)
+			if err != nil {
+				logErrorFields(err).Warn("Unsupported workload kind")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		workloads, err := k8sConn.ListWorkloads(kind)
+		if err != nil {
+			logErrorFields(err).Error("Unable to list workloads")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		jsonData, err := workloads.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing for wire")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
+// getWorkloadHandler gets a single workload by kind and name from the Kubernetes instance
+func getWorkloadHandler(k8sConn comms.K8sCommunicator) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, name, ok := workloadVars(w, r)
+		if !ok {
+			return
+		}
+
+		workload, err := k8sConn.GetWorkload(kind, name)
+		if errors.Cause(err) == comms.ErrWorkloadNotFound {
+			logErrorFields(err).Warnf("Workload not found for %s %q", kind, name)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			logErrorFields(err).Error("Error getting workload")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		jsonData, err := workload.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing for wire")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
+// updateWorkloadHandler updates a specific container on a single workload to a given image
+func updateWorkloadHandler(deployer *comms.Deployer) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind, name, ok := workloadVars(w, r)
+		if !ok {
+			return
+		}
+
+		userData := &UpdateDeploymentUserType{}
+		err := json.NewDecoder(r.Body).Decode(userData)
+		if err != nil {
+			logErrorFields(err).Warn("Error decoding JSON")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		workload, err := deployer.UpdateWorkload(&comms.WorkloadContainerInfo{
+			Kind:          kind,
+			Name:          name,
+			ContainerName: userData.ContainerName,
+			Image:         userData.Image,
+		}, userData.Force)
+
+		switch errors.Cause(err) {
+		case nil:
+		case comms.ErrWorkloadNotFound, comms.ErrContainerNotFound, comms.ErrImageNotInRegistry:
+			logErrorFields(err).Warnf("Unable to update %s %q", kind, name)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		case comms.ErrImageNotInStore:
+			logErrorFields(err).Warnf("Image %q not found in the metadata store", userData.Image)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		default:
+			logErrorFields(err).Error("Error updating workload")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		jsonData, err := workload.SerializeForWire()
+		if err != nil {
+			logErrorFields(err).Error("Error serializing for wire")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Write(jsonData)
+	})
+}
+
+// workloadVars parses the kind and name path parameters, writing a 400 and returning false if
+// the kind isn't supported
+func workloadVars(w http.ResponseWriter, r *http.Request) (comms.WorkloadKind, string, bool) {
+	vars := mux.Vars(r)
+	kind, err := comms.ParseWorkloadKind(vars["kind"])
+	if err != nil {
+		logErrorFields(err).Warn("Unsupported workload kind")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return "", "", false
+	}
+	return kind, vars["name"], true
+}
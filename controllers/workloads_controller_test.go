@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bypasslane/gzr/comms"
+)
+
+func TestListWorkloads(t *testing.T) {
+	var listedKinds []comms.WorkloadKind
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnListWorkloads: func(kind comms.WorkloadKind) (*comms.WorkloadList, error) {
+			listedKinds = append(listedKinds, kind)
+			return populatedListWorkloads(kind)
+		},
+	}
+	server := httptest.NewServer(App(mockK8sConn, &comms.MockStore{}, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+
+	for _, path := range []string{"", "/statefulsets", "?kind=cronjob"} {
+		res, err := getWorkloads(server, path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected %v for %q, but received %v", http.StatusOK, path, res.Status)
+		}
+	}
+	expected := []comms.WorkloadKind{"", comms.KindStatefulSet, comms.KindCronJob}
+	if len(listedKinds) != len(expected) || listedKinds[1] != expected[1] || listedKinds[2] != expected[2] {
+		t.Errorf("Expected kinds %v to be listed, but listed %v", expected, listedKinds)
+	}
+}
+
+func TestListWorkloadsUnsupportedKind(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnListWorkloads: populatedListWorkloads,
+	}
+	server := httptest.NewServer(App(mockK8sConn, &comms.MockStore{}, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+	res, err := getWorkloads(server, "/replicasets")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %v, but received %v", http.StatusBadRequest, res.Status)
+	}
+}
+
+func TestGetWorkloadFound(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnGetWorkload: populatedGetWorkload,
+	}
+	server := httptest.NewServer(App(mockK8sConn, &comms.MockStore{}, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+	res, err := getWorkloads(server, "/daemonset/name")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+}
+
+func TestGetWorkloadNotFound(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnGetWorkload: emptyGetWorkload,
+	}
+	server := httptest.NewServer(App(mockK8sConn, &comms.MockStore{}, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+	res, err := getWorkloads(server, "/daemonset/name")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %v, but received %v", http.StatusNotFound, res.Status)
+	}
+}
+
+func TestUpdateWorkload(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnUpdateWorkload: successfulUpdateWorkload,
+	}
+	mockImageStore := &comms.MockStore{OnGet: storedGet}
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+	res, err := updateWorkload(server, "cronjobs")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected %v, but received %v", http.StatusOK, res.Status)
+	}
+}
+
+func TestUpdateWorkloadImageNotInStore(t *testing.T) {
+	mockK8sConn := &comms.MockK8sCommunicator{
+		OnUpdateWorkload: successfulUpdateWorkload,
+	}
+	mockImageStore := &comms.MockStore{OnGet: emptyGet}
+	server := httptest.NewServer(App(mockK8sConn, mockImageStore, &mockStaticFileBoxConfig{}))
+	defer server.Close()
+	res, err := updateWorkload(server, "statefulset")
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected %v, but received %v", http.StatusConflict, res.Status)
+	}
+}
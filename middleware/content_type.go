@@ -1,5 +1,5 @@
-// ContentType ensures that the "Content-Type" HTTP header is always "application/json"
-// in all responses from the server.
+// ContentType ensures that the "Content-Type" HTTP header is "application/json"
+// in all responses from the server, unless the handler set a different one.
 package middleware
 
 import (
@@ -28,7 +28,9 @@ func (r *ContentType) ServeHTTP(w http.ResponseWriter, req *http.Request, next h
 
 	res := w.(negroni.ResponseWriter)
 	res.Before(func(res negroni.ResponseWriter) {
-		w.Header().Set(HttpContentTypeKey, HttpContentTypeValue)
+		if w.Header().Get(HttpContentTypeKey) == "" {
+			w.Header().Set(HttpContentTypeKey, HttpContentTypeValue)
+		}
 	})
 	next(w, req)
 }
@@ -40,3 +40,29 @@ func TestContentTypeMiddleWare(t *testing.T) {
 		t.Errorf("Expected %v, got %v", HttpContentTypeValue, contentType)
 	}
 }
+
+func TestContentTypeMiddleWareKeepsHandlerContentType(t *testing.T) {
+	muxer := mux.NewRouter()
+	muxer.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(HttpContentTypeKey, "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	n := negroni.New()
+	n.Use(NewContentType())
+	n.UseHandler(muxer)
+
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentType := response.Header.Get(HttpContentTypeKey)
+
+	if contentType != "text/event-stream" {
+		t.Errorf("Expected %v, got %v", "text/event-stream", contentType)
+	}
+}